@@ -0,0 +1,250 @@
+// Package auth verifies the signed tokens clients connect with. Tokens are JSON Web Tokens
+// signed with HS256 (a shared secret) or RS256 (an RSA key pair), and the subject is the user ID.
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Signing algorithms
+const (
+	ALG_HS256 = "HS256"
+	ALG_RS256 = "RS256"
+)
+
+// LEEWAY is how many seconds a token's times can be off by, to allow for clock skew
+const LEEWAY = 30
+
+var (
+	// ErrInvalidToken is returned for tokens which are malformed, or whose signature doesn't check out
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for tokens used outside the times they are valid for
+	ErrExpiredToken = errors.New("token expired")
+	// ErrUnknownKey is returned for tokens signed with an algorithm or key ID the verifier has no key for
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// Claims are the parts of a token the game cares about. Times are in unix seconds, and 0 when unset.
+// Every token must expire, so one without an exp is refused.
+type Claims struct {
+	// Subject is the user ID the token was issued to
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// header is the first part of a token
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Verifier checks tokens against a set of keys. Keys are looked up by the token's algorithm,
+// so a token can't pass off one kind of key as another, and by its key ID if it has one.
+type Verifier struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	// now returns the current time, and is replaced in tests
+	now func() time.Time
+}
+
+// NewVerifier returns a verifier with no keys, which rejects every token until some are added
+func NewVerifier() *Verifier {
+	return &Verifier{
+		hmacKeys: make(map[string][]byte),
+		rsaKeys:  make(map[string]*rsa.PublicKey),
+		now:      time.Now,
+	}
+}
+
+// AddHMACKey lets the verifier accept HS256 tokens signed with secret. kid is the key ID tokens
+// name it by, and can be empty.
+func (v *Verifier) AddHMACKey(kid string, secret []byte) {
+	v.hmacKeys[kid] = secret
+}
+
+// AddRSAKey lets the verifier accept RS256 tokens signed with the private half of key.
+// kid is the key ID tokens name it by, and can be empty.
+func (v *Verifier) AddRSAKey(kid string, key *rsa.PublicKey) {
+	v.rsaKeys[kid] = key
+}
+
+// AddRSAKeyPEM adds an RSA public key in PEM form, either PKIX ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY")
+func (v *Verifier) AddRSAKeyPEM(kid string, data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no PEM data found for key %q", kid)
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		v.AddRSAKey(kid, key)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an RSA key", kid)
+		}
+		v.AddRSAKey(kid, rsaKey)
+	default:
+		return fmt.Errorf("unexpected PEM block %s for key %q", block.Type, kid)
+	}
+	return nil
+}
+
+// Verify checks a token's signature and times, and returns its claims.
+// Tokens without a subject are rejected, since they don't say who the player is.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, fmt.Errorf("%w: expected 3 parts, got %d", ErrInvalidToken, len(parts))
+	}
+	h := header{}
+	if err := decodePart(parts[0], &h); err != nil {
+		return Claims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+	if err := v.checkSignature(h, parts[0]+"."+parts[1], sig); err != nil {
+		return Claims{}, err
+	}
+
+	c := Claims{}
+	if err := decodePart(parts[1], &c); err != nil {
+		return Claims{}, err
+	}
+	now := v.now().Unix()
+	if c.ExpiresAt == 0 {
+		return Claims{}, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now > c.ExpiresAt+LEEWAY {
+		return Claims{}, fmt.Errorf("%w: expired at %d", ErrExpiredToken, c.ExpiresAt)
+	}
+	if c.NotBefore != 0 && now < c.NotBefore-LEEWAY {
+		return Claims{}, fmt.Errorf("%w: not valid until %d", ErrExpiredToken, c.NotBefore)
+	}
+	if c.Subject == "" {
+		return Claims{}, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return c, nil
+}
+
+// checkSignature verifies the signature over the header and claims with the key the header names.
+// Without a key ID, any key for the algorithm will do.
+func (v *Verifier) checkSignature(h header, signed string, sig []byte) error {
+	switch h.Alg {
+	case ALG_HS256:
+		for kid, secret := range v.hmacKeys {
+			if h.Kid != "" && kid != h.Kid {
+				continue
+			}
+			if hmac.Equal(sig, hs256(signed, secret)) {
+				return nil
+			}
+		}
+	case ALG_RS256:
+		digest := sha256.Sum256([]byte(signed))
+		for kid, key := range v.rsaKeys {
+			if h.Kid != "" && kid != h.Kid {
+				continue
+			}
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf("%w: algorithm %q", ErrUnknownKey, h.Alg)
+	}
+	if !v.hasKey(h) {
+		return fmt.Errorf("%w: %s key %q", ErrUnknownKey, h.Alg, h.Kid)
+	}
+	return fmt.Errorf("%w: bad signature", ErrInvalidToken)
+}
+
+// hasKey reports whether there is any key the token could have been signed with
+func (v *Verifier) hasKey(h header) bool {
+	if h.Alg == ALG_HS256 {
+		_, found := v.hmacKeys[h.Kid]
+		return found || (h.Kid == "" && len(v.hmacKeys) > 0)
+	}
+	_, found := v.rsaKeys[h.Kid]
+	return found || (h.Kid == "" && len(v.rsaKeys) > 0)
+}
+
+// hs256 returns the HMAC-SHA256 of signed
+func hs256(signed string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// decodePart decodes a base64url encoded JSON part of a token
+func decodePart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: bad encoding", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// encodeParts returns the header and claims of a new token, ready to be signed
+func encodeParts(alg, kid string, c Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: alg, Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(claims), nil
+}
+
+// SignHS256 issues an HS256 token for the claims. It's meant for tests and local tools;
+// in production tokens come from whatever service logs players in.
+func SignHS256(c Claims, kid string, secret []byte) (string, error) {
+	signed, err := encodeParts(ALG_HS256, kid, c)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(hs256(signed, secret)), nil
+}
+
+// SignRS256 issues an RS256 token for the claims, like SignHS256
+func SignRS256(c Claims, kid string, key *rsa.PrivateKey) (string, error) {
+	signed, err := encodeParts(ALG_RS256, kid, c)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRSAKey generates a throwaway key pair
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	return key
+}
+
+// newSecret generates a random HMAC secret
+func newSecret(t *testing.T) []byte {
+	t.Helper()
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatalf("unable to generate secret: %s", err)
+	}
+	return secret
+}
+
+func TestVerify(t *testing.T) {
+	secret, otherSecret := newSecret(t), newSecret(t)
+	key, otherKey := newRSAKey(t), newRSAKey(t)
+	now := time.Unix(1_600_000_000, 0)
+
+	v := NewVerifier()
+	v.now = func() time.Time { return now }
+	v.AddHMACKey("", secret)
+	v.AddRSAKey("main", &key.PublicKey)
+
+	valid := Claims{Subject: "alice", IssuedAt: now.Unix(), ExpiresAt: now.Unix() + 3600}
+	hs := func(c Claims, kid string, secret []byte) string {
+		token, err := SignHS256(c, kid, secret)
+		if err != nil {
+			t.Fatalf("unable to sign: %s", err)
+		}
+		return token
+	}
+	rs := func(c Claims, kid string, key *rsa.PrivateKey) string {
+		token, err := SignRS256(c, kid, key)
+		if err != nil {
+			t.Fatalf("unable to sign: %s", err)
+		}
+		return token
+	}
+	// a token claiming to be unsigned, which must never be accepted
+	parts := strings.Split(hs(valid, "", secret), ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	// the claims of one token with the signature of another
+	forged := strings.Split(hs(Claims{Subject: "mallory"}, "", secret), ".")
+	tampered := parts[0] + "." + forged[1] + "." + parts[2]
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"hmac", hs(valid, "", secret), nil},
+		{"rsa", rs(valid, "main", key), nil},
+		{"rsa without kid", rs(valid, "", key), nil},
+		{"within leeway", hs(Claims{Subject: "alice", ExpiresAt: now.Unix() - LEEWAY}, "", secret), nil},
+		{"wrong secret", hs(valid, "", otherSecret), ErrInvalidToken},
+		{"wrong rsa key", rs(valid, "main", otherKey), ErrInvalidToken},
+		{"unknown kid", rs(valid, "other", key), ErrUnknownKey},
+		{"expired", hs(Claims{Subject: "alice", ExpiresAt: now.Unix() - LEEWAY - 1}, "", secret), ErrExpiredToken},
+		{"not yet valid", hs(Claims{Subject: "alice", ExpiresAt: now.Unix() + 7200, NotBefore: now.Unix() + 3600}, "", secret), ErrExpiredToken},
+		{"hmac without expiry", hs(Claims{Subject: "alice"}, "", secret), ErrInvalidToken},
+		{"rsa without expiry", rs(Claims{Subject: "alice"}, "main", key), ErrInvalidToken},
+		{"no subject", hs(Claims{ExpiresAt: now.Unix() + 3600}, "", secret), ErrInvalidToken},
+		{"alg none", none, ErrUnknownKey},
+		{"tampered claims", tampered, ErrInvalidToken},
+		{"garbage", "not.a.token", ErrInvalidToken},
+		{"too few parts", "abc", ErrInvalidToken},
+	}
+	for _, c := range cases {
+		claims, err := v.Verify(c.token)
+		if c.err == nil {
+			if err != nil || claims.Subject != "alice" {
+				t.Errorf("%s: expected alice, got %+v %v", c.name, claims, err)
+			}
+		} else if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	key := newRSAKey(t)
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+
+	v := NewVerifier()
+	if err := v.AddRSAKeyPEM("", pubPEM); err != nil {
+		t.Fatalf("unable to add PEM key: %s", err)
+	}
+	// the public key is no secret, so it mustn't work as an HMAC key
+	token, _ := SignHS256(Claims{Subject: "mallory"}, "", pubPEM)
+	if _, err := v.Verify(token); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("an HS256 token should need an HMAC key, got %v", err)
+	}
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	if err := v.AddRSAKeyPEM("pkcs1", pkcs1); err != nil {
+		t.Errorf("unable to add PKCS #1 key: %s", err)
+	}
+	if err := v.AddRSAKeyPEM("bad", []byte("not a key")); err == nil {
+		t.Errorf("expected an error for a key which isn't PEM")
+	}
+}
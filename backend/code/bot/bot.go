@@ -0,0 +1,160 @@
+// Package bot implements computer opponents, with pluggable strategies for picking a move
+package bot
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+)
+
+// PREFIX marks a player ID (and the new game opponent option) as a bot, e.g. "bot:markov"
+const PREFIX = "bot:"
+
+// Strategy picks the bot's next move
+type Strategy interface {
+	// Next returns a move from the ruleset, given the game's resolved rounds (oldest first),
+	// the bot's own player ID and the opponent's player ID
+	Next(rules *game.Ruleset, history []game.RoundResult, self, opponent string) string
+}
+
+// IsBot returns true if the player ID belongs to a bot
+func IsBot(playerID string) bool {
+	return strings.HasPrefix(playerID, PREFIX)
+}
+
+// New returns the strategy named by a bot player ID or option, e.g. "bot:random" or "bot:markov:3"
+func New(name string) (Strategy, error) {
+	parts := strings.Split(strings.TrimPrefix(name, PREFIX), ":")
+	switch parts[0] {
+	case "random":
+		return Random{}, nil
+	case "frequency":
+		return Frequency{}, nil
+	case "winstay":
+		return WinStay{}, nil
+	case "markov":
+		order := 2
+		if len(parts) > 1 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: markov order must be a positive number: %s", game.ErrInvalidOptions, parts[1])
+			}
+			order = n
+		}
+		return Markov{Order: order}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown bot strategy %s", game.ErrInvalidOptions, name)
+}
+
+// randomMove picks any move in the ruleset
+func randomMove(rules *game.Ruleset) string {
+	return rules.Moves[rand.Intn(len(rules.Moves))].ID
+}
+
+// counter picks a move which beats the given move, at random if there are several
+func counter(rules *game.Ruleset, move string) string {
+	options := []string{}
+	for _, m := range rules.Moves {
+		if beats, _ := rules.Beats(m.ID, move); beats {
+			options = append(options, m.ID)
+		}
+	}
+	if len(options) == 0 {
+		return randomMove(rules)
+	}
+	return options[rand.Intn(len(options))]
+}
+
+// Random plays uniformly at random
+type Random struct{}
+
+// Next picks any move
+func (Random) Next(rules *game.Ruleset, history []game.RoundResult, self, opponent string) string {
+	return randomMove(rules)
+}
+
+// Frequency plays whatever beats the opponent's most common move so far
+type Frequency struct{}
+
+// Next counters the opponent's favourite move
+func (Frequency) Next(rules *game.Ruleset, history []game.RoundResult, self, opponent string) string {
+	counts := make(map[string]int)
+	favourite := ""
+	for _, r := range history {
+		move := r.Plays[opponent]
+		if move == "" {
+			continue
+		}
+		counts[move]++
+		if favourite == "" || counts[move] > counts[favourite] {
+			favourite = move
+		}
+	}
+	if favourite == "" {
+		return randomMove(rules)
+	}
+	return counter(rules, favourite)
+}
+
+// Markov predicts the opponent's next move from what they played after their last Order moves
+type Markov struct {
+	Order int
+}
+
+// Next counters the move the opponent most often made after their current sequence
+func (m Markov) Next(rules *game.Ruleset, history []game.RoundResult, self, opponent string) string {
+	moves := []string{}
+	for _, r := range history {
+		if move := r.Plays[opponent]; move != "" {
+			moves = append(moves, move)
+		}
+	}
+	if len(moves) <= m.Order {
+		return randomMove(rules)
+	}
+
+	recent := strings.Join(moves[len(moves)-m.Order:], ",")
+	counts := make(map[string]int)
+	predicted := ""
+	for i := m.Order; i < len(moves); i++ {
+		if strings.Join(moves[i-m.Order:i], ",") != recent {
+			continue
+		}
+		counts[moves[i]]++
+		if predicted == "" || counts[moves[i]] > counts[predicted] {
+			predicted = moves[i]
+		}
+	}
+	if predicted == "" {
+		return randomMove(rules)
+	}
+	return counter(rules, predicted)
+}
+
+// WinStay repeats a move that won, and switches to a different move after losing or tying
+type WinStay struct{}
+
+// Next stays on a win and shifts otherwise
+func (WinStay) Next(rules *game.Ruleset, history []game.RoundResult, self, opponent string) string {
+	if len(history) == 0 {
+		return randomMove(rules)
+	}
+	last := history[len(history)-1]
+	mine := last.Plays[self]
+	for _, w := range last.Winners {
+		if w == self && mine != "" {
+			return mine
+		}
+	}
+
+	options := []string{}
+	for _, m := range rules.Moves {
+		if m.ID != mine {
+			options = append(options, m.ID)
+		}
+	}
+	return options[rand.Intn(len(options))]
+}
@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+)
+
+func rules(t *testing.T) *game.Ruleset {
+	t.Helper()
+	r, err := game.LookupRuleset("rpsls")
+	if err != nil {
+		t.Fatalf("no rpsls ruleset: %s", err)
+	}
+	return r
+}
+
+// history builds resolved rounds where the human plays the given moves and the bot plays rock
+func history(moves ...string) []game.RoundResult {
+	h := []game.RoundResult{}
+	for i, m := range moves {
+		h = append(h, game.RoundResult{
+			Round: i + 1,
+			Plays: map[string]string{"human": m, "bot:test": "rock"},
+		})
+	}
+	return h
+}
+
+// assertBeats checks the bot's move beats the expected human move
+func assertBeats(t *testing.T, r *game.Ruleset, name, move, human string) {
+	t.Helper()
+	if beats, _ := r.Beats(move, human); !beats {
+		t.Errorf("%s: %s does not beat %s", name, move, human)
+	}
+}
+
+func TestNew(t *testing.T) {
+	valid := map[string]Strategy{
+		"bot:random":    Random{},
+		"bot:frequency": Frequency{},
+		"bot:winstay":   WinStay{},
+		"bot:markov":    Markov{Order: 2},
+		"bot:markov:3":  Markov{Order: 3},
+	}
+	for name, expected := range valid {
+		s, err := New(name)
+		if err != nil {
+			t.Errorf("%s should be a valid strategy: %s", name, err)
+		}
+		if s != expected {
+			t.Errorf("%s: expected %#v, got %#v", name, expected, s)
+		}
+	}
+
+	for _, name := range []string{"bot:psychic", "bot:markov:zero", "bot:markov:0"} {
+		if _, err := New(name); err == nil {
+			t.Errorf("%s should not be a valid strategy", name)
+		}
+	}
+
+	if !IsBot("bot:random") || IsBot("robot") {
+		t.Errorf("IsBot should only match the bot prefix")
+	}
+}
+
+func TestRandom(t *testing.T) {
+	r := rules(t)
+	for i := 0; i < 50; i++ {
+		if move := (Random{}).Next(r, nil, "bot:test", "human"); !r.ValidPlay(move) {
+			t.Fatalf("random made an invalid move %s", move)
+		}
+	}
+}
+
+func TestFrequency(t *testing.T) {
+	r := rules(t)
+	h := history("rock", "paper", "rock", "spock", "rock")
+	for i := 0; i < 20; i++ {
+		assertBeats(t, r, "frequency", Frequency{}.Next(r, h, "bot:test", "human"), "rock")
+	}
+	if move := (Frequency{}).Next(r, nil, "bot:test", "human"); !r.ValidPlay(move) {
+		t.Errorf("frequency with no history should still make a valid move: %s", move)
+	}
+}
+
+func TestMarkov(t *testing.T) {
+	r := rules(t)
+	// the human cycles rock, paper, scissors, so after paper, scissors it will play rock
+	h := history("rock", "paper", "scissors", "rock", "paper", "scissors", "rock", "paper", "scissors")
+	m := Markov{Order: 2}
+	for i := 0; i < 20; i++ {
+		assertBeats(t, r, "markov", m.Next(r, h, "bot:test", "human"), "rock")
+	}
+
+	short := history("rock")
+	if move := m.Next(r, short, "bot:test", "human"); !r.ValidPlay(move) {
+		t.Errorf("markov without enough history should still make a valid move: %s", move)
+	}
+}
+
+func TestWinStay(t *testing.T) {
+	r := rules(t)
+	won := []game.RoundResult{{
+		Round:   1,
+		Plays:   map[string]string{"human": "scissors", "bot:test": "rock"},
+		Winners: []string{"bot:test"},
+	}}
+	if move := (WinStay{}).Next(r, won, "bot:test", "human"); move != "rock" {
+		t.Errorf("win-stay should repeat a winning move, played %s", move)
+	}
+
+	lost := []game.RoundResult{{
+		Round:   1,
+		Plays:   map[string]string{"human": "paper", "bot:test": "rock"},
+		Winners: []string{"human"},
+	}}
+	for i := 0; i < 20; i++ {
+		if move := (WinStay{}).Next(r, lost, "bot:test", "human"); move == "rock" || !r.ValidPlay(move) {
+			t.Fatalf("lose-shift should switch to another valid move, played %s", move)
+		}
+	}
+}
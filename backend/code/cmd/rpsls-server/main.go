@@ -0,0 +1,195 @@
+// rpsls-server runs the game over plain HTTP websockets, without Lambda or API Gateway.
+// It feeds $connect, $disconnect and default messages into the same service as the lambda.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gorilla/websocket"
+	"github.com/jbarratt/rpsls/backend/code/auth"
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/service"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// CONNID_LENGTH matches the rough size of an API Gateway connection id
+const CONNID_LENGTH = 16
+
+var upgrader = websocket.Upgrader{
+	// This is a development server, so allow the frontend to be served from anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Server holds the shared service and the sockets it can write to
+type Server struct {
+	svc      *service.LambdaSvc
+	notifier *notify.LocalNotifier
+}
+
+// ServeHTTP upgrades the request and pumps messages into the service until the socket closes
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("unable to upgrade connection", err.Error())
+		return
+	}
+	defer ws.Close()
+
+	connectionID, err := game.GenerateRandomString(CONNID_LENGTH)
+	if err != nil {
+		log.Println("unable to generate connection id", err.Error())
+		return
+	}
+	srv.notifier.Add(connectionID, ws)
+	defer srv.notifier.Remove(connectionID)
+
+	// the token is checked like API Gateway would, but the socket is already open, so it's closed on refusal
+	if srv.dispatch(connectionID, "$connect", "", r.URL.Query()) != http.StatusOK {
+		return
+	}
+	defer srv.dispatch(connectionID, "$disconnect", "", nil)
+
+	for {
+		_, body, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("connection closed unexpectedly", err.Error())
+			}
+			return
+		}
+		srv.dispatch(connectionID, "$default", string(body), nil)
+	}
+}
+
+// dispatch builds the same event API Gateway would send and routes it like the lambda handler,
+// returning the status code
+func (srv *Server) dispatch(connectionID, routeKey, body string, query url.Values) int {
+	params := make(map[string]string, len(query))
+	for k := range query {
+		params[k] = query.Get(k)
+	}
+	e := events.APIGatewayWebsocketProxyRequest{
+		Body:                  body,
+		QueryStringParameters: params,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     routeKey,
+		},
+	}
+
+	var resp interface{}
+	var err error
+	switch routeKey {
+	case "$connect":
+		resp, err = srv.svc.Connect(e)
+	case "$disconnect":
+		resp, err = srv.svc.Disconnect(e)
+	default:
+		resp, err = srv.svc.Default(e)
+	}
+
+	if err != nil {
+		log.Printf("%s failed for %s: %s\n", routeKey, connectionID, err)
+		return http.StatusInternalServerError
+	}
+	if r, ok := resp.(events.APIGatewayProxyResponse); ok && r.StatusCode != http.StatusOK {
+		log.Printf("%s returned %d for %s\n", routeKey, r.StatusCode, connectionID)
+		return r.StatusCode
+	}
+	return http.StatusOK
+}
+
+// sweep resolves rounds which have run out of time and matches queued players, checking every
+// interval until the process exits
+func (srv *Server) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := srv.svc.ExpireRounds(now.Unix()); err != nil {
+			log.Println("unable to expire rounds", err.Error())
+		}
+		if err := srv.svc.Matchmake(now.Unix()); err != nil {
+			log.Println("unable to matchmake", err.Error())
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	backend := flag.String("store", "memory", "where to keep games: memory or dynamo")
+	table := flag.String("table", os.Getenv("TABLE_NAME"), "DynamoDB table to store games in")
+	rulesets := flag.String("rulesets", "rulesets", "directory of extra rulesets to load, if it exists")
+	sweep := flag.Duration("sweep", time.Second, "how often to check for rounds which have run out of time, and match queued players")
+	blocklist := flag.String("chat-blocklist", "", "comma separated words to mask in chat")
+	chatHistory := flag.Int("chat-history", service.CHAT_HISTORY, "how many chat messages to keep with each game")
+	hmacSecret := flag.String("auth-hmac-secret", os.Getenv("AUTH_HMAC_SECRET"), "secret for HS256 connection tokens, which are then required")
+	rsaKey := flag.String("auth-rsa-key", "", "PEM file with the RSA public key for RS256 connection tokens, which are then required")
+	flag.Parse()
+
+	if _, err := os.Stat(*rulesets); err == nil {
+		if err := game.LoadRulesetDir(*rulesets); err != nil {
+			log.Fatalln("unable to load rulesets", err.Error())
+		}
+	}
+	log.Printf("rulesets available: %v\n", game.RulesetNames())
+
+	var st store.GameStore
+	switch *backend {
+	case "memory":
+		st = store.NewMemory()
+	case "dynamo":
+		sess, err := session.NewSession(&aws.Config{
+			Region: aws.String(os.Getenv("AWS_REGION")),
+		})
+		if err != nil {
+			log.Fatalln("unable to create session", err.Error())
+		}
+		st = store.New(dynamodb.New(sess), *table)
+	default:
+		log.Fatalln("unknown store", *backend)
+	}
+
+	no := notify.NewLocalNotifier()
+	srv := &Server{
+		svc:      service.NewLambdaSvc(st, no),
+		notifier: no,
+	}
+	srv.svc.SetChat(service.ChatConfig{
+		Filter:  service.Blocklist(strings.Split(*blocklist, ",")),
+		History: *chatHistory,
+	})
+
+	if *hmacSecret != "" || *rsaKey != "" {
+		v := auth.NewVerifier()
+		if *hmacSecret != "" {
+			v.AddHMACKey("", []byte(*hmacSecret))
+		}
+		if *rsaKey != "" {
+			data, err := ioutil.ReadFile(*rsaKey)
+			if err != nil {
+				log.Fatalln("unable to read RSA key", err.Error())
+			}
+			if err := v.AddRSAKeyPEM("", data); err != nil {
+				log.Fatalln("unable to load RSA key", err.Error())
+			}
+		}
+		srv.svc.SetAuth(v)
+		log.Printf("connections need a token in the %q query parameter\n", service.TOKEN_PARAM)
+	}
+
+	go srv.sweep(*sweep)
+
+	http.Handle("/", srv)
+	log.Printf("listening for websockets on %s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,28 @@
+package game
+
+import "errors"
+
+// Errors returned by the game, wrapped with more detail. Callers can match them with errors.Is
+// to tell players what went wrong.
+var (
+	// ErrGameFull is returned when every seat in the game is taken
+	ErrGameFull = errors.New("game is already full")
+	// ErrInvalidPlay is returned for a move which isn't in the game's ruleset
+	ErrInvalidPlay = errors.New("invalid play")
+	// ErrMatchOver is returned for any play after the match has finished
+	ErrMatchOver = errors.New("match is over")
+	// ErrWrongMode is returned for plain plays in fair play games, and commits or reveals in other games
+	ErrWrongMode = errors.New("wrong action for this game")
+	// ErrOutOfTurn is returned for actions the round isn't ready for, like revealing before everyone commits
+	ErrOutOfTurn = errors.New("out of turn")
+	// ErrAlreadyPlayed is returned when a player acts twice in the same round
+	ErrAlreadyPlayed = errors.New("already played this round")
+	// ErrInvalidCommitment is returned for commitments which aren't a sha256 hash
+	ErrInvalidCommitment = errors.New("invalid commitment")
+	// ErrInvalidOptions is returned when a new game's settings don't make sense together
+	ErrInvalidOptions = errors.New("invalid game options")
+	// ErrMatchNotOver is returned for things which can only happen once the match has finished, like a rematch
+	ErrMatchNotOver = errors.New("match is not over")
+	// ErrUnknownRuleset is returned when looking up a ruleset which isn't registered
+	ErrUnknownRuleset = errors.New("unknown ruleset")
+)
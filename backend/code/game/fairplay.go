@@ -0,0 +1,95 @@
+package game
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// In fair play games nobody, including the server, sees a move before every player is locked in.
+// Players first commit to sha256(play + nonce), then reveal the play and nonce once all have
+// committed. A reveal which doesn't match the commitment forfeits the round.
+
+// Commitment returns the hex encoded hash a client commits to for a play and nonce
+func Commitment(play, nonce string) string {
+	sum := sha256.Sum256([]byte(play + nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// AllCommitted is true once every player has committed in a fair play round
+func (g *Game) AllCommitted() bool {
+	return g.Full() && g.PlayCount == len(g.Players)
+}
+
+// Commit records the acting player's commitment for the current round
+func (gc *GameContext) Commit(commitment string) error {
+	if !gc.Game.FairPlay {
+		return fmt.Errorf("%w: game does not use commit and reveal, just play", ErrWrongMode)
+	}
+	if gc.Game.MatchOver {
+		return fmt.Errorf("%w, no more plays allowed", ErrMatchOver)
+	}
+	if b, err := hex.DecodeString(commitment); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("%w: must be a hex encoded sha256 hash", ErrInvalidCommitment)
+	}
+	if gc.ActingPlayer.Round >= gc.Game.Round {
+		return fmt.Errorf("%w: already committed", ErrAlreadyPlayed)
+	}
+
+	gc.ActingPlayer.Commitment = commitment
+	gc.ActingPlayer.Forfeit = false
+	gc.ActingPlayer.Round = gc.Game.Round
+	gc.Game.PlayCount++
+	return nil
+}
+
+// Reveal checks the acting player's play against their commitment.
+// A mismatched or invalid play is still recorded, as a forfeit.
+func (gc *GameContext) Reveal(play, nonce string) error {
+	if !gc.Game.FairPlay {
+		return fmt.Errorf("%w: game does not use commit and reveal, just play", ErrWrongMode)
+	}
+	if !gc.Game.AllCommitted() {
+		return fmt.Errorf("%w: cannot reveal until every player has committed", ErrOutOfTurn)
+	}
+	if gc.ActingPlayer.Round != gc.Game.Round {
+		return fmt.Errorf("%w: no commitment to reveal this round", ErrOutOfTurn)
+	}
+	if gc.ActingPlayer.RevealRound >= gc.Game.Round {
+		return fmt.Errorf("%w: already revealed", ErrAlreadyPlayed)
+	}
+
+	gc.reveal(play)
+	if !gc.Game.Rules().ValidPlay(play) || Commitment(play, nonce) != gc.ActingPlayer.Commitment {
+		gc.ActingPlayer.Play = ""
+		gc.ActingPlayer.Forfeit = true
+	}
+	return nil
+}
+
+// reveal marks the acting player as revealed for this round
+func (gc *GameContext) reveal(play string) {
+	gc.ActingPlayer.Play = play
+	gc.ActingPlayer.RevealRound = gc.Game.Round
+	gc.Game.RevealCount++
+}
+
+// AllRevealed is true once every player has revealed (or forfeited) in a fair play round
+func (g *Game) AllRevealed() bool {
+	return g.AllCommitted() && g.RevealCount == len(g.Players)
+}
+
+// ForfeitUnrevealed forfeits every player who committed but has not revealed this round,
+// so a round can be resolved when someone refuses to reveal. It returns the forfeiting player IDs.
+func (g *Game) ForfeitUnrevealed() []string {
+	forfeits := []string{}
+	for _, p := range g.SortedPlayers() {
+		if p.Round == g.Round && p.RevealRound < g.Round {
+			gc := GameContext{Game: g, ActingPlayer: p}
+			gc.reveal("")
+			p.Forfeit = true
+			forfeits = append(forfeits, p.ID)
+		}
+	}
+	return forfeits
+}
@@ -0,0 +1,95 @@
+package game
+
+import "testing"
+
+func fairGame(t *testing.T) (*Game, *GameContext, *GameContext) {
+	t.Helper()
+	g := NewGame()
+	g.FairPlay = true
+	p1, _ := NewGameContext("first", "1addr", g)
+	p2, _ := NewGameContext("second", "2addr", g)
+	return g, p1, p2
+}
+
+func TestCommitReveal(t *testing.T) {
+	g, p1, p2 := fairGame(t)
+
+	if err := p1.Play("rock"); err == nil {
+		t.Errorf("fair play games should not accept plain plays")
+	}
+	if err := p1.Commit("rock"); err == nil {
+		t.Errorf("commitments must be hashes")
+	}
+	if err := p1.Commit(Commitment("rock", "n1")); err != nil {
+		t.Fatalf("unable to commit: %s", err)
+	}
+	if err := p1.Commit(Commitment("paper", "n1")); err == nil {
+		t.Errorf("should not be able to commit twice in a round")
+	}
+	if err := p1.Reveal("rock", "n1"); err == nil {
+		t.Errorf("should not be able to reveal before everyone commits")
+	}
+
+	p2.Commit(Commitment("scissors", "n2"))
+	if err := p1.Reveal("rock", "n1"); err != nil {
+		t.Fatalf("unable to reveal: %s", err)
+	}
+	if err := p1.Reveal("rock", "n1"); err == nil {
+		t.Errorf("should not be able to reveal twice")
+	}
+	if err := g.AdvanceGame(); err == nil {
+		t.Errorf("should not advance until everyone reveals")
+	}
+
+	p2.Reveal("scissors", "n2")
+	if err := g.AdvanceGame(); err != nil {
+		t.Fatalf("unable to advance: %s", err)
+	}
+	if g.Winner != "first" || g.Players["first"].Score != 1 {
+		t.Errorf("rock should beat scissors: %+v", g)
+	}
+	if g.RevealCount != 0 || g.PlayCount != 0 {
+		t.Errorf("counts should reset for the next round: %+v", g)
+	}
+}
+
+func TestBadRevealForfeits(t *testing.T) {
+	g, p1, p2 := fairGame(t)
+	p1.Commit(Commitment("rock", "n1"))
+	p2.Commit(Commitment("scissors", "n2"))
+
+	// first tries to switch to paper after seeing nothing, but the hash gives it away
+	p1.Reveal("paper", "n1")
+	p2.Reveal("scissors", "n2")
+	if !p1.ActingPlayer.Forfeit {
+		t.Errorf("a mismatched reveal should forfeit")
+	}
+	g.AdvanceGame()
+	if g.Winner != "second" || g.Players["second"].Score != 1 || g.Players["first"].Score != 0 {
+		t.Errorf("the player who didn't forfeit should win: %+v", g)
+	}
+	if len(g.LastResult.Forfeits) != 1 || g.LastResult.Forfeits[0] != "first" {
+		t.Errorf("forfeit should be recorded: %+v", g.LastResult)
+	}
+	if p1.ActingPlayer.Forfeit {
+		t.Errorf("forfeit flags should be cleared for the next round")
+	}
+}
+
+func TestForfeitUnrevealed(t *testing.T) {
+	g, p1, p2 := fairGame(t)
+	p1.Commit(Commitment("rock", "n1"))
+	p2.Commit(Commitment("scissors", "n2"))
+	p2.Reveal("scissors", "n2")
+
+	forfeits := g.ForfeitUnrevealed()
+	if len(forfeits) != 1 || forfeits[0] != "first" {
+		t.Errorf("only the unrevealed player should forfeit: %v", forfeits)
+	}
+	if err := g.AdvanceGame(); err != nil {
+		t.Fatalf("round should resolve after forfeits: %s", err)
+	}
+	if g.Winner != "second" {
+		t.Errorf("second should win by forfeit: %+v", g)
+	}
+}
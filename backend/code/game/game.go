@@ -5,16 +5,24 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
-var (
-	winnermap map[string]string
-	plays     []string
+const (
+	// NUM_PLAYERS is the number of seats in a game unless it asks for more
+	NUM_PLAYERS = 2
+	// MAX_PLAYERS is the largest room allowed
+	MAX_PLAYERS   = 8
+	GAMEID_LENGTH = 5
 )
 
+// Scoring modes, which decide who gets points in a round
 const (
-	NUM_PLAYERS   = 2
-	GAMEID_LENGTH = 5
+	// SCORING_PAIRWISE gives a point for every opponent beaten
+	SCORING_PAIRWISE = ""
+	// SCORING_FREE_FOR_ALL gives a single point to each player who beat someone and lost to nobody
+	SCORING_FREE_FOR_ALL = "ffa"
 )
 
 // Player stores relevant information about a current player's state
@@ -32,8 +40,33 @@ type Player struct {
 	Score int
 	// Game is the GameID this player is associated with
 	Game string
-	// WonLastRound identifies if the player ... won the last round
+	// WonLastRound identifies if the player scored in the last round
 	WonLastRound bool
+	// Commitment is the hash committed to this round in fair play games
+	Commitment string
+	// RevealRound is the last round the player revealed their play in fair play games
+	RevealRound int
+	// Forfeit is set when the player gave up the current round, e.g. with a bad reveal
+	Forfeit bool
+	// Misses counts the rounds the player forfeited by running out of time
+	Misses int
+	// Offline is set when the player's connection dropped, until they join again
+	Offline bool
+	// Pending is the latest message which couldn't be delivered to the player, kept until they
+	// join again. The game doesn't look inside it.
+	Pending string
+	// Protocol is the message protocol version the player's client speaks
+	Protocol int
+	// Rematch is set once the match is over if the player wants to play again
+	Rematch bool
+}
+
+// Spectator is a connection following a game without playing in it
+type Spectator struct {
+	// Address is the connection id of the spectator
+	Address string
+	// Protocol is the message protocol version the spectator's client speaks
+	Protocol int
 }
 
 // Game is the key data for the overall game
@@ -48,8 +81,62 @@ type Game struct {
 	Players map[string]*Player
 	// RoundSummary is a summary of the previous round ("Rock beats Scissors")
 	RoundSummary string
-	// Winner is the Player.ID which won the last round.
+	// Winner is the Player.ID which won the last round, or "Tie" if nobody scored.
+	// It is empty when several players scored, see Winners.
 	Winner string
+	// Winners are the Player.IDs which scored in the last round
+	Winners []string
+	// MaxPlayers is the number of seats, NUM_PLAYERS if unset
+	MaxPlayers int
+	// Scoring is how points are handed out each round
+	Scoring string
+	// Ruleset is the name of the ruleset the game is played with
+	Ruleset string
+	// Format decides when the match is over
+	Format MatchFormat
+	// MatchOver is set once the format's end condition is met, after which no more plays are allowed
+	MatchOver bool
+	// MatchWinner is the Player.ID which won the match, or "Tie"
+	MatchWinner string
+	// FairPlay games use Commit and Reveal instead of Play
+	FairPlay bool
+	// RevealCount keeps track of how many reveals have been submitted in fair play games
+	RevealCount int
+	// RoundTimeout is how many seconds players have to act once a round starts, 0 for no limit
+	RoundTimeout int
+	// Deadline is when the current round expires, in unix seconds, or 0 if the clock isn't running
+	Deadline int64
+	// MaxMisses is how many rounds a player can run out of time in before forfeiting the match, 0 for no limit
+	MaxMisses int
+	// Series is the ID of the series of rematches the game is part of, empty until the first rematch
+	Series string
+	// NextGame is the ID of the rematch, once everyone agreed to it
+	NextGame string
+	// Tournament is the ID of the tournament the game is a match in, if any
+	Tournament string
+	// Spectators is indexed by Spectator.Address, and are told about each round once it resolves
+	Spectators map[string]*Spectator
+	// Version counts changes to the round state: every play, commit, reveal and resolved round.
+	// The store only resolves a round for the version it was worked out from, so it is resolved once.
+	Version int
+	// LastResult is the round most recently resolved by AdvanceGame.
+	// It is not loaded back from storage, see the store's History
+	LastResult *RoundResult
+}
+
+// RoundResult is the record of a single resolved round
+type RoundResult struct {
+	// Round is the number of the round that was resolved
+	Round int
+	// Plays is indexed by Player.ID and holds each player's move
+	Plays map[string]string
+	// Winner and Winners are the values the game had after the round
+	Winner  string
+	Winners []string
+	// Summary is the RoundSummary, e.g. "Rock crushes Lizard"
+	Summary string
+	// Forfeits are the Player.IDs which forfeited the round
+	Forfeits []string
 }
 
 // GameContext is a container for the overall game and the current player action in it
@@ -64,22 +151,29 @@ func (gc *GameContext) AssignPlayer(p *Player) error {
 	_, found := gc.Game.Players[p.ID]
 	if found {
 		gc.ActingPlayer = gc.Game.Players[p.ID]
-		// update address in case it has changed
+		// update address in case it has changed, which also means they're back online
 		gc.ActingPlayer.Address = p.Address
+		gc.ActingPlayer.Offline = false
 	} else {
-		if len(gc.Game.Players) < 2 {
+		if len(gc.Game.Players) < gc.Game.Seats() {
 			gc.Game.Players[p.ID] = p
 			gc.ActingPlayer = p
 		} else {
-			return errors.New("unable to assign player, game is already full")
+			return fmt.Errorf("unable to assign player: %w", ErrGameFull)
 		}
 	}
 	return nil
 }
 
 func (gc *GameContext) Play(play string) error {
-	if !ValidPlay(play) {
-		return errors.New("Invalid play " + play)
+	if gc.Game.MatchOver {
+		return fmt.Errorf("%w, no more plays allowed", ErrMatchOver)
+	}
+	if gc.Game.FairPlay {
+		return fmt.Errorf("%w: game uses commit and reveal, plays must be committed first", ErrWrongMode)
+	}
+	if !gc.Game.Rules().ValidPlay(play) {
+		return fmt.Errorf("%w %s", ErrInvalidPlay, play)
 	}
 	gc.ActingPlayer.Play = play
 	if gc.ActingPlayer.Round < gc.Game.Round {
@@ -93,13 +187,60 @@ func (gc *GameContext) Play(play string) error {
 func NewGame() *Game {
 	id, _ := GenerateRandomString(GAMEID_LENGTH)
 	g := Game{
-		ID:      id,
-		Round:   1,
-		Players: make(map[string]*Player),
+		ID:         id,
+		Round:      1,
+		Players:    make(map[string]*Player),
+		Spectators: make(map[string]*Spectator),
+		Ruleset:    DEFAULT_RULESET,
 	}
 	return &g
 }
 
+// Seats returns how many players the game can hold
+func (g *Game) Seats() int {
+	if g.MaxPlayers == 0 {
+		return NUM_PLAYERS
+	}
+	return g.MaxPlayers
+}
+
+// Full is true once every seat is taken. Rounds don't resolve, and clocks don't start,
+// until then, so nobody who joins a room late misses its first round.
+func (g *Game) Full() bool {
+	return len(g.Players) >= g.Seats()
+}
+
+// ValidateRoom checks the number of seats and the scoring mode
+func (g *Game) ValidateRoom() error {
+	if g.MaxPlayers != 0 && (g.MaxPlayers < NUM_PLAYERS || g.MaxPlayers > MAX_PLAYERS) {
+		return fmt.Errorf("%w: games need between %d and %d players, not %d", ErrInvalidOptions, NUM_PLAYERS, MAX_PLAYERS, g.MaxPlayers)
+	}
+	switch g.Scoring {
+	case SCORING_PAIRWISE, SCORING_FREE_FOR_ALL:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown scoring mode %s", ErrInvalidOptions, g.Scoring)
+}
+
+// SortedPlayers returns the game's players ordered by ID
+func (g *Game) SortedPlayers() []*Player {
+	players := make([]*Player, 0, len(g.Players))
+	for _, p := range g.Players {
+		players = append(players, p)
+	}
+	sort.Slice(players, func(i, j int) bool { return players[i].ID < players[j].ID })
+	return players
+}
+
+// Rules returns the ruleset this game is played with, falling back to the default
+func (g *Game) Rules() *Ruleset {
+	r, err := LookupRuleset(g.Ruleset)
+	if err != nil {
+		r, _ = LookupRuleset(DEFAULT_RULESET)
+	}
+	return r
+}
+
 func NewGameContext(playerID, playerAddress string, game *Game) (*GameContext, error) {
 	gc := GameContext{
 		Game: game,
@@ -113,71 +254,131 @@ func NewGameContext(playerID, playerAddress string, game *Game) (*GameContext, e
 }
 
 // AdvanceGame updates a game to resolve the winner, round, etc
+// Every pair of players is compared, and points handed out according to the scoring mode
 func (g *Game) AdvanceGame() error {
 
-	if g.PlayCount != NUM_PLAYERS {
+	if g.MatchOver {
+		return errors.New("Cannot advance game, the match is over")
+	}
+
+	if !g.Full() || g.PlayCount != len(g.Players) {
 		return errors.New("Cannot advance game without all plays")
 	}
 
-	// This seems kind of annoying but this is the only place needing to compare players
-	players := make([]*Player, NUM_PLAYERS)
-	i := 0
-	for k := range g.Players {
-		// have to make a read only copy
-		players[i] = g.Players[k]
-		i++
+	if g.FairPlay && !g.AllRevealed() {
+		return errors.New("Cannot advance game without all reveals")
 	}
 
-	// Check for a tie
-	if players[0].Play == players[1].Play {
-		g.Winner = "Tie"
-		g.RoundSummary = fmt.Sprintf("Both played %s, tie", players[0].Play)
-	} else {
-		beats, how := Beats(players[0].Play, players[1].Play)
-		if beats {
-			g.Winner = players[0].ID
-			players[0].Score++
-			players[0].WonLastRound = true
-			players[1].WonLastRound = false
-			g.RoundSummary = fmt.Sprintf("%s %s %s", players[0].Play, how, players[1].Play)
-		} else {
-			_, how = Beats(players[1].Play, players[0].Play)
-			g.Winner = players[1].ID
-			players[1].Score++
-			players[1].WonLastRound = true
-			players[1].WonLastRound = false
-			g.RoundSummary = fmt.Sprintf("%s %s %s", players[1].Play, how, players[0].Play)
+	rules := g.Rules()
+	players := g.SortedPlayers()
+	wins := make(map[string]int, len(players))
+	losses := make(map[string]int, len(players))
+	summaries := []string{}
+
+	forfeits := []string{}
+	for _, p := range players {
+		if p.Forfeit {
+			forfeits = append(forfeits, p.ID)
+			summaries = append(summaries, fmt.Sprintf("%s forfeits", p.ID))
+		}
+	}
+
+	for i, a := range players {
+		for _, b := range players[i+1:] {
+			// a forfeiting player loses to everyone who didn't forfeit
+			if a.Forfeit || b.Forfeit {
+				if !a.Forfeit {
+					wins[a.ID]++
+					losses[b.ID]++
+				} else if !b.Forfeit {
+					wins[b.ID]++
+					losses[a.ID]++
+				}
+				continue
+			}
+			if a.Play == b.Play {
+				continue
+			}
+			winner, loser := a, b
+			beats, how := rules.Beats(a.Play, b.Play)
+			if !beats {
+				winner, loser = b, a
+				_, how = rules.Beats(b.Play, a.Play)
+			}
+			wins[winner.ID]++
+			losses[loser.ID]++
+			summaries = append(summaries, fmt.Sprintf("%s %s %s", rules.DisplayName(winner.Play), how, rules.DisplayName(loser.Play)))
 		}
 	}
 
+	g.Winners = []string{}
+	for _, p := range players {
+		points := wins[p.ID]
+		if g.Scoring == SCORING_FREE_FOR_ALL {
+			points = 0
+			if wins[p.ID] > 0 && losses[p.ID] == 0 {
+				points = 1
+			}
+		}
+		p.Score += points
+		p.WonLastRound = points > 0
+		if p.WonLastRound {
+			g.Winners = append(g.Winners, p.ID)
+		}
+	}
+
+	switch len(g.Winners) {
+	case 0:
+		g.Winner = "Tie"
+	case 1:
+		g.Winner = g.Winners[0]
+	default:
+		g.Winner = ""
+	}
+
+	switch {
+	case len(summaries) == 0 && len(players) == 2:
+		g.RoundSummary = fmt.Sprintf("Both played %s, tie", rules.DisplayName(players[0].Play))
+	case len(summaries) == 0:
+		g.RoundSummary = fmt.Sprintf("Everyone played %s, tie", rules.DisplayName(players[0].Play))
+	default:
+		g.RoundSummary = strings.Join(summaries, ", ")
+	}
+
+	g.LastResult = &RoundResult{
+		Round:    g.Round,
+		Plays:    make(map[string]string, len(players)),
+		Winner:   g.Winner,
+		Winners:  g.Winners,
+		Summary:  g.RoundSummary,
+		Forfeits: forfeits,
+	}
+	for _, p := range players {
+		g.LastResult.Plays[p.ID] = p.Play
+		p.Forfeit = false
+	}
+	g.RevealCount = 0
+	g.Deadline = 0
+
 	g.Round = g.Round + 1
 	g.PlayCount = 0
+	g.checkMatchOver()
 
 	return nil
 }
 
-// Beats returns if first would beat second
+// Beats returns if first would beat second under the default ruleset
 // also returns the verb needed <first> crushes <second>
 // In the case of a tie, returns "ties" as the verb
 func Beats(first, second string) (bool, string) {
-	if first == second {
-		return false, "ties"
-	}
-	how, ok := winnermap[first+":"+second]
-	if ok {
-		return true, how
-	}
-	return false, ""
+	r, _ := LookupRuleset(DEFAULT_RULESET)
+	return r.Beats(first, second)
 }
 
-// ValidPlay returns true only if the play given in the argument is valid
+// ValidPlay returns true only if the play given in the argument is valid under the default ruleset
 func ValidPlay(play string) bool {
-	for _, val := range plays {
-		if val == play {
-			return true
-		}
-	}
-	return false
+	r, _ := LookupRuleset(DEFAULT_RULESET)
+	return r.ValidPlay(play)
 }
 
 // GenerateRandomString returns a random string of length N
@@ -207,19 +408,3 @@ func GenerateRandomBytes(n int) ([]byte, error) {
 
 	return b, nil
 }
-
-func init() {
-	plays = []string{"rock", "paper", "scissors", "lizard", "spock"}
-	winnermap = map[string]string{
-		"scissors:paper":  "cuts",
-		"scissors:lizard": "decapitates",
-		"paper:rock":      "covers",
-		"paper:spock":     "disproves",
-		"rock:lizard":     "crushes",
-		"rock:scissors":   "smashes",
-		"lizard:paper":    "eats",
-		"lizard:spock":    "poisons",
-		"spock:scissors":  "beams up",
-		"spock:rock":      "sits on",
-	}
-}
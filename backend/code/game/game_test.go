@@ -1,6 +1,8 @@
 package game
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -60,3 +62,208 @@ func TestGame(t *testing.T) {
 		t.Errorf("should not be able to advance game if one player makes multiple plays")
 	}
 }
+
+// room creates a game with one player per play and makes every play
+func room(t *testing.T, scoring string, plays ...string) *Game {
+	t.Helper()
+	g := NewGame()
+	g.MaxPlayers = len(plays)
+	g.Scoring = scoring
+	for i, play := range plays {
+		gc, err := NewGameContext(fmt.Sprintf("p%d", i+1), "addr", g)
+		if err != nil {
+			t.Fatalf("unable to seat player %d: %s", i+1, err)
+		}
+		gc.Play(play)
+	}
+	return g
+}
+
+func TestMultiPlayerScoring(t *testing.T) {
+	cases := []struct {
+		name    string
+		scoring string
+		plays   []string
+		scores  []int
+		winner  string
+	}{
+		{"pairwise cycle", SCORING_PAIRWISE, []string{"rock", "paper", "scissors"}, []int{1, 1, 1}, ""},
+		{"pairwise sweep", SCORING_PAIRWISE, []string{"rock", "scissors", "lizard"}, []int{2, 1, 0}, ""},
+		{"pairwise all tie", SCORING_PAIRWISE, []string{"spock", "spock", "spock"}, []int{0, 0, 0}, "Tie"},
+		{"ffa cycle", SCORING_FREE_FOR_ALL, []string{"rock", "paper", "scissors"}, []int{0, 0, 0}, "Tie"},
+		{"ffa sweep", SCORING_FREE_FOR_ALL, []string{"rock", "scissors", "lizard"}, []int{1, 0, 0}, "p1"},
+		{"ffa shared", SCORING_FREE_FOR_ALL, []string{"rock", "rock", "scissors", "lizard"}, []int{1, 1, 0, 0}, ""},
+	}
+
+	for _, c := range cases {
+		g := room(t, c.scoring, c.plays...)
+		if err := g.AdvanceGame(); err != nil {
+			t.Fatalf("%s: unable to advance: %s", c.name, err)
+		}
+		for i, score := range c.scores {
+			p := g.Players[fmt.Sprintf("p%d", i+1)]
+			if p.Score != score {
+				t.Errorf("%s: p%d should have %d points, has %d", c.name, i+1, score, p.Score)
+			}
+			if p.WonLastRound != (score > 0) {
+				t.Errorf("%s: p%d WonLastRound should match scoring", c.name, i+1)
+			}
+		}
+		if g.Winner != c.winner {
+			t.Errorf("%s: expected winner %q, got %q (%v)", c.name, c.winner, g.Winner, g.Winners)
+		}
+	}
+}
+
+func TestMultiPlayerRoom(t *testing.T) {
+	g := NewGame()
+	g.MaxPlayers = 3
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := NewGameContext(id, "addr", g); err != nil {
+			t.Errorf("%s should have a seat: %s", id, err)
+		}
+	}
+	if _, err := NewGameContext("d", "addr", g); err == nil {
+		t.Errorf("a three seat room should not take a fourth player")
+	}
+
+	g.Players["a"].Play = "rock"
+	g.PlayCount = 2
+	if err := g.AdvanceGame(); err == nil {
+		t.Errorf("should wait for every player in the room")
+	}
+
+	early := NewGame()
+	early.MaxPlayers = 3
+	early.RoundTimeout = 30
+	for _, id := range []string{"a", "b"} {
+		gc, _ := NewGameContext(id, "addr", early)
+		gc.Play("rock")
+	}
+	early.StartClock(100)
+	if err := early.AdvanceGame(); err == nil || early.Deadline != 0 {
+		t.Errorf("the first round should wait for every seat to fill")
+	}
+	gc, _ := NewGameContext("c", "addr", early)
+	gc.Play("paper")
+	if err := early.AdvanceGame(); err != nil {
+		t.Errorf("should advance once the room is full: %s", err)
+	}
+
+	g.MaxPlayers = MAX_PLAYERS + 1
+	if err := g.ValidateRoom(); err == nil {
+		t.Errorf("rooms bigger than MAX_PLAYERS should be invalid")
+	}
+	g.MaxPlayers = 3
+	g.Scoring = "golf"
+	if err := g.ValidateRoom(); err == nil {
+		t.Errorf("unknown scoring should be invalid")
+	}
+}
+
+func TestStatsDelta(t *testing.T) {
+	g := NewGame()
+	g.Format = MatchFormat{Mode: MATCH_BEST_OF, Length: 3}
+	p1, _ := NewGameContext("first", "1addr", g)
+	p2, _ := NewGameContext("second", "2addr", g)
+
+	if len(g.StatsDelta()) != 0 {
+		t.Errorf("no stats before a round resolves")
+	}
+
+	totals := map[string]*Stats{"first": {}, "second": {}}
+	for _, plays := range [][2]string{{"rock", "rock"}, {"rock", "scissors"}, {"paper", "rock"}} {
+		p1.Play(plays[0])
+		p2.Play(plays[1])
+		if err := g.AdvanceGame(); err != nil {
+			t.Fatalf("unable to advance: %s", err)
+		}
+		for id, d := range g.StatsDelta() {
+			totals[id].Add(d)
+		}
+	}
+
+	expected := Stats{Games: 1, MatchesWon: 1, RoundsWon: 2, RoundsTied: 1, Moves: map[string]int{"rock": 2, "paper": 1}}
+	if !reflect.DeepEqual(*totals["first"], expected) {
+		t.Errorf("unexpected stats for first: %+v", *totals["first"])
+	}
+	expected = Stats{Games: 1, MatchesLost: 1, RoundsLost: 2, RoundsTied: 1, Moves: map[string]int{"rock": 2, "scissors": 1}}
+	if !reflect.DeepEqual(*totals["second"], expected) {
+		t.Errorf("unexpected stats for second: %+v", *totals["second"])
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	g := NewGame()
+	g.MaxPlayers = 3
+	for _, id := range []string{"a", "b", "c"} {
+		NewGameContext(id, id+"addr", g)
+	}
+	g.Players["a"].Score = 1
+	g.Players["b"].Score = 3
+	g.Players["c"].Score = 1
+	// a won on forfeit, despite the lower score
+	g.MatchWinner = "a"
+
+	cases := []struct {
+		a, b     string
+		expected float64
+	}{
+		{"a", "b", 1},
+		{"b", "a", 0},
+		{"b", "c", 1},
+		{"c", "b", 0},
+		{"c", "a", 0},
+	}
+	for _, c := range cases {
+		if got := g.MatchScore(c.a, c.b); got != c.expected {
+			t.Errorf("%s against %s: expected %v, got %v", c.a, c.b, c.expected, got)
+		}
+	}
+
+	g.MatchWinner = "Tie"
+	if got := g.MatchScore("a", "c"); got != 0.5 {
+		t.Errorf("level players should draw, got %v", got)
+	}
+}
+
+func TestRematch(t *testing.T) {
+	g := NewGame()
+	g.Ruleset = "rps"
+	g.Format = MatchFormat{Mode: MATCH_BEST_OF, Length: 1}
+	g.RoundTimeout = 30
+	p1, _ := NewGameContext("first", "1addr", g)
+	p2, _ := NewGameContext("second", "2addr", g)
+
+	p1.ActingPlayer.Rematch = true
+	p2.ActingPlayer.Rematch = true
+	if g.RematchAgreed() {
+		t.Errorf("there's no rematch before the match is over")
+	}
+	p1.Play("rock")
+	p2.Play("scissors")
+	g.AdvanceGame()
+	p2.ActingPlayer.Rematch = false
+	if !g.MatchOver || g.RematchAgreed() {
+		t.Errorf("everyone has to agree to a rematch")
+	}
+	p2.ActingPlayer.Rematch = true
+	if !g.RematchAgreed() {
+		t.Errorf("rematch should be agreed")
+	}
+
+	next := g.Rematch()
+	if next.ID == g.ID || next.Series != g.ID || next.SeriesID() != g.ID || g.SeriesID() != g.ID {
+		t.Errorf("the rematch should start a series named after the first game: %s %s", next.ID, next.Series)
+	}
+	if next.Ruleset != "rps" || next.Format != g.Format || next.RoundTimeout != 30 || next.Round != 1 || next.MatchOver {
+		t.Errorf("the rematch should be a fresh game with the same settings: %+v", next)
+	}
+	p := next.Players["first"]
+	if len(next.Players) != 2 || p.Address != "1addr" || p.Score != 0 || p.Game != next.ID || p.Rematch {
+		t.Errorf("the rematch should have the same players, starting over: %+v", p)
+	}
+	if again := next.Rematch(); again.Series != g.ID {
+		t.Errorf("later rematches stay in the same series: %s", again.Series)
+	}
+}
@@ -0,0 +1,87 @@
+package game
+
+import "fmt"
+
+// Match formats, which decide when a game is over
+const (
+	// MATCH_ENDLESS games never finish, rounds just keep going
+	MATCH_ENDLESS = ""
+	// MATCH_BEST_OF games finish when someone has won a majority of Length rounds
+	MATCH_BEST_OF = "bestof"
+	// MATCH_FIRST_TO games finish when someone has Length points
+	MATCH_FIRST_TO = "firstto"
+	// MATCH_ROUNDS games finish after exactly Length rounds, highest score wins
+	MATCH_ROUNDS = "rounds"
+)
+
+// MatchFormat describes how long a game runs
+type MatchFormat struct {
+	Mode   string
+	Length int
+}
+
+// Validate checks that the format is one we know how to finish
+func (f MatchFormat) Validate() error {
+	switch f.Mode {
+	case MATCH_ENDLESS:
+		return nil
+	case MATCH_BEST_OF:
+		if f.Length%2 == 0 {
+			return fmt.Errorf("%w: best of %d would allow a drawn match, use an odd number", ErrInvalidOptions, f.Length)
+		}
+	case MATCH_FIRST_TO, MATCH_ROUNDS:
+	default:
+		return fmt.Errorf("%w: unknown match format %s", ErrInvalidOptions, f.Mode)
+	}
+	if f.Length < 1 {
+		return fmt.Errorf("%w: match length must be at least 1, not %d", ErrInvalidOptions, f.Length)
+	}
+	return nil
+}
+
+// pointsToWin returns how many points end the match, or 0 if points alone never do
+func (f MatchFormat) pointsToWin() int {
+	switch f.Mode {
+	case MATCH_BEST_OF:
+		return f.Length/2 + 1
+	case MATCH_FIRST_TO:
+		return f.Length
+	}
+	return 0
+}
+
+// checkMatchOver marks the game finished, and records the match winner, if the format says so.
+// It is called after a round has been scored and the round counter advanced.
+// When several players share the top score a points target doesn't end the match;
+// play goes on until one of them pulls ahead. A fixed number of rounds ends in a "Tie".
+func (g *Game) checkMatchOver() {
+	var leader *Player
+	tied := false
+	for _, p := range g.SortedPlayers() {
+		if leader == nil || p.Score > leader.Score {
+			leader = p
+			tied = false
+		} else if p.Score == leader.Score {
+			tied = true
+		}
+	}
+	if leader == nil {
+		return
+	}
+
+	switch g.Format.Mode {
+	case MATCH_BEST_OF, MATCH_FIRST_TO:
+		if !tied && leader.Score >= g.Format.pointsToWin() {
+			g.MatchOver = true
+			g.MatchWinner = leader.ID
+		}
+	case MATCH_ROUNDS:
+		if g.Round > g.Format.Length {
+			g.MatchOver = true
+			g.MatchWinner = leader.ID
+			if tied {
+				g.MatchWinner = "Tie"
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package game
+
+import "testing"
+
+// playRounds runs rounds where first plays firstPlays[i] against second's secondPlays[i]
+func playRounds(t *testing.T, g *Game, firstPlays, secondPlays []string) {
+	t.Helper()
+	for i := range firstPlays {
+		p1, _ := NewGameContext("first", "1addr", g)
+		p2, _ := NewGameContext("second", "2addr", g)
+		if err := p1.Play(firstPlays[i]); err != nil {
+			t.Fatalf("round %d: first could not play: %s", i+1, err)
+		}
+		if err := p2.Play(secondPlays[i]); err != nil {
+			t.Fatalf("round %d: second could not play: %s", i+1, err)
+		}
+		if err := g.AdvanceGame(); err != nil {
+			t.Fatalf("round %d: could not advance: %s", i+1, err)
+		}
+	}
+}
+
+func TestMatchFormats(t *testing.T) {
+	cases := []struct {
+		name        string
+		format      MatchFormat
+		first       []string
+		second      []string
+		over        bool
+		matchWinner string
+	}{
+		{"endless", MatchFormat{}, []string{"rock", "rock", "rock"}, []string{"scissors", "scissors", "scissors"}, false, ""},
+		{"best of 3 decided early", MatchFormat{MATCH_BEST_OF, 3}, []string{"rock", "rock"}, []string{"scissors", "scissors"}, true, "first"},
+		{"best of 3 not yet", MatchFormat{MATCH_BEST_OF, 3}, []string{"rock", "rock"}, []string{"scissors", "paper"}, false, ""},
+		{"best of 3 ties extend", MatchFormat{MATCH_BEST_OF, 3}, []string{"rock", "rock", "rock"}, []string{"scissors", "rock", "rock"}, false, ""},
+		{"first to 1", MatchFormat{MATCH_FIRST_TO, 1}, []string{"rock"}, []string{"paper"}, true, "second"},
+		{"fixed rounds", MatchFormat{MATCH_ROUNDS, 2}, []string{"rock", "rock"}, []string{"scissors", "rock"}, true, "first"},
+		{"fixed rounds drawn", MatchFormat{MATCH_ROUNDS, 2}, []string{"rock", "paper"}, []string{"scissors", "scissors"}, true, "Tie"},
+	}
+
+	for _, c := range cases {
+		g := NewGame()
+		g.Format = c.format
+		playRounds(t, g, c.first, c.second)
+		if g.MatchOver != c.over || g.MatchWinner != c.matchWinner {
+			t.Errorf("%s: expected over=%v winner=%q, got over=%v winner=%q", c.name, c.over, c.matchWinner, g.MatchOver, g.MatchWinner)
+		}
+	}
+}
+
+func TestMatchSharedTarget(t *testing.T) {
+	g := room(t, SCORING_PAIRWISE, "rock", "paper", "scissors")
+	g.Format = MatchFormat{MATCH_FIRST_TO, 1}
+	if err := g.AdvanceGame(); err != nil {
+		t.Fatalf("unable to advance: %s", err)
+	}
+	if g.MatchOver {
+		t.Fatalf("everyone reached the target together, match should go on, winner %q", g.MatchWinner)
+	}
+
+	for id, play := range map[string]string{"p1": "rock", "p2": "scissors", "p3": "lizard"} {
+		gc, _ := NewGameContext(id, "addr", g)
+		if err := gc.Play(play); err != nil {
+			t.Fatalf("%s could not play: %s", id, err)
+		}
+	}
+	if err := g.AdvanceGame(); err != nil {
+		t.Fatalf("unable to advance: %s", err)
+	}
+	if !g.MatchOver || g.MatchWinner != "p1" {
+		t.Errorf("expected p1 to win once ahead, got over=%v winner=%q", g.MatchOver, g.MatchWinner)
+	}
+}
+
+func TestMatchOverRejectsPlays(t *testing.T) {
+	g := NewGame()
+	g.Format = MatchFormat{MATCH_FIRST_TO, 1}
+	playRounds(t, g, []string{"rock"}, []string{"scissors"})
+
+	p1, _ := NewGameContext("first", "1addr", g)
+	if err := p1.Play("rock"); err == nil {
+		t.Errorf("should not be able to play once the match is over")
+	}
+	g.PlayCount = NUM_PLAYERS
+	if err := g.AdvanceGame(); err == nil {
+		t.Errorf("should not be able to advance once the match is over")
+	}
+}
+
+func TestMatchFormatValidate(t *testing.T) {
+	valid := []MatchFormat{{}, {MATCH_BEST_OF, 5}, {MATCH_FIRST_TO, 3}, {MATCH_ROUNDS, 10}}
+	for _, f := range valid {
+		if err := f.Validate(); err != nil {
+			t.Errorf("%+v should be valid: %s", f, err)
+		}
+	}
+	invalid := []MatchFormat{{MATCH_BEST_OF, 4}, {MATCH_FIRST_TO, 0}, {MATCH_ROUNDS, -1}, {"sudden death", 1}}
+	for _, f := range invalid {
+		if err := f.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", f)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DEFAULT_RULESET is used by games which don't name a ruleset
+const DEFAULT_RULESET = "rpsls"
+
+var (
+	rulesetsMu sync.RWMutex
+	rulesets   map[string]*Ruleset
+)
+
+// Move is a single throw allowed by a ruleset
+type Move struct {
+	// ID is what players send, e.g. "spock"
+	ID string `json:"id" yaml:"id"`
+	// Name is how the move is displayed, e.g. "Spock"
+	Name string `json:"name" yaml:"name"`
+}
+
+// Relation records that Winner <Verb> Loser, e.g. "paper covers rock"
+type Relation struct {
+	Winner string `json:"winner" yaml:"winner"`
+	Verb   string `json:"verb" yaml:"verb"`
+	Loser  string `json:"loser" yaml:"loser"`
+}
+
+// Ruleset is a set of moves and which of them beats which
+type Ruleset struct {
+	Name      string     `json:"name" yaml:"name"`
+	Moves     []Move     `json:"moves" yaml:"moves"`
+	Relations []Relation `json:"relations" yaml:"relations"`
+
+	// winners maps "winner:loser" to the verb, filled in by Validate
+	winners map[string]string
+	// names maps move ID to display name, filled in by Validate
+	names map[string]string
+}
+
+// Validate checks the ruleset is usable and indexes it for lookups.
+// Every pair of different moves must have exactly one winner (a tournament graph)
+func (r *Ruleset) Validate() error {
+	if r.Name == "" {
+		return errors.New("ruleset has no name")
+	}
+	if len(r.Moves) < 2 {
+		return fmt.Errorf("ruleset %s needs at least two moves", r.Name)
+	}
+
+	r.names = make(map[string]string, len(r.Moves))
+	for _, m := range r.Moves {
+		if m.ID == "" {
+			return fmt.Errorf("ruleset %s has a move with no id", r.Name)
+		}
+		if m.ID != strings.ToLower(m.ID) {
+			return fmt.Errorf("ruleset %s: move id %s must be lowercase", r.Name, m.ID)
+		}
+		if _, found := r.names[m.ID]; found {
+			return fmt.Errorf("ruleset %s: duplicate move %s", r.Name, m.ID)
+		}
+		r.names[m.ID] = m.Name
+		if m.Name == "" {
+			r.names[m.ID] = m.ID
+		}
+	}
+
+	r.winners = make(map[string]string, len(r.Relations))
+	for _, rel := range r.Relations {
+		if _, found := r.names[rel.Winner]; !found {
+			return fmt.Errorf("ruleset %s: relation uses unknown move %s", r.Name, rel.Winner)
+		}
+		if _, found := r.names[rel.Loser]; !found {
+			return fmt.Errorf("ruleset %s: relation uses unknown move %s", r.Name, rel.Loser)
+		}
+		if rel.Winner == rel.Loser {
+			return fmt.Errorf("ruleset %s: %s cannot beat itself", r.Name, rel.Winner)
+		}
+		if _, found := r.winners[rel.Loser+":"+rel.Winner]; found {
+			return fmt.Errorf("ruleset %s: %s and %s both beat each other", r.Name, rel.Winner, rel.Loser)
+		}
+		if _, found := r.winners[rel.Winner+":"+rel.Loser]; found {
+			return fmt.Errorf("ruleset %s: %s beats %s more than once", r.Name, rel.Winner, rel.Loser)
+		}
+		r.winners[rel.Winner+":"+rel.Loser] = rel.Verb
+	}
+
+	for i, a := range r.Moves {
+		for _, b := range r.Moves[i+1:] {
+			_, ab := r.winners[a.ID+":"+b.ID]
+			_, ba := r.winners[b.ID+":"+a.ID]
+			if !ab && !ba {
+				return fmt.Errorf("ruleset %s: no winner between %s and %s", r.Name, a.ID, b.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// Beats returns if first would beat second
+// also returns the verb needed <first> crushes <second>
+// In the case of a tie, returns "ties" as the verb
+func (r *Ruleset) Beats(first, second string) (bool, string) {
+	if first == second {
+		return false, "ties"
+	}
+	how, ok := r.winners[first+":"+second]
+	if ok {
+		return true, how
+	}
+	return false, ""
+}
+
+// ValidPlay returns true only if the play is one of the ruleset's moves
+func (r *Ruleset) ValidPlay(play string) bool {
+	_, found := r.names[play]
+	return found
+}
+
+// DisplayName returns the human friendly name for a move
+func (r *Ruleset) DisplayName(play string) string {
+	name, found := r.names[play]
+	if !found {
+		return play
+	}
+	return name
+}
+
+// ParseRuleset decodes a ruleset from JSON or YAML (format "json" or "yaml") and validates it
+func ParseRuleset(data []byte, format string) (*Ruleset, error) {
+	r := &Ruleset{}
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, r)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, r)
+	default:
+		return nil, errors.New("unknown ruleset format " + format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadRuleset reads a ruleset file, using the extension to pick JSON or YAML
+func LoadRuleset(path string) (*Ruleset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRuleset(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// LoadRulesetDir registers every .json, .yaml and .yml ruleset in a directory
+func LoadRulesetDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		switch filepath.Ext(f.Name()) {
+		case ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		r, err := LoadRuleset(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if err := RegisterRuleset(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterRuleset validates a ruleset and makes it available to games by name
+func RegisterRuleset(r *Ruleset) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	rulesetsMu.Lock()
+	defer rulesetsMu.Unlock()
+	rulesets[r.Name] = r
+	return nil
+}
+
+// LookupRuleset returns a registered ruleset by name
+func LookupRuleset(name string) (*Ruleset, error) {
+	rulesetsMu.RLock()
+	defer rulesetsMu.RUnlock()
+	r, found := rulesets[name]
+	if !found {
+		return nil, fmt.Errorf("%w %s", ErrUnknownRuleset, name)
+	}
+	return r, nil
+}
+
+// RulesetNames lists the registered rulesets
+func RulesetNames() []string {
+	rulesetsMu.RLock()
+	defer rulesetsMu.RUnlock()
+	names := make([]string, 0, len(rulesets))
+	for name := range rulesets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	rulesets = make(map[string]*Ruleset)
+
+	builtin := []*Ruleset{
+		{
+			Name: "rps",
+			Moves: []Move{
+				{"rock", "Rock"},
+				{"paper", "Paper"},
+				{"scissors", "Scissors"},
+			},
+			Relations: []Relation{
+				{"scissors", "cuts", "paper"},
+				{"paper", "covers", "rock"},
+				{"rock", "smashes", "scissors"},
+			},
+		},
+		{
+			Name: "rpsls",
+			Moves: []Move{
+				{"rock", "Rock"},
+				{"paper", "Paper"},
+				{"scissors", "Scissors"},
+				{"lizard", "Lizard"},
+				{"spock", "Spock"},
+			},
+			Relations: []Relation{
+				{"scissors", "cuts", "paper"},
+				{"scissors", "decapitates", "lizard"},
+				{"paper", "covers", "rock"},
+				{"paper", "disproves", "spock"},
+				{"rock", "crushes", "lizard"},
+				{"rock", "smashes", "scissors"},
+				{"lizard", "eats", "paper"},
+				{"lizard", "poisons", "spock"},
+				{"spock", "beams up", "scissors"},
+				{"spock", "sits on", "rock"},
+			},
+		},
+	}
+	for _, r := range builtin {
+		if err := RegisterRuleset(r); err != nil {
+			panic(err)
+		}
+	}
+}
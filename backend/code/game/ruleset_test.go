@@ -0,0 +1,126 @@
+package game
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuiltinRulesets(t *testing.T) {
+	rps, err := LookupRuleset("rps")
+	if err != nil {
+		t.Fatalf("rps should be built in: %s", err)
+	}
+	if rps.ValidPlay("spock") {
+		t.Errorf("spock is not part of classic rps")
+	}
+	if beats, how := rps.Beats("rock", "scissors"); !beats || how != "smashes" {
+		t.Errorf("rock should smash scissors: %v %s", beats, how)
+	}
+
+	rpsls, err := LookupRuleset("rpsls")
+	if err != nil {
+		t.Fatalf("rpsls should be built in: %s", err)
+	}
+	if rpsls.DisplayName("spock") != "Spock" {
+		t.Errorf("unexpected display name %s", rpsls.DisplayName("spock"))
+	}
+}
+
+func TestParseRuleset(t *testing.T) {
+	yamlRules := `
+name: tiny
+moves:
+  - id: a
+    name: Ay
+  - id: b
+relations:
+  - {winner: a, verb: bests, loser: b}
+`
+	r, err := ParseRuleset([]byte(yamlRules), "yaml")
+	if err != nil {
+		t.Fatalf("unable to parse yaml ruleset: %s", err)
+	}
+	if beats, how := r.Beats("a", "b"); !beats || how != "bests" {
+		t.Errorf("a should best b: %v %s", beats, how)
+	}
+	if r.DisplayName("b") != "b" {
+		t.Errorf("move without a name should display its id: %s", r.DisplayName("b"))
+	}
+
+	jsonRules := `{"name":"tiny","moves":[{"id":"a"},{"id":"b"}],"relations":[{"winner":"b","verb":"bests","loser":"a"}]}`
+	r, err = ParseRuleset([]byte(jsonRules), "json")
+	if err != nil {
+		t.Fatalf("unable to parse json ruleset: %s", err)
+	}
+	if beats, _ := r.Beats("b", "a"); !beats {
+		t.Errorf("b should beat a")
+	}
+
+	if _, err := ParseRuleset([]byte(jsonRules), "toml"); err == nil {
+		t.Errorf("unknown formats should be rejected")
+	}
+}
+
+func TestRulesetValidation(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"no name", `{"moves":[{"id":"a"},{"id":"b"}],"relations":[{"winner":"a","loser":"b"}]}`, "no name"},
+		{"one move", `{"name":"x","moves":[{"id":"a"}]}`, "at least two"},
+		{"duplicate move", `{"name":"x","moves":[{"id":"a"},{"id":"a"}]}`, "duplicate"},
+		{"uppercase move", `{"name":"x","moves":[{"id":"A"},{"id":"b"}]}`, "lowercase"},
+		{"unknown move", `{"name":"x","moves":[{"id":"a"},{"id":"b"}],"relations":[{"winner":"a","loser":"c"}]}`, "unknown move"},
+		{"self relation", `{"name":"x","moves":[{"id":"a"},{"id":"b"}],"relations":[{"winner":"a","loser":"a"}]}`, "itself"},
+		{"both directions", `{"name":"x","moves":[{"id":"a"},{"id":"b"}],"relations":[{"winner":"a","loser":"b"},{"winner":"b","loser":"a"}]}`, "both beat"},
+		{"repeated relation", `{"name":"x","moves":[{"id":"a"},{"id":"b"}],"relations":[{"winner":"a","loser":"b"},{"winner":"a","loser":"b"}]}`, "more than once"},
+		{"missing pair", `{"name":"x","moves":[{"id":"a"},{"id":"b"},{"id":"c"}],"relations":[{"winner":"a","loser":"b"},{"winner":"b","loser":"c"}]}`, "no winner between a and c"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseRuleset([]byte(c.rules), "json")
+		if err == nil {
+			t.Errorf("%s: ruleset should be invalid", c.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing %q, got %q", c.name, c.err, err)
+		}
+	}
+}
+
+func TestLoadRulesetDir(t *testing.T) {
+	if err := LoadRulesetDir("../rulesets"); err != nil {
+		t.Fatalf("unable to load bundled rulesets: %s", err)
+	}
+	r, err := LookupRuleset("rps15")
+	if err != nil {
+		t.Fatalf("rps15 should be registered: %s", err)
+	}
+	if len(r.Moves) != 15 || len(r.Relations) != 105 {
+		t.Errorf("rps15 should have 15 moves and 105 relations: %d %d", len(r.Moves), len(r.Relations))
+	}
+	if beats, _ := r.Beats("gun", "rock"); !beats {
+		t.Errorf("gun should beat rock, wrapping around the move list")
+	}
+}
+
+func TestGameUsesRuleset(t *testing.T) {
+	g := NewGame()
+	g.Ruleset = "rps"
+	p1, _ := NewGameContext("first", "1addr", g)
+	p2, _ := NewGameContext("second", "2addr", g)
+
+	if err := p1.Play("lizard"); err == nil {
+		t.Errorf("lizard is not a valid play in classic rps")
+	}
+	p1.Play("paper")
+	p2.Play("rock")
+	if err := g.AdvanceGame(); err != nil {
+		t.Fatalf("unable to advance game: %s", err)
+	}
+	if g.Winner != "first" || g.RoundSummary != "Paper covers Rock" {
+		t.Errorf("unexpected round result: %s %s", g.Winner, g.RoundSummary)
+	}
+}
@@ -0,0 +1,58 @@
+package game
+
+// Series is the running total of a set of linked matches between the same players
+type Series struct {
+	// ID is the ID of the series, which is the ID of its first game
+	ID string
+	// Matches counts the finished matches in the series
+	Matches int
+	// Wins is indexed by Player.ID and counts the matches each player won
+	Wins map[string]int
+	// Ties counts the matches nobody won
+	Ties int
+}
+
+// SeriesID returns the series the game belongs to. A game which hasn't had a rematch yet
+// would start a series of its own.
+func (g *Game) SeriesID() string {
+	if g.Series == "" {
+		return g.ID
+	}
+	return g.Series
+}
+
+// RematchAgreed reports whether the match is over, and every player wants a rematch
+func (g *Game) RematchAgreed() bool {
+	if !g.MatchOver {
+		return false
+	}
+	for _, p := range g.Players {
+		if !p.Rematch {
+			return false
+		}
+	}
+	return true
+}
+
+// Rematch creates a fresh game with the same players and settings, in the same series
+func (g *Game) Rematch() *Game {
+	next := NewGame()
+	next.Ruleset = g.Ruleset
+	next.Format = g.Format
+	next.MaxPlayers = g.MaxPlayers
+	next.Scoring = g.Scoring
+	next.FairPlay = g.FairPlay
+	next.RoundTimeout = g.RoundTimeout
+	next.MaxMisses = g.MaxMisses
+	next.Series = g.SeriesID()
+	for id, p := range g.Players {
+		next.Players[id] = &Player{
+			ID:       id,
+			Address:  p.Address,
+			Game:     next.ID,
+			Offline:  p.Offline,
+			Protocol: p.Protocol,
+		}
+	}
+	return next
+}
@@ -0,0 +1,102 @@
+package game
+
+// Stats are a player's lifetime totals across every game they've played
+type Stats struct {
+	// Games counts the games the player has finished at least one round of
+	Games       int
+	MatchesWon  int
+	MatchesLost int
+	MatchesTied int
+	RoundsWon   int
+	RoundsLost  int
+	RoundsTied  int
+	// Moves counts how often the player made each move, by move ID
+	Moves map[string]int
+}
+
+// Add adds another set of stats to these ones
+func (s *Stats) Add(o Stats) {
+	s.Games += o.Games
+	s.MatchesWon += o.MatchesWon
+	s.MatchesLost += o.MatchesLost
+	s.MatchesTied += o.MatchesTied
+	s.RoundsWon += o.RoundsWon
+	s.RoundsLost += o.RoundsLost
+	s.RoundsTied += o.RoundsTied
+	if len(o.Moves) > 0 && s.Moves == nil {
+		s.Moves = make(map[string]int, len(o.Moves))
+	}
+	for move, count := range o.Moves {
+		s.Moves[move] += count
+	}
+}
+
+// StatsDelta returns what the last resolved round adds to each player's stats, indexed by Player.ID.
+// A round counts as won for anyone who scored, tied if nobody did, and lost otherwise.
+// The first round counts a game played, and the round which ends the match counts the match.
+func (g *Game) StatsDelta() map[string]Stats {
+	deltas := make(map[string]Stats, len(g.Players))
+	r := g.LastResult
+	if r == nil {
+		return deltas
+	}
+
+	won := make(map[string]bool, len(r.Winners))
+	for _, id := range r.Winners {
+		won[id] = true
+	}
+
+	for id, play := range r.Plays {
+		d := Stats{Moves: map[string]int{}}
+		if r.Round == 1 {
+			d.Games = 1
+		}
+		switch {
+		case won[id]:
+			d.RoundsWon = 1
+		case len(r.Winners) == 0:
+			d.RoundsTied = 1
+		default:
+			d.RoundsLost = 1
+		}
+		if play != "" {
+			d.Moves[play] = 1
+		}
+
+		if g.MatchOver {
+			switch g.MatchWinner {
+			case id:
+				d.MatchesWon = 1
+			case "Tie":
+				d.MatchesTied = 1
+			default:
+				d.MatchesLost = 1
+			}
+		}
+		deltas[id] = d
+	}
+	return deltas
+}
+
+// MatchScore is how a finished match went for player a against player b, for rating them:
+// 1 for a win, 0.5 for a draw and 0 for a loss. The match winner beat everyone, even on a forfeit,
+// and the other players are compared by score.
+func (g *Game) MatchScore(a, b string) float64 {
+	switch {
+	case g.MatchWinner == a:
+		return 1
+	case g.MatchWinner == b:
+		return 0
+	}
+	pa, pb := g.Players[a], g.Players[b]
+	if pa == nil || pb == nil {
+		return 0.5
+	}
+	switch {
+	case pa.Score > pb.Score:
+		return 1
+	case pa.Score < pb.Score:
+		return 0
+	}
+	return 0.5
+}
@@ -0,0 +1,119 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Games can put a deadline on each round, so a player walking away doesn't stall it forever.
+// The clock starts with the first play (or commitment) of a round. When it runs out, everyone
+// who hasn't acted forfeits the round, and after MaxMisses missed rounds they forfeit the match.
+// Timers live outside this package: a scheduled sweeper or in-process ticker calls ExpireRound.
+
+// ValidateClock checks the round timeout and miss limit
+func (g *Game) ValidateClock() error {
+	if g.RoundTimeout < 0 {
+		return fmt.Errorf("%w: round timeout must be positive, not %d", ErrInvalidOptions, g.RoundTimeout)
+	}
+	if g.MaxMisses < 0 {
+		return fmt.Errorf("%w: miss limit must be positive, not %d", ErrInvalidOptions, g.MaxMisses)
+	}
+	if g.MaxMisses > 0 && g.RoundTimeout == 0 {
+		return fmt.Errorf("%w: a miss limit needs a round timeout", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// StartClock sets the current round's deadline, if the game has one and it isn't already running.
+// now is in unix seconds.
+func (g *Game) StartClock(now int64) {
+	if g.RoundTimeout == 0 || g.Deadline != 0 || g.MatchOver || !g.Full() {
+		return
+	}
+	g.Deadline = now + int64(g.RoundTimeout)
+}
+
+// Expired is true once the current round's deadline has passed
+func (g *Game) Expired(now int64) bool {
+	return g.Deadline != 0 && now >= g.Deadline && !g.MatchOver && g.Full()
+}
+
+// ExpireRound forfeits every player who hasn't acted this round and resolves it.
+// A player who reaches the miss limit forfeits the match, which goes to the best placed of the rest.
+// It returns the IDs of the players who missed the round.
+func (g *Game) ExpireRound(now int64) ([]string, error) {
+	if !g.Expired(now) {
+		return nil, errors.New("round has not expired")
+	}
+
+	revealing := g.FairPlay && g.AllCommitted()
+	missed := []string{}
+	for _, p := range g.SortedPlayers() {
+		if p.Round >= g.Round {
+			continue
+		}
+		// record an empty, forfeited play (or commitment and reveal) so the round can resolve
+		p.Play = ""
+		p.Forfeit = true
+		p.Round = g.Round
+		g.PlayCount++
+		if g.FairPlay {
+			gc := GameContext{Game: g, ActingPlayer: p}
+			gc.reveal("")
+		}
+		missed = append(missed, p.ID)
+	}
+	if revealing {
+		missed = append(missed, g.ForfeitUnrevealed()...)
+	} else if g.FairPlay {
+		// the commit phase ran out, so nobody got the chance to reveal. Those who committed
+		// take the round without showing their play.
+		for _, p := range g.SortedPlayers() {
+			if p.RevealRound < g.Round {
+				gc := GameContext{Game: g, ActingPlayer: p}
+				gc.reveal("")
+			}
+		}
+	}
+	for _, id := range missed {
+		g.Players[id].Misses++
+	}
+
+	if err := g.AdvanceGame(); err != nil {
+		return nil, err
+	}
+	g.forfeitMatch()
+	return missed, nil
+}
+
+// forfeitMatch ends the match if any player has missed too many rounds.
+// The highest scoring player still under the limit wins, or "Tie" if that is shared.
+func (g *Game) forfeitMatch() {
+	if g.MaxMisses == 0 || g.MatchOver {
+		return
+	}
+
+	var leader *Player
+	out, tied := false, false
+	for _, p := range g.SortedPlayers() {
+		if p.Misses >= g.MaxMisses {
+			out = true
+			continue
+		}
+		if leader == nil || p.Score > leader.Score {
+			leader = p
+			tied = false
+		} else if p.Score == leader.Score {
+			tied = true
+		}
+	}
+	if !out {
+		return
+	}
+
+	g.MatchOver = true
+	g.MatchWinner = "Tie"
+	if leader != nil && !tied {
+		g.MatchWinner = leader.ID
+	}
+}
@@ -0,0 +1,95 @@
+package game
+
+import "testing"
+
+func timedGame(t *testing.T, timeout, misses int) (*Game, *GameContext, *GameContext) {
+	t.Helper()
+	g := NewGame()
+	g.RoundTimeout = timeout
+	g.MaxMisses = misses
+	p1, _ := NewGameContext("first", "1addr", g)
+	p2, _ := NewGameContext("second", "2addr", g)
+	return g, p1, p2
+}
+
+func TestRoundTimeout(t *testing.T) {
+	g, p1, p2 := timedGame(t, 30, 0)
+
+	if g.Expired(1_000_000) {
+		t.Errorf("the clock should not run before anyone plays")
+	}
+	g.StartClock(1000)
+	p1.Play("rock")
+	g.StartClock(1010)
+	if g.Deadline != 1030 {
+		t.Errorf("the clock should start with the first play only: %d", g.Deadline)
+	}
+	if _, err := g.ExpireRound(1029); err == nil {
+		t.Errorf("round should not expire before the deadline")
+	}
+
+	missed, err := g.ExpireRound(1030)
+	if err != nil {
+		t.Fatalf("round should expire at the deadline: %s", err)
+	}
+	if len(missed) != 1 || missed[0] != "second" || p2.ActingPlayer.Misses != 1 {
+		t.Errorf("second should have missed the round: %v %+v", missed, p2.ActingPlayer)
+	}
+	if g.Round != 2 || g.Winner != "first" || g.RoundSummary != "second forfeits" || g.Deadline != 0 {
+		t.Errorf("first should win the expired round: %+v", g)
+	}
+	if g.LastResult.Forfeits[0] != "second" || g.MatchOver {
+		t.Errorf("forfeit should be recorded without ending the match: %+v", g.LastResult)
+	}
+}
+
+func TestMissLimitForfeitsMatch(t *testing.T) {
+	g, p1, _ := timedGame(t, 10, 2)
+
+	for round := 1; round <= 2; round++ {
+		p1.Play("rock")
+		g.StartClock(int64(round * 100))
+		if _, err := g.ExpireRound(int64(round*100 + 10)); err != nil {
+			t.Fatalf("round %d should expire: %s", round, err)
+		}
+	}
+	if !g.MatchOver || g.MatchWinner != "first" {
+		t.Errorf("second should forfeit the match after two misses: %+v", g)
+	}
+}
+
+func TestFairPlayTimeout(t *testing.T) {
+	g, p1, p2 := timedGame(t, 10, 0)
+	g.FairPlay = true
+
+	p1.Commit(Commitment("rock", "n1"))
+	g.StartClock(100)
+	missed, err := g.ExpireRound(110)
+	if err != nil || len(missed) != 1 || missed[0] != "second" {
+		t.Fatalf("second should miss the commit phase: %v %s", missed, err)
+	}
+	if g.Round != 2 || g.Players["first"].Score != 1 {
+		t.Errorf("first should win when second never commits: %+v", g)
+	}
+
+	// everyone commits, but only second reveals
+	p1.Commit(Commitment("rock", "n1"))
+	p2.Commit(Commitment("paper", "n2"))
+	p2.Reveal("paper", "n2")
+	g.StartClock(200)
+	missed, _ = g.ExpireRound(210)
+	if len(missed) != 1 || missed[0] != "first" || g.Players["second"].Score != 1 {
+		t.Errorf("first should forfeit by not revealing: %v %+v", missed, g)
+	}
+}
+
+func TestValidateClock(t *testing.T) {
+	for _, g := range []*Game{{RoundTimeout: -1}, {MaxMisses: -1}, {MaxMisses: 3}} {
+		if err := g.ValidateClock(); err == nil {
+			t.Errorf("%d second timeout and %d misses should be rejected", g.RoundTimeout, g.MaxMisses)
+		}
+	}
+	if err := (&Game{RoundTimeout: 60, MaxMisses: 3}).ValidateClock(); err != nil {
+		t.Errorf("valid clock rejected: %s", err)
+	}
+}
@@ -5,5 +5,7 @@ go 1.14
 require (
 	github.com/aws/aws-lambda-go v1.16.0
 	github.com/aws/aws-sdk-go v1.30.22
+	github.com/gorilla/websocket v1.5.3
 	github.com/jinzhu/copier v0.0.0-20190924061706-b57f9002281a // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
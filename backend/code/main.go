@@ -5,6 +5,8 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -12,6 +14,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/jbarratt/rpsls/backend/code/auth"
+	"github.com/jbarratt/rpsls/backend/code/game"
 	"github.com/jbarratt/rpsls/backend/code/notify"
 	"github.com/jbarratt/rpsls/backend/code/service"
 	"github.com/jbarratt/rpsls/backend/code/store"
@@ -27,6 +31,39 @@ func GetSession() *session.Session {
 	return sess
 }
 
+// chatConfig reads the chat settings from the environment: CHAT_BLOCKLIST is a comma separated
+// list of words to mask, and CHAT_HISTORY how many messages to keep with each game
+func chatConfig() service.ChatConfig {
+	c := service.ChatConfig{
+		Filter:  service.Blocklist(strings.Split(os.Getenv("CHAT_BLOCKLIST"), ",")),
+		History: service.CHAT_HISTORY,
+	}
+	if n, err := strconv.Atoi(os.Getenv("CHAT_HISTORY")); err == nil {
+		c.History = n
+	}
+	return c
+}
+
+// authConfig reads the keys connection tokens are signed with from the environment: AUTH_HMAC_SECRET
+// for HS256 tokens, and AUTH_RSA_PUBLIC_KEY (in PEM form) for RS256 ones. With neither set, no
+// tokens are needed and it returns nil.
+func authConfig() (*auth.Verifier, error) {
+	secret, rsaKey := os.Getenv("AUTH_HMAC_SECRET"), os.Getenv("AUTH_RSA_PUBLIC_KEY")
+	if secret == "" && rsaKey == "" {
+		return nil, nil
+	}
+	v := auth.NewVerifier()
+	if secret != "" {
+		v.AddHMACKey("", []byte(secret))
+	}
+	if rsaKey != "" {
+		if err := v.AddRSAKeyPEM("", []byte(rsaKey)); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
 func Handler(e events.APIGatewayWebsocketProxyRequest) (interface{}, error) {
 
 	fmt.Printf("Entered handler\n")
@@ -36,6 +73,14 @@ func Handler(e events.APIGatewayWebsocketProxyRequest) (interface{}, error) {
 	st := store.New(dynamodb.New(sess), os.Getenv("TABLE_NAME"))
 	no := notify.NewAPIGWNotifier(e.RequestContext.DomainName, e.RequestContext.Stage, sess)
 	svc := service.NewLambdaSvc(st, no)
+	svc.SetChat(chatConfig())
+	v, err := authConfig()
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		svc.SetAuth(v)
+	}
 
 	switch e.RequestContext.RouteKey {
 	case "$connect":
@@ -47,7 +92,37 @@ func Handler(e events.APIGatewayWebsocketProxyRequest) (interface{}, error) {
 	}
 }
 
+// SweepHandler runs on a schedule and resolves every round which has run out of time, then
+// matches queued players whose rating bands have widened enough.
+// It isn't triggered by a websocket event, so the API endpoint comes from the environment.
+func SweepHandler(e events.CloudWatchEvent) error {
+	fmt.Printf("Sweeping expired rounds\n")
+
+	sess := GetSession()
+
+	st := store.New(dynamodb.New(sess), os.Getenv("TABLE_NAME"))
+	no := notify.NewAPIGWNotifier(os.Getenv("WEBSOCKET_DOMAIN"), os.Getenv("WEBSOCKET_STAGE"), sess)
+	svc := service.NewLambdaSvc(st, no)
+
+	now := time.Now().Unix()
+	if err := svc.ExpireRounds(now); err != nil {
+		return err
+	}
+	return svc.Matchmake(now)
+}
+
 func main() {
+	// Extra rulesets beyond the built in ones can be shipped alongside the handler
+	if dir := os.Getenv("RULESET_DIR"); dir != "" {
+		if err := game.LoadRulesetDir(dir); err != nil {
+			log.Fatalln("unable to load rulesets", err.Error())
+		}
+	}
+	// The same binary is deployed as the scheduled sweeper
+	if os.Getenv("SWEEPER") != "" {
+		lambda.Start(SweepHandler)
+		return
+	}
 	lambda.Start(Handler)
 }
 
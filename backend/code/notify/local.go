@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// LocalNotifier delivers messages to websockets held open by this process,
+// for running the game without API Gateway
+type LocalNotifier struct {
+	mu    sync.RWMutex
+	conns map[string]*localConn
+}
+
+// localConn serializes writes, as a websocket only supports one concurrent writer
+type localConn struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+// NewLocalNotifier returns a notifier with no registered connections
+func NewLocalNotifier() *LocalNotifier {
+	return &LocalNotifier{
+		conns: make(map[string]*localConn),
+	}
+}
+
+// Add registers an open websocket under a connection id
+func (n *LocalNotifier) Add(id string, ws *websocket.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.conns[id] = &localConn{ws: ws}
+}
+
+// Remove forgets a connection id, e.g. after the socket closes
+func (n *LocalNotifier) Remove(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, id)
+}
+
+// Send writes a message to the identified connection
+func (n *LocalNotifier) Send(destination string, body []byte) error {
+	n.mu.RLock()
+	c, found := n.conns[destination]
+	n.mu.RUnlock()
+	if !found {
+		return ErrConnectionGone
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.ws.WriteMessage(websocket.TextMessage, body)
+	if err != nil {
+		log.Println("Error Sending Message", err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package notify
+
+import "sync"
+
+// Message is a single notification captured by a Recorder
+type Message struct {
+	Destination string
+	Body        []byte
+}
+
+// Recorder is a Notifier which keeps every message instead of delivering it, for tests
+type Recorder struct {
+	mu       sync.Mutex
+	Messages []Message
+	gone     map[string]bool
+}
+
+// Send records the message, or fails with ErrConnectionGone for destinations marked gone
+func (r *Recorder) Send(destination string, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gone[destination] {
+		return ErrConnectionGone
+	}
+	r.Messages = append(r.Messages, Message{Destination: destination, Body: body})
+	return nil
+}
+
+// MarkGone makes every later Send to the destination fail, like a closed connection
+func (r *Recorder) MarkGone(destination string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gone == nil {
+		r.gone = make(map[string]bool)
+	}
+	r.gone[destination] = true
+}
+
+// To returns the bodies of all messages sent to a destination, oldest first
+func (r *Recorder) To(destination string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bodies := []string{}
+	for _, m := range r.Messages {
+		if m.Destination == destination {
+			bodies = append(bodies, string(m.Body))
+		}
+	}
+	return bodies
+}
+
+// Reset forgets all recorded messages
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Messages = nil
+}
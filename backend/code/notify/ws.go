@@ -1,10 +1,12 @@
 package notify
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
 )
@@ -17,6 +19,10 @@ type Notifier interface {
 	Send(string, []byte) error
 }
 
+// ErrConnectionGone is returned by Send when the destination connection no longer exists,
+// so there's no point sending to it again
+var ErrConnectionGone = errors.New("connection is gone")
+
 func NewAPIGWNotifier(domain, stage string, sess *session.Session) *APIGWNotifier {
 	baseURL := fmt.Sprintf("https://%s/%s/", domain, stage)
 
@@ -33,6 +39,9 @@ func (n *APIGWNotifier) Send(destination string, body []byte) error {
 	}
 
 	_, err := n.c.PostToConnection(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == apigatewaymanagementapi.ErrCodeGoneException {
+		return ErrConnectionGone
+	}
 	if err != nil {
 		log.Println("Error Sending Message", err.Error())
 		return err
@@ -0,0 +1,292 @@
+package protocol
+
+// GameState structures for sending to players, in state and roundResult messages. Fields are optional especially on setup
+type GameState struct {
+	Round        int    `json:"round"`
+	GameID       string `json:"gameId"`
+	YourScore    int    `json:"yourScore"`
+	TheirScore   int    `json:"theirScore"`
+	Winner       bool   `json:"winner"`
+	YourPlay     string `json:"yourPlay,omitempty"`
+	TheirPlay    string `json:"theirPlay,omitempty"`
+	RoundSummary string `json:"roundSummary,omitempty"`
+	Ruleset      string `json:"ruleset,omitempty"`
+	MatchFormat  string `json:"matchFormat,omitempty"`
+	MatchLength  int    `json:"matchLength,omitempty"`
+	// MatchOver is set on the final state of a finished match
+	MatchOver bool `json:"matchOver,omitempty"`
+	// MatchWinner is true if you won the match
+	MatchWinner bool `json:"matchWinner,omitempty"`
+	// MaxPlayers is the number of seats in rooms bigger than two players
+	MaxPlayers int `json:"maxPlayers,omitempty"`
+	// FairPlay games use commit and reveal, and Phase says which one is expected next
+	FairPlay bool   `json:"fairPlay,omitempty"`
+	Phase    string `json:"phase,omitempty"`
+	// RoundTimeout is the seconds allowed per round, and Deadline the unix time the current round expires
+	RoundTimeout int   `json:"roundTimeout,omitempty"`
+	Deadline     int64 `json:"deadline,omitempty"`
+	// Forfeits are the userIds which forfeited the last round, e.g. by running out of time
+	Forfeits []string `json:"forfeits,omitempty"`
+	// Opponents holds everyone else in the game. In a two player game
+	// TheirScore and TheirPlay repeat the single opponent's values.
+	Opponents []OpponentState `json:"opponents,omitempty"`
+	// SeriesID is set on rematches, and names the series of linked matches
+	SeriesID string `json:"seriesId,omitempty"`
+	// Spectating is set for spectators, who see every player in Opponents and have no score of their own
+	Spectating bool `json:"spectating,omitempty"`
+}
+
+// OpponentState is what a player can see of another player in the game
+type OpponentState struct {
+	UserID string `json:"userId"`
+	Score  int    `json:"score"`
+	Play   string `json:"play,omitempty"`
+	// Offline is set while their connection is down
+	Offline bool `json:"offline,omitempty"`
+}
+
+// Presence statuses
+const (
+	PRESENCE_DISCONNECTED = "disconnected"
+	PRESENCE_RECONNECTED  = "reconnected"
+)
+
+// PresenceMessage tells players when an opponent's connection drops or comes back
+type PresenceMessage struct {
+	GameID string `json:"gameId"`
+	UserID string `json:"userId"`
+	Status string `json:"status"`
+}
+
+// PlayerMessage are what we get from the players
+type PlayerMessage struct {
+	// V is the protocol version the client speaks, 0 for clients from before versioning
+	V      int    `json:"v,omitempty"`
+	Action string `json:"action,omitempty"`
+	UID    string `json:"userId"`
+	GameID string `json:"gameId"`
+	Play   string `json:"play"`
+	Round  int    `json:"round"`
+	// Ruleset picks the ruleset when creating a new game
+	Ruleset string `json:"ruleset,omitempty"`
+	// MatchFormat and MatchLength pick how long a new game runs, e.g. "bestof" 5
+	MatchFormat string `json:"matchFormat,omitempty"`
+	MatchLength int    `json:"matchLength,omitempty"`
+	// MaxPlayers and Scoring set up rooms of more than two players
+	MaxPlayers int    `json:"maxPlayers,omitempty"`
+	Scoring    string `json:"scoring,omitempty"`
+	// FairPlay creates a game where plays are committed as a hash, then revealed
+	FairPlay bool `json:"fairPlay,omitempty"`
+	// Commitment is the hex sha256 of the play followed by the nonce, for commit
+	Commitment string `json:"commitment,omitempty"`
+	// Nonce is sent along with Play to reveal a commitment
+	Nonce string `json:"nonce,omitempty"`
+	// Opponent asks for a computer opponent when creating a game, e.g. "bot:markov"
+	Opponent string `json:"opponent,omitempty"`
+	// RoundTimeout gives each round of a new game a deadline in seconds, and after
+	// MaxMisses expired rounds a player forfeits the match
+	RoundTimeout int `json:"roundTimeout,omitempty"`
+	MaxMisses    int `json:"maxMisses,omitempty"`
+	// Band limits matchmaking to opponents rated within this many points, widening the longer
+	// the player waits. 0 matches anyone.
+	Band int `json:"band,omitempty"`
+	// Limit is how many players a leaderboard request wants
+	Limit int `json:"limit,omitempty"`
+	// Text or Emote is what a chat message says
+	Text  string `json:"text,omitempty"`
+	Emote string `json:"emote,omitempty"`
+	// TournamentID picks the tournament to register for, start or view
+	TournamentID string `json:"tournamentId,omitempty"`
+	// TournamentFormat, Name and Rounds set up a new tournament, e.g. "swiss" over 5 rounds
+	TournamentFormat string `json:"tournamentFormat,omitempty"`
+	Name             string `json:"name,omitempty"`
+	Rounds           int    `json:"rounds,omitempty"`
+	// RequestID is echoed back in any error about this message. A message with the same RequestID
+	// as a recent one from the same player is a retry, and gets the same replies without running again.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Error codes sent in an ErrorMessage
+const (
+	CODE_BAD_REQUEST          = "BAD_REQUEST"
+	CODE_GAME_NOT_FOUND       = "GAME_NOT_FOUND"
+	CODE_GAME_FULL            = "GAME_FULL"
+	CODE_INVALID_PLAY         = "INVALID_PLAY"
+	CODE_STALE_ROUND          = "STALE_ROUND"
+	CODE_MATCH_OVER           = "MATCH_OVER"
+	CODE_WRONG_MODE           = "WRONG_MODE"
+	CODE_OUT_OF_TURN          = "OUT_OF_TURN"
+	CODE_ALREADY_PLAYED       = "ALREADY_PLAYED"
+	CODE_INVALID_COMMITMENT   = "INVALID_COMMITMENT"
+	CODE_INVALID_OPTIONS      = "INVALID_OPTIONS"
+	CODE_UNKNOWN_RULESET      = "UNKNOWN_RULESET"
+	CODE_NOT_QUEUED           = "NOT_QUEUED"
+	CODE_RATE_LIMITED         = "RATE_LIMITED"
+	CODE_MATCH_NOT_OVER       = "MATCH_NOT_OVER"
+	CODE_REMATCH_STARTED      = "REMATCH_STARTED"
+	CODE_TOURNAMENT_NOT_FOUND = "TOURNAMENT_NOT_FOUND"
+	CODE_REGISTRATION_CLOSED  = "REGISTRATION_CLOSED"
+	CODE_NOT_ENOUGH_PLAYERS   = "NOT_ENOUGH_PLAYERS"
+	CODE_UNAUTHORIZED         = "UNAUTHORIZED"
+	CODE_REQUEST_IN_PROGRESS  = "REQUEST_IN_PROGRESS"
+	CODE_INTERNAL             = "INTERNAL"
+)
+
+// ErrorMessage tells a player why their message failed
+type ErrorMessage struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// HistoryMessage lists the resolved rounds of a game, in response to the history action
+type HistoryMessage struct {
+	GameID string        `json:"gameId"`
+	Rounds []RoundRecord `json:"rounds"`
+}
+
+// RoundRecord is a single resolved round
+type RoundRecord struct {
+	Round int `json:"round"`
+	// Plays is indexed by userId
+	Plays   map[string]string `json:"plays"`
+	Winners []string          `json:"winners,omitempty"`
+	Summary string            `json:"summary"`
+}
+
+// StatsMessage holds a player's lifetime statistics, in response to the stats action
+type StatsMessage struct {
+	UserID      string `json:"userId"`
+	Games       int    `json:"games"`
+	MatchesWon  int    `json:"matchesWon"`
+	MatchesLost int    `json:"matchesLost"`
+	MatchesTied int    `json:"matchesTied"`
+	RoundsWon   int    `json:"roundsWon"`
+	RoundsLost  int    `json:"roundsLost"`
+	RoundsTied  int    `json:"roundsTied"`
+	// Moves counts how often each move was played
+	Moves map[string]int `json:"moves"`
+}
+
+// LeaderboardMessage lists the best rated players, and where the requesting player stands
+type LeaderboardMessage struct {
+	Players []LeaderboardEntry `json:"players"`
+	UserID  string             `json:"userId"`
+	// Rank is the requesting player's place, 0 until they finish a rated match
+	Rank      int     `json:"rank"`
+	Rating    float64 `json:"rating"`
+	Deviation float64 `json:"deviation"`
+}
+
+// LeaderboardEntry is one player on the leaderboard
+type LeaderboardEntry struct {
+	Rank      int     `json:"rank"`
+	UserID    string  `json:"userId"`
+	Rating    float64 `json:"rating"`
+	Deviation float64 `json:"deviation"`
+}
+
+// Matchmaking statuses
+const (
+	QUEUE_QUEUED   = "queued"
+	QUEUE_DEQUEUED = "dequeued"
+)
+
+// QueueMessage confirms a player joined or left the matchmaking queue
+type QueueMessage struct {
+	UserID  string `json:"userId"`
+	Status  string `json:"status"`
+	Ruleset string `json:"ruleset"`
+	// Rating and Band are what the player is matched on
+	Rating float64 `json:"rating"`
+	Band   int     `json:"band"`
+}
+
+// MatchedMessage tells a queued player they have an opponent, and which game to play in
+type MatchedMessage struct {
+	GameID    string   `json:"gameId"`
+	Ruleset   string   `json:"ruleset"`
+	Opponents []string `json:"opponents"`
+}
+
+// ChatMessage is a text message or emote from a player, relayed to everyone in the game
+type ChatMessage struct {
+	GameID string `json:"gameId"`
+	UserID string `json:"userId"`
+	Text   string `json:"text,omitempty"`
+	Emote  string `json:"emote,omitempty"`
+	// Sent is when the message was sent, in unix milliseconds
+	Sent int64 `json:"sent"`
+}
+
+// Rematch statuses
+const (
+	REMATCH_REQUESTED = "requested"
+	REMATCH_DECLINED  = "declined"
+	REMATCH_STARTED   = "started"
+)
+
+// RematchMessage tells the players of a finished game that someone asked for a rematch or declined
+// it, or that everyone agreed and the rematch started
+type RematchMessage struct {
+	GameID string `json:"gameId"`
+	// UserID is who asked or declined
+	UserID string `json:"userId,omitempty"`
+	Status string `json:"status"`
+	// NextGameID is the rematch, and the rest is the series so far, once it started
+	NextGameID string         `json:"nextGameId,omitempty"`
+	SeriesID   string         `json:"seriesId,omitempty"`
+	Matches    int            `json:"matches,omitempty"`
+	Wins       map[string]int `json:"wins,omitempty"`
+	Ties       int            `json:"ties,omitempty"`
+}
+
+// TournamentMessage describes a tournament: its settings, the standings and every match so far.
+// It is sent to every registered player whenever the tournament changes.
+type TournamentMessage struct {
+	TournamentID string `json:"tournamentId"`
+	Name         string `json:"name,omitempty"`
+	Organizer    string `json:"organizer"`
+	Format       string `json:"format"`
+	State        string `json:"state"`
+	// Round is the round being played, out of Rounds, which is 0 until a single elimination tournament starts
+	Round       int                  `json:"round"`
+	Rounds      int                  `json:"rounds"`
+	Ruleset     string               `json:"ruleset"`
+	MatchFormat string               `json:"matchFormat"`
+	MatchLength int                  `json:"matchLength"`
+	Standings   []TournamentStanding `json:"standings"`
+	Pairings    []TournamentPairing  `json:"pairings"`
+	// Winner is the userId which won the tournament, once it's finished
+	Winner string `json:"winner,omitempty"`
+}
+
+// TournamentStanding is how one player is doing in a tournament
+type TournamentStanding struct {
+	Rank       int     `json:"rank"`
+	UserID     string  `json:"userId"`
+	Points     float64 `json:"points"`
+	Wins       int     `json:"wins"`
+	Losses     int     `json:"losses"`
+	Ties       int     `json:"ties"`
+	Byes       int     `json:"byes"`
+	Eliminated bool    `json:"eliminated,omitempty"`
+}
+
+// TournamentPairing is a match in a tournament round. A bye has a single player and no game.
+type TournamentPairing struct {
+	Round   int      `json:"round"`
+	Players []string `json:"players"`
+	GameID  string   `json:"gameId,omitempty"`
+	// Winner is the userId which won the match, or "Tie", once it's over
+	Winner string `json:"winner,omitempty"`
+}
+
+// MatchOverMessage announces the end of a match, after the final roundResult
+type MatchOverMessage struct {
+	GameID string `json:"gameId"`
+	// Winner is the userId of the match winner, or "Tie"
+	Winner string `json:"winner"`
+	// Scores is indexed by userId
+	Scores map[string]int `json:"scores"`
+}
@@ -0,0 +1,170 @@
+// Package protocol defines the messages exchanged with game clients over the websocket, and
+// how they are encoded. It is shared by the server and any Go clients.
+//
+// Since version 1 every message is an envelope naming its version and type, with the
+// payload under data:
+//
+//	{"v":1,"type":"roundResult","data":{"round":2,"gameId":"ABCDE",...}}
+//
+// Version 0 clients, from before the envelope, send flat PlayerMessages with an action and
+// get flat payloads back. Game states have no type, everything else carries a "type" key.
+// The server answers each client in the version it speaks. JSON schemas for every message
+// are in the schema directory.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// VERSION is the newest protocol version
+const VERSION = 1
+
+// Message types sent by the server
+const (
+	TYPE_STATE        = "state"
+	TYPE_ROUND_RESULT = "roundResult"
+	TYPE_MATCH_OVER   = "matchOver"
+	TYPE_ERROR        = "error"
+	TYPE_PRESENCE     = "presence"
+	TYPE_HISTORY      = "history"
+	TYPE_STATS        = "stats"
+	TYPE_LEADERBOARD  = "leaderboard"
+	TYPE_QUEUE        = "queue"
+	TYPE_MATCHED      = "matched"
+	TYPE_REMATCH      = "rematch"
+	TYPE_CHAT         = "chat"
+	TYPE_TOURNAMENT   = "tournament"
+)
+
+var (
+	// ErrUnsupportedVersion is returned for messages newer than this package understands
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrMalformed is returned for messages which aren't valid JSON objects
+	ErrMalformed = errors.New("malformed message")
+)
+
+// Envelope wraps every message from version 1 on. Requests from clients are envelopes
+// too, with the action as the type.
+type Envelope struct {
+	V         int             `json:"v"`
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// untyped lists the message types version 0 clients receive without a "type" key
+var untyped = map[string]bool{
+	TYPE_STATE:        true,
+	TYPE_ROUND_RESULT: true,
+}
+
+// Encode builds a message of the given type for a client speaking the given version
+func Encode(version int, msgType string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case 0:
+		if untyped[msgType] {
+			return data, nil
+		}
+		// add the type as the first key of the flat payload
+		if len(data) < 2 || data[0] != '{' {
+			return nil, fmt.Errorf("%w: %s payload is not an object", ErrMalformed, msgType)
+		}
+		typed := []byte(fmt.Sprintf(`{"type":%q`, msgType))
+		if len(data) > 2 {
+			typed = append(typed, ',')
+		}
+		return append(typed, data[1:]...), nil
+	case VERSION:
+		return json.Marshal(Envelope{V: version, Type: msgType, Data: data})
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+}
+
+// Decode reads a message sent by the server, in either version. Version 0 game states
+// are reported as TYPE_STATE, and Data is always just the payload.
+func Decode(body []byte) (Envelope, error) {
+	var probe struct {
+		V    *int            `json:"v"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	if probe.V == nil || *probe.V == 0 {
+		env := Envelope{Type: probe.Type, Data: body}
+		if env.Type == "" {
+			env.Type = TYPE_STATE
+		}
+		return env, nil
+	}
+	if *probe.V > VERSION {
+		return Envelope{}, fmt.Errorf("%w %d", ErrUnsupportedVersion, *probe.V)
+	}
+	return Envelope{V: *probe.V, Type: probe.Type, Data: probe.Data}, nil
+}
+
+// EncodeRequest builds a request to the server in the given version
+func EncodeRequest(version int, m PlayerMessage) ([]byte, error) {
+	switch version {
+	case 0:
+		m.V = 0
+		return json.Marshal(m)
+	case VERSION:
+		env := Envelope{V: version, Type: m.Action, RequestID: m.RequestID}
+		m.V, m.Action, m.RequestID = 0, "", ""
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		env.Data = data
+		return json.Marshal(env)
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+}
+
+// DecodeRequest reads a request from a client, in either version.
+// The returned message's V says which version the client speaks.
+func DecodeRequest(body []byte) (PlayerMessage, error) {
+	m := PlayerMessage{}
+	var probe struct {
+		V *int `json:"v"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return m, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	if probe.V == nil || *probe.V == 0 {
+		if err := json.Unmarshal(body, &m); err != nil {
+			return m, fmt.Errorf("%w: %s", ErrMalformed, err)
+		}
+		m.V = 0
+		return m, nil
+	}
+	if *probe.V > VERSION || *probe.V < 0 {
+		return m, fmt.Errorf("%w %d", ErrUnsupportedVersion, *probe.V)
+	}
+
+	env := Envelope{}
+	if err := json.Unmarshal(body, &env); err != nil {
+		return m, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+	if len(env.Data) > 0 && !bytes.Equal(env.Data, []byte("null")) {
+		if err := json.Unmarshal(env.Data, &m); err != nil {
+			return m, fmt.Errorf("%w: %s", ErrMalformed, err)
+		}
+	}
+	m.V = env.V
+	m.Action = env.Type
+	m.RequestID = env.RequestID
+	return m, nil
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	state := GameState{Round: 2, GameID: "ABCDE", YourScore: 1, Winner: true}
+	presence := PresenceMessage{GameID: "ABCDE", UserID: "p2", Status: PRESENCE_DISCONNECTED}
+
+	cases := []struct {
+		version  int
+		msgType  string
+		payload  interface{}
+		expected string
+	}{
+		{0, TYPE_STATE, state, `{"round":2,"gameId":"ABCDE","yourScore":1,"theirScore":0,"winner":true}`},
+		{0, TYPE_ROUND_RESULT, state, `{"round":2,"gameId":"ABCDE","yourScore":1,"theirScore":0,"winner":true}`},
+		{0, TYPE_PRESENCE, presence, `{"type":"presence","gameId":"ABCDE","userId":"p2","status":"disconnected"}`},
+		{0, TYPE_MATCH_OVER, struct{}{}, `{"type":"matchOver"}`},
+		{1, TYPE_ROUND_RESULT, state, `{"v":1,"type":"roundResult","data":{"round":2,"gameId":"ABCDE","yourScore":1,"theirScore":0,"winner":true}}`},
+		{1, TYPE_PRESENCE, presence, `{"v":1,"type":"presence","data":{"gameId":"ABCDE","userId":"p2","status":"disconnected"}}`},
+	}
+	for _, c := range cases {
+		b, err := Encode(c.version, c.msgType, c.payload)
+		if err != nil {
+			t.Fatalf("v%d %s: unable to encode: %s", c.version, c.msgType, err)
+		}
+		if string(b) != c.expected {
+			t.Errorf("v%d %s:\nexpected %s\ngot      %s", c.version, c.msgType, c.expected, b)
+		}
+
+		env, err := Decode(b)
+		if err != nil {
+			t.Fatalf("v%d %s: unable to decode: %s", c.version, c.msgType, err)
+		}
+		// version 0 can't tell a round result from a state
+		if env.V != c.version || (env.Type != c.msgType && c.msgType != TYPE_ROUND_RESULT) {
+			t.Errorf("v%d %s: decoded as v%d %s", c.version, c.msgType, env.V, env.Type)
+		}
+	}
+
+	if _, err := Encode(2, TYPE_STATE, state); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("unknown versions should not be encoded: %v", err)
+	}
+	if _, err := Decode([]byte(`{"v":2,"type":"state"}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("unknown versions should not be decoded: %v", err)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	m := PlayerMessage{Action: "play", UID: "p1", GameID: "ABCDE", Play: "rock", Round: 3, RequestID: "r1"}
+
+	v1, err := EncodeRequest(1, m)
+	if err != nil {
+		t.Fatalf("unable to encode request: %s", err)
+	}
+	expected := `{"v":1,"type":"play","requestId":"r1","data":{"userId":"p1","gameId":"ABCDE","play":"rock","round":3}}`
+	if string(v1) != expected {
+		t.Errorf("expected %s\ngot      %s", expected, v1)
+	}
+	decoded, err := DecodeRequest(v1)
+	if err != nil {
+		t.Fatalf("unable to decode request: %s", err)
+	}
+	m.V = 1
+	if decoded != m {
+		t.Errorf("v1 request did not round trip: %+v", decoded)
+	}
+
+	v0 := []byte(`{"action":"play","userId":"p1","gameId":"ABCDE","play":"rock","round":3,"requestId":"r1"}`)
+	decoded, err = DecodeRequest(v0)
+	m.V = 0
+	if err != nil || decoded != m {
+		t.Errorf("v0 request should decode as before: %+v %v", decoded, err)
+	}
+
+	for _, body := range []string{`not json`, `[1,2]`, `{"v":1,"type":"play","data":"rock"}`} {
+		if _, err := DecodeRequest([]byte(body)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s should be malformed: %v", body, err)
+		}
+	}
+	if _, err := DecodeRequest([]byte(`{"v":7,"type":"play"}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("newer versions should be rejected: %v", err)
+	}
+}
+
+// jsonNames returns the json names of a struct's fields
+func jsonNames(v interface{}) []string {
+	names := []string{}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestSchemas(t *testing.T) {
+	// every field the server sends or accepts should be described in its schema
+	schemas := map[string]interface{}{
+		"state.json":       GameState{},
+		"matchOver.json":   MatchOverMessage{},
+		"error.json":       ErrorMessage{},
+		"presence.json":    PresenceMessage{},
+		"history.json":     HistoryMessage{},
+		"stats.json":       StatsMessage{},
+		"leaderboard.json": LeaderboardMessage{},
+		"queue.json":       QueueMessage{},
+		"matched.json":     MatchedMessage{},
+		"chat.json":        ChatMessage{},
+		"rematch.json":     RematchMessage{},
+		"tournament.json":  TournamentMessage{},
+		"request.json":     PlayerMessage{},
+		"envelope.json":    Envelope{},
+	}
+
+	files, _ := filepath.Glob("schema/*.json")
+	if len(files) != len(schemas) {
+		t.Errorf("expected a schema for every message, found %v", files)
+	}
+
+	for file, message := range schemas {
+		data, err := ioutil.ReadFile(filepath.Join("schema", file))
+		if err != nil {
+			t.Fatalf("missing schema %s: %s", file, err)
+		}
+		var schema struct {
+			Properties map[string]interface{} `json:"properties"`
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("%s is not valid JSON: %s", file, err)
+		}
+		for _, name := range jsonNames(message) {
+			if _, found := schema.Properties[name]; !found {
+				t.Errorf("%s does not describe %s", file, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package rating
+
+import "math"
+
+// Elo is the simpler option: a single number per player, and a fixed K factor for how far
+// each game can move it.
+
+// ELO_K is the K factor used by many national chess federations for most players
+const ELO_K = 32
+
+// EloExpected is the score a player rated ra is expected to get against one rated rb
+func EloExpected(ra, rb float64) float64 {
+	return 1 / (1 + math.Pow(10, (rb-ra)/400))
+}
+
+// EloResult is the outcome of one game against an opponent
+type EloResult struct {
+	Opponent float64
+	// Score is 1 for a win, 0.5 for a draw and 0 for a loss
+	Score float64
+}
+
+// EloUpdate returns a player's new Elo rating after a set of games, all scored against
+// the ratings everyone had at the start
+func EloUpdate(r float64, results []EloResult, k float64) float64 {
+	var expected, actual float64
+	for _, res := range results {
+		expected += EloExpected(r, res.Opponent)
+		actual += res.Score
+	}
+	return r + k*(actual-expected)
+}
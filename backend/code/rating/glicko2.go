@@ -0,0 +1,116 @@
+// Package rating implements player rating systems: Glicko-2, which the game uses, and Elo.
+package rating
+
+import "math"
+
+// Glicko-2 as described in Mark Glickman's "Example of the Glicko-2 system",
+// http://www.glicko.net/glicko/glicko2.pdf
+
+const (
+	// DEFAULT_RATING, DEFAULT_DEVIATION and DEFAULT_VOLATILITY are where unrated players start
+	DEFAULT_RATING     = 1500
+	DEFAULT_DEVIATION  = 350
+	DEFAULT_VOLATILITY = 0.06
+	// TAU constrains how much volatility can change, between 0.3 and 1.2
+	TAU = 0.5
+
+	// scale converts between the Glicko and Glicko-2 scales
+	scale = 173.7178
+	// epsilon is the convergence tolerance for the volatility iteration
+	epsilon = 0.000001
+)
+
+// Rating is a player's Glicko-2 rating, on the familiar Glicko scale
+type Rating struct {
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+}
+
+// Result is the outcome of one game in a rating period
+type Result struct {
+	Opponent Rating
+	// Score is 1 for a win, 0.5 for a draw and 0 for a loss
+	Score float64
+}
+
+// Default returns the rating of a new player
+func Default() Rating {
+	return Rating{Rating: DEFAULT_RATING, Deviation: DEFAULT_DEVIATION, Volatility: DEFAULT_VOLATILITY}
+}
+
+// g reduces the impact of games against opponents whose rating is uncertain
+func g(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// expected is the expected score against an opponent, on the Glicko-2 scale
+func expected(mu, muj, phij float64) float64 {
+	return 1 / (1 + math.Exp(-g(phij)*(mu-muj)))
+}
+
+// Update returns the player's new rating after a rating period with the given results, using
+// the system constant tau. With no results only the deviation grows, as the rating gets older.
+func Update(p Rating, results []Result, tau float64) Rating {
+	mu := (p.Rating - DEFAULT_RATING) / scale
+	phi := p.Deviation / scale
+	sigma := p.Volatility
+
+	if len(results) == 0 {
+		p.Deviation = math.Sqrt(phi*phi+sigma*sigma) * scale
+		return p
+	}
+
+	// step 3 and 4: the estimated variance, and the estimated improvement
+	var vinv, delta float64
+	for _, r := range results {
+		muj := (r.Opponent.Rating - DEFAULT_RATING) / scale
+		phij := r.Opponent.Deviation / scale
+		e := expected(mu, muj, phij)
+		vinv += g(phij) * g(phij) * e * (1 - e)
+		delta += g(phij) * (r.Score - e)
+	}
+	v := 1 / vinv
+	delta *= v
+
+	// step 5: the new volatility, by the Illinois algorithm
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi*phi-v-ex)/(2*math.Pow(phi*phi+v+ex, 2)) - (x-a)/(tau*tau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		B = a - k*tau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > epsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	sigma = math.Exp(A / 2)
+
+	// step 6 to 8: the new deviation and rating, converted back to the Glicko scale
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * delta / v
+
+	return Rating{
+		Rating:     mu*scale + DEFAULT_RATING,
+		Deviation:  phi * scale,
+		Volatility: sigma,
+	}
+}
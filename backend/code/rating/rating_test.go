@@ -0,0 +1,95 @@
+package rating
+
+import (
+	"math"
+	"testing"
+)
+
+// near checks a value against a published one, to the precision it was published at
+func near(t *testing.T, name string, got, want, tolerance float64) {
+	t.Helper()
+	if math.Abs(got-want) > tolerance {
+		t.Errorf("%s: expected %v, got %v", name, want, got)
+	}
+}
+
+func TestGlicko2(t *testing.T) {
+	cases := []struct {
+		name     string
+		player   Rating
+		results  []Result
+		expected Rating
+	}{
+		{
+			// the worked example from Glickman's paper
+			name:   "glickman example",
+			player: Rating{1500, 200, 0.06},
+			results: []Result{
+				{Rating{1400, 30, 0.06}, 1},
+				{Rating{1550, 100, 0.06}, 0},
+				{Rating{1700, 300, 0.06}, 0},
+			},
+			expected: Rating{1464.06, 151.52, 0.05999},
+		},
+		{
+			// a player who doesn't compete only becomes less certain: sqrt(200^2 + (0.06*173.7178)^2)
+			name:     "no games",
+			player:   Rating{1500, 200, 0.06},
+			expected: Rating{1500, 200.27, 0.06},
+		},
+	}
+
+	for _, c := range cases {
+		got := Update(c.player, c.results, TAU)
+		near(t, c.name+" rating", got.Rating, c.expected.Rating, 0.01)
+		near(t, c.name+" deviation", got.Deviation, c.expected.Deviation, 0.01)
+		near(t, c.name+" volatility", got.Volatility, c.expected.Volatility, 0.00001)
+	}
+}
+
+func TestGlicko2Symmetry(t *testing.T) {
+	// equal players: the winner goes up exactly as much as the loser goes down
+	a := Update(Default(), []Result{{Default(), 1}}, TAU)
+	b := Update(Default(), []Result{{Default(), 0}}, TAU)
+	near(t, "symmetry", a.Rating-DEFAULT_RATING, DEFAULT_RATING-b.Rating, 0.000001)
+	if a.Rating <= DEFAULT_RATING || a.Deviation >= DEFAULT_DEVIATION {
+		t.Errorf("winning should raise the rating and lower the deviation: %+v", a)
+	}
+
+	draw := Update(Default(), []Result{{Default(), 0.5}}, TAU)
+	near(t, "draw", draw.Rating, DEFAULT_RATING, 0.000001)
+}
+
+func TestElo(t *testing.T) {
+	cases := []struct {
+		name     string
+		rating   float64
+		results  []EloResult
+		k        float64
+		expected float64
+	}{
+		{
+			// the example from the Wikipedia article on the Elo rating system
+			name:   "wikipedia example",
+			rating: 1613,
+			results: []EloResult{
+				{1609, 0}, {1477, 0.5}, {1388, 1}, {1586, 1}, {1720, 0},
+			},
+			k:        ELO_K,
+			expected: 1601,
+		},
+		{
+			name:     "equal players",
+			rating:   1500,
+			results:  []EloResult{{1500, 1}},
+			k:        ELO_K,
+			expected: 1516,
+		},
+	}
+
+	for _, c := range cases {
+		near(t, c.name, EloUpdate(c.rating, c.results, c.k), c.expected, 0.5)
+	}
+
+	near(t, "expected score", EloExpected(1613, 1609), 0.506, 0.001)
+}
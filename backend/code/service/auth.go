@@ -0,0 +1,42 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jbarratt/rpsls/backend/code/auth"
+	"github.com/jbarratt/rpsls/backend/code/bot"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// TOKEN_PARAM is the query parameter clients pass their token in when connecting, e.g. wss://host/Prod?token=...
+const TOKEN_PARAM = "token"
+
+// SetAuth requires every connection to bring a token the verifier accepts. Messages then act as
+// the token's subject, and the userId they carry is ignored.
+func (s *LambdaSvc) SetAuth(v *auth.Verifier) {
+	s.auth = v
+}
+
+// authenticate checks the token a connection was opened with, and binds the user it was issued
+// to to the connection
+func (s *LambdaSvc) authenticate(e events.APIGatewayWebsocketProxyRequest) error {
+	claims, err := s.auth.Verify(e.QueryStringParameters[TOKEN_PARAM])
+	if err != nil {
+		return err
+	}
+	if bot.IsBot(claims.Subject) {
+		return fmt.Errorf("%w: user id %s is reserved", ErrBadRequest, claims.Subject)
+	}
+	return s.store.StoreConnection(e.RequestContext.ConnectionID, "", claims.Subject)
+}
+
+// identity returns the user bound to a connection when it was authenticated
+func (s *LambdaSvc) identity(connectionID string) (string, error) {
+	_, userID, err := s.store.LookupConnection(connectionID)
+	if errors.Is(err, store.ErrNoConnection) || (err == nil && userID == "") {
+		return "", fmt.Errorf("%w: connection %s has no identity", ErrUnauthorized, connectionID)
+	}
+	return userID, err
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jbarratt/rpsls/backend/code/auth"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+)
+
+// connect opens a connection with a token, and returns the status code
+func connect(t *testing.T, s *LambdaSvc, connectionID, token string) int {
+	t.Helper()
+	resp, err := s.Connect(events.APIGatewayWebsocketProxyRequest{
+		QueryStringParameters: map[string]string{TOKEN_PARAM: token},
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "$connect",
+		},
+	})
+	if err != nil {
+		t.Fatalf("connect route returned an error: %s", err)
+	}
+	return resp.(events.APIGatewayProxyResponse).StatusCode
+}
+
+func TestAuthenticatedConnections(t *testing.T) {
+	s, st, rec := testSvc()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	v := auth.NewVerifier()
+	v.AddHMACKey("", secret)
+	v.AddRSAKey("", &key.PublicKey)
+	s.SetAuth(v)
+
+	expires := time.Now().Unix() + 3600
+	alice, _ := auth.SignHS256(auth.Claims{Subject: "alice", ExpiresAt: expires}, "", secret)
+	bob, _ := auth.SignRS256(auth.Claims{Subject: "bob", ExpiresAt: expires}, "", key)
+	forged, _ := auth.SignHS256(auth.Claims{Subject: "alice", ExpiresAt: expires}, "", []byte("guess"))
+	botToken, _ := auth.SignHS256(auth.Claims{Subject: "bot:random", ExpiresAt: expires}, "", secret)
+
+	for name, token := range map[string]string{"no": "", "forged": forged, "bot": botToken} {
+		if code := connect(t, s, "conn9", token); code != 401 {
+			t.Errorf("a connection with %s token should be refused, got %d", name, code)
+		}
+	}
+	send(t, s, "conn9", PlayerMessage{Action: "new", UID: "alice"})
+	if code := lastError(t, rec, "conn9").Code; code != protocol.CODE_UNAUTHORIZED {
+		t.Errorf("messages on a refused connection should fail with UNAUTHORIZED, got %s", code)
+	}
+
+	if code := connect(t, s, "conn1", alice); code != 200 {
+		t.Fatalf("alice should be able to connect, got %d", code)
+	}
+	if code := connect(t, s, "conn2", bob); code != 200 {
+		t.Fatalf("bob should be able to connect, got %d", code)
+	}
+
+	// whatever userId the messages claim, they come from the signed in players
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "mallory"})
+	gameID := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "alice", GameID: gameID})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "alice", GameID: gameID, Play: "rock", Round: 1})
+
+	g, err := st.Load(gameID)
+	if err != nil {
+		t.Fatalf("unable to load game: %s", err)
+	}
+	if len(g.Players) != 2 || g.Players["alice"] == nil || g.Players["bob"] == nil {
+		t.Fatalf("the game should be between alice and bob: %+v", g.Players)
+	}
+	if g.Players["alice"].Play != "" || g.Players["bob"].Play != "rock" {
+		t.Errorf("bob's play shouldn't count for alice: alice %+v bob %+v", g.Players["alice"], g.Players["bob"])
+	}
+}
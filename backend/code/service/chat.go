@@ -0,0 +1,157 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+const (
+	// CHAT_MAX_LENGTH is the most characters a chat message can have
+	CHAT_MAX_LENGTH = 200
+	// CHAT_LIMIT is how many messages a player can send in each CHAT_WINDOW seconds
+	CHAT_LIMIT  = 5
+	CHAT_WINDOW = 10
+	// CHAT_HISTORY is how many recent messages are kept with a game by default
+	CHAT_HISTORY = 20
+)
+
+// EMOTES are the predefined emotes players can send instead of text
+var EMOTES = map[string]bool{
+	"wave":     true,
+	"gg":       true,
+	"thumbsup": true,
+	"laugh":    true,
+	"think":    true,
+	"wow":      true,
+	"oops":     true,
+}
+
+// ChatFilter checks the text of a chat message before it's sent on. It returns the text to send,
+// which may be cleaned up, or false to refuse the message.
+type ChatFilter func(text string) (string, bool)
+
+// ChatConfig controls in-game chat
+type ChatConfig struct {
+	// Filter is run on every text message, nil for none
+	Filter ChatFilter
+	// History is how many recent messages are kept with each game, and sent to players
+	// when they join. 0 keeps none.
+	History int
+}
+
+// Blocklist returns a ChatFilter which masks each of the words, ignoring case, with asterisks
+func Blocklist(words []string) ChatFilter {
+	quoted := []string{}
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	blocked := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return func(text string) (string, bool) {
+		return blocked.ReplaceAllStringFunc(text, func(w string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(w))
+		}), true
+	}
+}
+
+// SetChat changes how chat is filtered and kept
+func (s *LambdaSvc) SetChat(c ChatConfig) {
+	s.chat = c
+}
+
+// Chat relays a text message or emote from a player to everyone in their game, including spectators
+func (s *LambdaSvc) Chat(connectionID string, message PlayerMessage) error {
+	text := strings.TrimSpace(message.Text)
+	switch {
+	case (text == "") == (message.Emote == ""):
+		return fmt.Errorf("%w: chat needs either text or an emote", ErrBadRequest)
+	case utf8.RuneCountInString(text) > CHAT_MAX_LENGTH:
+		return fmt.Errorf("%w: chat messages can be at most %d characters", ErrBadRequest, CHAT_MAX_LENGTH)
+	case message.Emote != "" && !EMOTES[message.Emote]:
+		return fmt.Errorf("%w: unknown emote %s", ErrBadRequest, message.Emote)
+	}
+	if text != "" && s.chat.Filter != nil {
+		var ok bool
+		if text, ok = s.chat.Filter(text); !ok {
+			return fmt.Errorf("%w: message not allowed", ErrBadRequest)
+		}
+	}
+
+	g, err := s.store.Load(message.GameID)
+	if err != nil {
+		return err
+	}
+	// only players can chat, from the connection they're playing on
+	p, found := g.Players[message.UID]
+	if !found || p.Address != connectionID {
+		return fmt.Errorf("%w: only players in the game can chat", ErrBadRequest)
+	}
+
+	now := time.Now()
+	err = s.store.LimitChat(g.ID, p.ID, now.Unix()/CHAT_WINDOW, CHAT_LIMIT)
+	if err != nil {
+		return err
+	}
+
+	c := &store.ChatItem{
+		GameID: g.ID,
+		UserID: p.ID,
+		Text:   text,
+		Emote:  message.Emote,
+		Sent:   now.UnixNano() / int64(time.Millisecond),
+	}
+	if s.chat.History > 0 {
+		if err := s.store.StoreChat(c); err != nil {
+			fmt.Printf("Unable to keep chat message: %s\n", err)
+		}
+	}
+
+	cm := chatMessage(c)
+	for _, o := range g.SortedPlayers() {
+		if !o.Offline {
+			s.send(o.Address, o.Protocol, protocol.TYPE_CHAT, cm)
+		}
+	}
+	for address, sp := range g.Spectators {
+		s.send(address, sp.Protocol, protocol.TYPE_CHAT, cm)
+	}
+	return nil
+}
+
+// chatMessage converts a stored chat message to the one sent to clients
+func chatMessage(c *store.ChatItem) ChatMessage {
+	return ChatMessage{
+		GameID: c.GameID,
+		UserID: c.UserID,
+		Text:   c.Text,
+		Emote:  c.Emote,
+		Sent:   c.Sent,
+	}
+}
+
+// SendRecentChat sends the chat kept with a game to a connection, oldest first
+func (s *LambdaSvc) SendRecentChat(gameID, connectionID string, version int) error {
+	if s.chat.History == 0 {
+		return nil
+	}
+	recent, err := s.store.RecentChat(gameID, s.chat.History)
+	if err != nil {
+		return err
+	}
+	for i := range recent {
+		if err := s.send(connectionID, version, protocol.TYPE_CHAT, chatMessage(&recent[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+)
+
+func TestChat(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+	send(t, s, "watcher", PlayerMessage{Action: "spectate", GameID: gameID})
+	rec.Reset()
+
+	send(t, s, "conn1", PlayerMessage{Action: "chat", UID: "p1", GameID: gameID, Text: "  good luck  "})
+	for _, conn := range []string{"conn1", "conn2", "watcher"} {
+		msgs := rec.To(conn)
+		if len(msgs) != 1 || !strings.HasPrefix(msgs[0], `{"type":"chat","gameId":"`+gameID+`","userId":"p1","text":"good luck","sent":`) {
+			t.Errorf("%s should get the chat message: %v", conn, msgs)
+		}
+	}
+	send(t, s, "conn2", PlayerMessage{Action: "chat", UID: "p2", GameID: gameID, Emote: "wave"})
+	if msgs := rec.To("conn1"); len(msgs) != 2 || !strings.Contains(msgs[1], `"emote":"wave"`) {
+		t.Errorf("emotes should be relayed: %v", msgs)
+	}
+
+	cases := []struct {
+		name    string
+		conn    string
+		message PlayerMessage
+		code    string
+	}{
+		{"empty", "conn1", PlayerMessage{UID: "p1", GameID: gameID}, protocol.CODE_BAD_REQUEST},
+		{"text and emote", "conn1", PlayerMessage{UID: "p1", GameID: gameID, Text: "hi", Emote: "wave"}, protocol.CODE_BAD_REQUEST},
+		{"too long", "conn1", PlayerMessage{UID: "p1", GameID: gameID, Text: strings.Repeat("a", CHAT_MAX_LENGTH+1)}, protocol.CODE_BAD_REQUEST},
+		{"unknown emote", "conn1", PlayerMessage{UID: "p1", GameID: gameID, Emote: "dance"}, protocol.CODE_BAD_REQUEST},
+		{"spectator", "watcher", PlayerMessage{UID: "p3", GameID: gameID, Text: "hi"}, protocol.CODE_BAD_REQUEST},
+		{"impersonation", "watcher", PlayerMessage{UID: "p1", GameID: gameID, Text: "hi"}, protocol.CODE_BAD_REQUEST},
+		{"missing game", "conn1", PlayerMessage{UID: "p1", GameID: "NOPE", Text: "hi"}, protocol.CODE_GAME_NOT_FOUND},
+	}
+	for _, c := range cases {
+		rec.Reset()
+		c.message.Action = "chat"
+		send(t, s, c.conn, c.message)
+		if code := lastError(t, rec, c.conn).Code; code != c.code {
+			t.Errorf("%s: expected %s, got %s", c.name, c.code, code)
+		}
+		if c.conn != "conn2" && len(rec.To("conn2")) != 0 {
+			t.Errorf("%s: nothing should be relayed: %v", c.name, rec.To("conn2"))
+		}
+	}
+}
+
+func TestChatRateLimit(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	// p1 already sent one message, the limit might straddle two windows so send plenty
+	send(t, s, "conn1", PlayerMessage{Action: "chat", UID: "p1", GameID: gameID, Emote: "gg"})
+	for i := 0; i < 2*CHAT_LIMIT; i++ {
+		send(t, s, "conn1", PlayerMessage{Action: "chat", UID: "p1", GameID: gameID, Emote: "gg"})
+	}
+	limited := 0
+	for _, msg := range rec.To("conn1") {
+		if strings.Contains(msg, `"code":"RATE_LIMITED"`) {
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Errorf("expected chat to be rate limited: %v", rec.To("conn1"))
+	}
+	if n := len(rec.To("conn2")); n > 2*CHAT_LIMIT {
+		t.Errorf("at most %d messages should get through across two windows, got %d", 2*CHAT_LIMIT, n)
+	}
+
+	// the limit is per player
+	rec.Reset()
+	send(t, s, "conn2", PlayerMessage{Action: "chat", UID: "p2", GameID: gameID, Emote: "gg"})
+	if len(rec.To("conn1")) != 1 {
+		t.Errorf("p2 should still be able to chat: %v", rec.To("conn2"))
+	}
+}
+
+func TestChatFilterAndHistory(t *testing.T) {
+	s, _, rec := testSvc()
+	s.SetChat(ChatConfig{Filter: Blocklist([]string{"darn", " heck "}), History: 2})
+	gameID := startGame(t, s, rec)
+
+	for _, text := range []string{"first", "Darn it", "what the heck, darned"} {
+		send(t, s, "conn1", PlayerMessage{Action: "chat", UID: "p1", GameID: gameID, Text: text})
+	}
+	msgs := rec.To("conn2")
+	if len(msgs) != 3 || !strings.Contains(msgs[1], `"text":"**** it"`) || !strings.Contains(msgs[2], `"text":"what the ****, darned"`) {
+		t.Errorf("blocked words should be masked: %v", msgs)
+	}
+
+	// p2 reconnects and catches up on the last two messages
+	disconnect(t, s, "conn2")
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	msgs = rec.To("conn3")
+	if len(msgs) != 3 || !strings.Contains(msgs[1], `"text":"**** it"`) || !strings.Contains(msgs[2], `"text":"what the ****, darned"`) {
+		t.Errorf("rejoining should replay recent chat after the state: %v", msgs)
+	}
+
+	s.SetChat(ChatConfig{Filter: func(string) (string, bool) { return "", false }})
+	rec.Reset()
+	send(t, s, "conn1", PlayerMessage{Action: "chat", UID: "p1", GameID: gameID, Text: "anything"})
+	if code := lastError(t, rec, "conn1").Code; code != protocol.CODE_BAD_REQUEST || len(rec.To("conn3")) != 0 {
+		t.Errorf("filters should be able to refuse messages, got %s", code)
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+	"github.com/jbarratt/rpsls/backend/code/tournament"
+)
+
+var (
+	// ErrBadRequest is returned for messages the service can't make sense of
+	ErrBadRequest = errors.New("bad request")
+	// ErrUnauthorized is returned for messages on a connection nobody is signed in to, when tokens are required
+	ErrUnauthorized = errors.New("not signed in")
+)
+
+// errorCodes maps the errors players can cause to the code they are told
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrBadRequest, protocol.CODE_BAD_REQUEST},
+	{ErrUnauthorized, protocol.CODE_UNAUTHORIZED},
+	{ErrRequestInProgress, protocol.CODE_REQUEST_IN_PROGRESS},
+	{protocol.ErrMalformed, protocol.CODE_BAD_REQUEST},
+	{protocol.ErrUnsupportedVersion, protocol.CODE_BAD_REQUEST},
+	{store.ErrGameNotFound, protocol.CODE_GAME_NOT_FOUND},
+	{store.ErrStaleRound, protocol.CODE_STALE_ROUND},
+	{store.ErrNotQueued, protocol.CODE_NOT_QUEUED},
+	{store.ErrChatLimited, protocol.CODE_RATE_LIMITED},
+	{store.ErrRematchStarted, protocol.CODE_REMATCH_STARTED},
+	{store.ErrNotAPlayer, protocol.CODE_BAD_REQUEST},
+	{store.ErrTournamentNotFound, protocol.CODE_TOURNAMENT_NOT_FOUND},
+	{tournament.ErrRegistrationClosed, protocol.CODE_REGISTRATION_CLOSED},
+	{tournament.ErrAlreadyStarted, protocol.CODE_REGISTRATION_CLOSED},
+	{tournament.ErrNotEnoughPlayers, protocol.CODE_NOT_ENOUGH_PLAYERS},
+	{game.ErrGameFull, protocol.CODE_GAME_FULL},
+	{game.ErrInvalidPlay, protocol.CODE_INVALID_PLAY},
+	{game.ErrMatchOver, protocol.CODE_MATCH_OVER},
+	{game.ErrMatchNotOver, protocol.CODE_MATCH_NOT_OVER},
+	{game.ErrWrongMode, protocol.CODE_WRONG_MODE},
+	{game.ErrOutOfTurn, protocol.CODE_OUT_OF_TURN},
+	{game.ErrAlreadyPlayed, protocol.CODE_ALREADY_PLAYED},
+	{game.ErrInvalidCommitment, protocol.CODE_INVALID_COMMITMENT},
+	{game.ErrInvalidOptions, protocol.CODE_INVALID_OPTIONS},
+	{game.ErrUnknownRuleset, protocol.CODE_UNKNOWN_RULESET},
+}
+
+// errorMessage builds the message for an error. Anything unexpected, like a storage failure,
+// is reported as INTERNAL without the details.
+func errorMessage(requestID string, err error) ErrorMessage {
+	var repeated *repeatedError
+	if errors.As(err, &repeated) {
+		return ErrorMessage{Code: repeated.code, Message: repeated.message, RequestID: requestID}
+	}
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ErrorMessage{Code: ec.code, Message: err.Error(), RequestID: requestID}
+		}
+	}
+	return ErrorMessage{Code: protocol.CODE_INTERNAL, Message: "something went wrong, try again", RequestID: requestID}
+}
+
+// SendError tells a connection why its message failed, in the protocol version it speaks
+func (s *LambdaSvc) SendError(connectionID string, version int, requestID string, err error) error {
+	return s.send(connectionID, version, protocol.TYPE_ERROR, errorMessage(requestID, err))
+}
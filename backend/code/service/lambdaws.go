@@ -1,40 +1,121 @@
 package service
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/jbarratt/rpsls/backend/code/auth"
+	"github.com/jbarratt/rpsls/backend/code/bot"
 	"github.com/jbarratt/rpsls/backend/code/game"
 	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/rating"
 	"github.com/jbarratt/rpsls/backend/code/store"
 )
 
+const (
+	// LEADERBOARD_SIZE is how many players a leaderboard request gets unless it asks for fewer
+	LEADERBOARD_SIZE = 10
+	// MAX_LEADERBOARD_SIZE is the most players a leaderboard request can ask for
+	MAX_LEADERBOARD_SIZE = 100
+)
+
 type LambdaSvc struct {
-	store *store.Store
-	ws    *notify.APIGWNotifier
+	store store.GameStore
+	ws    notify.Notifier
+	chat  ChatConfig
+	// auth verifies connection tokens, nil if they aren't required
+	auth *auth.Verifier
 }
 
-// NewLambdaSvc returns a new lambda service
-func NewLambdaSvc(store *store.Store, ws *notify.APIGWNotifier) *LambdaSvc {
+// NewLambdaSvc returns a new lambda service, which keeps CHAT_HISTORY chat messages per game and doesn't filter them.
+// Connections don't need a token until SetAuth is called.
+func NewLambdaSvc(store store.GameStore, ws notify.Notifier) *LambdaSvc {
 	return &LambdaSvc{
 		store: store,
 		ws:    ws,
+		chat:  ChatConfig{History: CHAT_HISTORY},
 	}
 }
 
-// Connect is currently a no-op
+// Connect accepts every connection, unless tokens are required. Then the connection needs a valid
+// token, and is refused otherwise, see authenticate.
 func (s *LambdaSvc) Connect(e events.APIGatewayWebsocketProxyRequest) (interface{}, error) {
+	if s.auth != nil {
+		if err := s.authenticate(e); err != nil {
+			log.Printf("Refusing connection %s: %s\n", e.RequestContext.ConnectionID, err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 401,
+			}, nil
+		}
+	}
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
 	}, nil
 }
 
-// Disconnect is currently a no-op
+// Disconnect marks the connection's player offline and tells everyone else in their game
 func (s *LambdaSvc) Disconnect(e events.APIGatewayWebsocketProxyRequest) (interface{}, error) {
+	connectionID := e.RequestContext.ConnectionID
+	// the game a connection spectates is indexed apart from the one it plays in
+	watching, err := s.store.LookupSpectating(connectionID)
+	if err == nil {
+		if err := s.store.RemoveSpectator(watching, connectionID); err != nil {
+			fmt.Printf("Unable to remove spectator %s: %s\n", connectionID, err)
+		}
+	} else if !errors.Is(err, store.ErrNoConnection) {
+		fmt.Printf("Unable to look up spectating connection %s: %s\n", connectionID, err)
+	}
+
+	gameID, userID, err := s.store.LookupConnection(connectionID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNoConnection) {
+			fmt.Printf("Unable to look up connection %s: %s\n", connectionID, err)
+		} else if watching != "" {
+			if err := s.store.DeleteConnection(connectionID); err != nil {
+				fmt.Printf("Unable to remove connection %s: %s\n", connectionID, err)
+			}
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+		}, nil
+	}
+
+	err = s.store.DeleteConnection(connectionID)
+	if err != nil {
+		fmt.Printf("Unable to remove connection %s: %s\n", connectionID, err)
+	}
+	// a player waiting for an opponent from this connection stops waiting
+	if err := s.store.Dequeue(userID, connectionID); err != nil && !errors.Is(err, store.ErrNotQueued) {
+		fmt.Printf("Unable to dequeue %s: %s\n", userID, err)
+	}
+	if gameID == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+		}, nil
+	}
+
+	g, err := s.store.Load(gameID)
+	if err != nil {
+		fmt.Printf("Unable to load game: %s\n", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+		}, nil
+	}
+	// fails if the player already reconnected somewhere else, then there's nothing to announce
+	err = s.store.StoreOffline(g, userID, connectionID)
+	if err != nil {
+		fmt.Printf("Not marking %s offline: %s\n", userID, err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+		}, nil
+	}
+
+	s.SendPresence(g, userID, PRESENCE_DISCONNECTED)
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
 	}, nil
@@ -42,42 +123,26 @@ func (s *LambdaSvc) Disconnect(e events.APIGatewayWebsocketProxyRequest) (interf
 
 func (s *LambdaSvc) Default(e events.APIGatewayWebsocketProxyRequest) (interface{}, error) {
 	fmt.Printf("$defaut: body: '%s' connectionId: '%s'\n", e.Body, e.RequestContext.ConnectionID)
+	connectionID := e.RequestContext.ConnectionID
 
-	// Parse a PlayerMessage
-	message := PlayerMessage{}
-	if err := json.Unmarshal([]byte(e.Body), &message); err != nil {
+	// Parse a PlayerMessage, in whichever protocol version the client speaks
+	message, err := protocol.DecodeRequest([]byte(e.Body))
+	if err != nil {
 		log.Println("Unable to decode player message", err.Error())
+		version := 0
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			version = protocol.VERSION
+		}
+		s.SendError(connectionID, version, "", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
 		}, nil
 	}
 
-	switch strings.ToLower(message.Action) {
-	case "play":
-		err := s.Play(e.RequestContext.ConnectionID, message)
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-			}, nil
-		}
-	case "new":
-		err := s.NewGame(e.RequestContext.ConnectionID, message)
-		if err != nil {
-			log.Println("Unable to create new game", err.Error())
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-			}, nil
-		}
-	case "join":
-		err := s.JoinGame(e.RequestContext.ConnectionID, message)
-		if err != nil {
-			log.Println("Unable to join game", err.Error())
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-			}, nil
-		}
-	default:
-		fmt.Printf("Unknown action %s\n", message.Action)
+	err = s.dispatch(connectionID, message)
+	if err != nil {
+		log.Printf("Unable to %s: %s\n", message.Action, err)
+		s.SendError(connectionID, message.V, message.RequestID, err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
 		}, nil
@@ -88,6 +153,71 @@ func (s *LambdaSvc) Default(e events.APIGatewayWebsocketProxyRequest) (interface
 	}, nil
 }
 
+// dispatch runs the action a message asks for. With tokens required, the message acts as
+// the user bound to the connection, whatever userId it claims.
+func (s *LambdaSvc) dispatch(connectionID string, message PlayerMessage) error {
+	if s.auth != nil {
+		userID, err := s.identity(connectionID)
+		if err != nil {
+			return err
+		}
+		message.UID = userID
+	}
+	if bot.IsBot(message.UID) {
+		return fmt.Errorf("%w: user id %s is reserved", ErrBadRequest, message.UID)
+	}
+	if message.RequestID != "" {
+		return s.once(connectionID, message)
+	}
+	return s.run(connectionID, message)
+}
+
+// run carries out the action a message asks for
+func (s *LambdaSvc) run(connectionID string, message PlayerMessage) error {
+	switch strings.ToLower(message.Action) {
+	case "play":
+		return s.Play(connectionID, message)
+	case "new":
+		return s.NewGame(connectionID, message)
+	case "join":
+		return s.JoinGame(connectionID, message)
+	case "commit":
+		return s.Commit(connectionID, message)
+	case "reveal":
+		return s.Reveal(connectionID, message)
+	case "history":
+		return s.History(connectionID, message)
+	case "stats":
+		return s.Stats(connectionID, message)
+	case "leaderboard":
+		return s.Leaderboard(connectionID, message)
+	case "spectate":
+		return s.Spectate(connectionID, message)
+	case "chat":
+		return s.Chat(connectionID, message)
+	case "rematch":
+		return s.Rematch(connectionID, message, false)
+	case "acceptrematch":
+		return s.Rematch(connectionID, message, true)
+	case "declinerematch":
+		return s.DeclineRematch(connectionID, message)
+	case "queue":
+		return s.Queue(connectionID, message)
+	case "dequeue":
+		return s.Dequeue(connectionID, message)
+	case "createtournament":
+		return s.CreateTournament(connectionID, message)
+	case "registertournament":
+		return s.RegisterTournament(connectionID, message)
+	case "starttournament":
+		return s.StartTournament(connectionID, message)
+	case "tournament":
+		return s.ViewTournament(connectionID, message)
+	default:
+		return fmt.Errorf("%w: unknown action %s", ErrBadRequest, message.Action)
+	}
+}
+
 // Play handles a single player's play.
 func (s *LambdaSvc) Play(connectionID string, message PlayerMessage) error {
 	// Validate the plays are correct
@@ -99,6 +229,10 @@ func (s *LambdaSvc) Play(connectionID string, message PlayerMessage) error {
 		return err
 	}
 	gc, err := game.NewGameContext(message.UID, connectionID, g)
+	if err != nil {
+		fmt.Printf("Unable to join game to play: %s\n", err)
+		return err
+	}
 
 	// set this equal to the round from the user
 	// so plays will be rejected if too old.
@@ -109,160 +243,680 @@ func (s *LambdaSvc) Play(connectionID string, message PlayerMessage) error {
 		fmt.Printf("invalid play: %s Game: %+v Message: %+v\n", err, gc.Game, message)
 		return err
 	}
+	gc.Game.StartClock(time.Now().Unix())
 	err = s.store.StorePlay(gc)
 	if err != nil {
 		fmt.Printf("Unable to store play: %s\n", err)
 		return err
 	}
 
-	err = gc.Game.AdvanceGame()
+	err = s.playBots(gc.Game)
+	if err != nil {
+		fmt.Printf("Unable to make bot plays: %s\n", err)
+		return err
+	}
+
+	return s.resolveRound(gc.Game)
+}
+
+// playBots makes a play for every bot in the game which hasn't played this round yet
+func (s *LambdaSvc) playBots(g *game.Game) error {
+	var history []game.RoundResult
+	for _, p := range g.SortedPlayers() {
+		if !bot.IsBot(p.ID) || p.Round >= g.Round {
+			continue
+		}
+		strategy, err := bot.New(p.ID)
+		if err != nil {
+			return err
+		}
+		if history == nil {
+			history, err = s.store.History(g.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		opponent := ""
+		for _, o := range g.SortedPlayers() {
+			if !bot.IsBot(o.ID) {
+				opponent = o.ID
+				break
+			}
+		}
+
+		gc := &game.GameContext{Game: g, ActingPlayer: p}
+		if err := gc.Play(strategy.Next(g.Rules(), history, p.ID, opponent)); err != nil {
+			return err
+		}
+		if err := s.store.StorePlay(gc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveRound advances the game if every play is in, then stores and announces the result
+func (s *LambdaSvc) resolveRound(g *game.Game) error {
+	err := g.AdvanceGame()
 	if err != nil {
 		fmt.Printf("Round not yet complete")
 		return nil
 	}
 
-	err = s.store.StoreRound(gc.Game)
+	err = s.storeRound(g)
+	if errors.Is(err, store.ErrStaleRound) {
+		// Someone else resolved the round first. Whichever invocation's StoreRound succeeds owns
+		// the notification: StoreRound only fails before the round is written, so the winner
+		// always reaches NotifyPlayers and the loser only needs to catch up.
+		return s.reload(g)
+	}
 	if err != nil {
 		fmt.Printf("Unable to store round: %s\n", err)
 		return err
 	}
 
 	// the round advanced, time to notify all the players
-	s.NotifyPlayers(gc)
+	s.NotifyPlayers(g)
+	// a finished tournament match moves the tournament on, once the players know the result
+	if err := s.advanceTournament(g); err != nil {
+		fmt.Printf("Unable to advance tournament %s: %s\n", g.Tournament, err)
+	}
+	return nil
+}
+
+// reload replaces a game with the stored version, e.g. to see the result of a round another
+// invocation resolved
+func (s *LambdaSvc) reload(g *game.Game) error {
+	stored, err := s.store.Load(g.ID)
+	if err != nil {
+		fmt.Printf("Unable to reload game %s: %s\n", g.ID, err)
+		return err
+	}
+	*g = *stored
 	return nil
 }
 
-func otherPlayer(gc *game.GameContext) (*game.Player, error) {
-	var them *game.Player
-	for id, player := range gc.Game.Players {
-		if gc.ActingPlayer.ID != id {
-			them = player
+// storeRound stores a resolved round, and rates the players if it ended the match.
+// The round stands even if rating fails, so players still hear the result.
+func (s *LambdaSvc) storeRound(g *game.Game) error {
+	err := s.store.StoreRound(g)
+	if err != nil {
+		return err
+	}
+	if g.MatchOver {
+		if err := s.rateMatch(g); err != nil {
+			fmt.Printf("Unable to rate match %s: %s\n", g.ID, err)
+		}
+		// matches before the first rematch are counted when the series starts
+		if g.Series != "" {
+			if err := s.store.AddSeriesResult(g.Series, g.MatchWinner); err != nil {
+				fmt.Printf("Unable to count match %s in series %s: %s\n", g.ID, g.Series, err)
+			}
 		}
 	}
+	return nil
+}
 
-	if them == nil {
-		return nil, errors.New("Unable to find second player when messaging round completion")
+// rateMatch updates the Glicko-2 rating of every human player in a finished match,
+// treating it as a rating period with one game against each other human.
+// Matches against bots aren't rated.
+func (s *LambdaSvc) rateMatch(g *game.Game) error {
+	humans := []string{}
+	for _, p := range g.SortedPlayers() {
+		if !bot.IsBot(p.ID) {
+			humans = append(humans, p.ID)
+		}
+	}
+	if len(humans) < game.NUM_PLAYERS {
+		return nil
 	}
-	return them, nil
+
+	// everyone is rated against the ratings from before the match
+	before := make(map[string]rating.Rating, len(humans))
+	for _, id := range humans {
+		r, err := s.store.Rating(id)
+		if err != nil {
+			return err
+		}
+		before[id] = r
+	}
+
+	for _, id := range humans {
+		results := []rating.Result{}
+		for _, opponent := range humans {
+			if opponent != id {
+				results = append(results, rating.Result{Opponent: before[opponent], Score: g.MatchScore(id, opponent)})
+			}
+		}
+		err := s.store.StoreRating(id, rating.Update(before[id], results, rating.TAU))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// NotifyPlayers sends out a notification about a game round to all connected parties
-func (s *LambdaSvc) NotifyPlayers(gc *game.GameContext) error {
-
-	you := gc.ActingPlayer
-	them, err := otherPlayer(gc)
-	if err != nil {
-		fmt.Printf("Unable to find other player, critical.")
-		return err
-	}
-
-	youState := GameState{
-		Round:      gc.Game.Round,
-		GameID:     gc.Game.ID,
-		YourScore:  you.Score,
-		TheirScore: them.Score,
-		YourPlay:   you.Play,
-		TheirPlay:  them.Play,
-	}
-	themState := GameState{
-		Round:      gc.Game.Round,
-		GameID:     gc.Game.ID,
-		YourScore:  them.Score,
-		TheirScore: you.Score,
-		YourPlay:   them.Play,
-		TheirPlay:  you.Play,
-	}
-
-	switch gc.Game.Winner {
-	case "Tie":
-		youState.Winner = false
-		themState.Winner = false
-		youState.RoundSummary = "Tie Game"
-		themState.RoundSummary = "Tie Game"
-	case you.ID:
-		youState.Winner = true
-		themState.Winner = false
-		youState.RoundSummary = gc.Game.RoundSummary
-		themState.RoundSummary = gc.Game.RoundSummary
-	case them.ID:
-		youState.Winner = false
-		themState.Winner = true
-		youState.RoundSummary = gc.Game.RoundSummary
-		themState.RoundSummary = gc.Game.RoundSummary
-	default:
-		return errors.New("Unusable winner value")
+// ExpireRounds resolves every game whose round deadline has passed, forfeiting whoever
+// didn't act in time, and tells the players. It is driven by a timer, now is in unix seconds.
+func (s *LambdaSvc) ExpireRounds(now int64) error {
+	ids, err := s.store.ExpiredGames(now)
+	if err != nil {
+		fmt.Printf("Unable to find expired games: %s\n", err)
+		return err
 	}
 
-	s.SendStateMessage(&youState, you.Address)
-	s.SendStateMessage(&themState, them.Address)
+	for _, id := range ids {
+		g, err := s.store.Load(id)
+		if err != nil {
+			fmt.Printf("Unable to load expired game %s: %s\n", id, err)
+			continue
+		}
+		// the round may have been resolved since the scan
+		if !g.Expired(now) {
+			continue
+		}
+		missed, err := g.ExpireRound(now)
+		if err != nil {
+			fmt.Printf("Unable to expire round of game %s: %s\n", id, err)
+			continue
+		}
+		fmt.Printf("Round expired in game %s, missed by %v\n", id, missed)
+
+		err = s.storeRound(g)
+		if errors.Is(err, store.ErrStaleRound) {
+			// a late play or another timer resolved the round first
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Unable to store expired round: %s\n", err)
+			return err
+		}
+		s.NotifyPlayers(g)
+		if err := s.advanceTournament(g); err != nil {
+			fmt.Printf("Unable to advance tournament %s: %s\n", g.Tournament, err)
+		}
+	}
 	return nil
 }
 
-func (s *LambdaSvc) SendStateMessage(gs *GameState, address string) error {
-	b, err := json.Marshal(gs)
+// Commit handles a player's commitment in a fair play game.
+// Once everyone has committed, all players are told to reveal.
+func (s *LambdaSvc) Commit(connectionID string, message PlayerMessage) error {
+	g, err := s.store.Load(message.GameID)
 	if err != nil {
+		fmt.Printf("Unable to load game: %s\n", err)
 		return err
 	}
-	err = s.ws.Send(address, b)
+	gc, err := game.NewGameContext(message.UID, connectionID, g)
+	if err != nil {
+		return err
+	}
+
+	err = gc.Commit(strings.ToLower(message.Commitment))
+	if err != nil {
+		fmt.Printf("invalid commitment: %s\n", err)
+		return err
+	}
+	gc.Game.StartClock(time.Now().Unix())
+	err = s.store.StoreCommit(gc)
 	if err != nil {
-		// TODO maybe handle a disconnection event here
-		fmt.Printf("Error sending to player %s\n", err)
+		fmt.Printf("Unable to store commitment: %s\n", err)
+		return err
+	}
+
+	if gc.Game.AllCommitted() {
+		for _, p := range gc.Game.SortedPlayers() {
+			state := stateFor(gc.Game, p)
+			s.SendPlayerState(gc.Game, p, protocol.TYPE_STATE, &state)
+		}
 	}
 	return nil
 }
 
-// SendGameState will send a game state to a given connection
-func (s *LambdaSvc) SendGameState(gc *game.GameContext) error {
+// Reveal handles a player revealing their committed play in a fair play game
+func (s *LambdaSvc) Reveal(connectionID string, message PlayerMessage) error {
+	g, err := s.store.Load(message.GameID)
+	if err != nil {
+		fmt.Printf("Unable to load game: %s\n", err)
+		return err
+	}
+	gc, err := game.NewGameContext(message.UID, connectionID, g)
+	if err != nil {
+		return err
+	}
 
-	you := gc.ActingPlayer
-	them, err := otherPlayer(gc)
+	err = gc.Reveal(strings.ToLower(message.Play), message.Nonce)
 	if err != nil {
-		fmt.Printf("unable to find other player, but this may be new game")
-		them = &game.Player{}
+		fmt.Printf("invalid reveal: %s\n", err)
+		return err
+	}
+	err = s.store.StoreReveal(gc)
+	if err != nil {
+		fmt.Printf("Unable to store reveal: %s\n", err)
+		return err
 	}
 
+	return s.resolveRound(gc.Game)
+}
+
+// visiblePlay returns a player's play only once the round it was made in has resolved,
+// so nobody can see a move before they've made their own
+func visiblePlay(g *game.Game, p *game.Player) string {
+	if p.Round < g.Round {
+		return p.Play
+	}
+	return ""
+}
+
+// stateFor builds the view of the game for one player
+func stateFor(g *game.Game, you *game.Player) GameState {
 	state := GameState{
-		Round:      gc.Game.Round,
-		GameID:     gc.Game.ID,
-		YourScore:  you.Score,
-		TheirScore: them.Score,
-		YourPlay:   you.Play,
-		TheirPlay:  them.Play,
+		Round:        g.Round,
+		GameID:       g.ID,
+		YourScore:    you.Score,
+		YourPlay:     visiblePlay(g, you),
+		Ruleset:      g.Ruleset,
+		MatchFormat:  g.Format.Mode,
+		MatchLength:  g.Format.Length,
+		MatchOver:    g.MatchOver,
+		MatchWinner:  g.MatchWinner == you.ID,
+		MaxPlayers:   g.MaxPlayers,
+		FairPlay:     g.FairPlay,
+		RoundTimeout: g.RoundTimeout,
+		Deadline:     g.Deadline,
+		SeriesID:     g.Series,
 	}
 
-	s.SendStateMessage(&state, you.Address)
+	if g.FairPlay && !g.MatchOver {
+		state.Phase = "commit"
+		if g.AllCommitted() {
+			state.Phase = "reveal"
+		}
+	}
+
+	for _, p := range g.SortedPlayers() {
+		if p.ID == you.ID {
+			continue
+		}
+		state.Opponents = append(state.Opponents, OpponentState{
+			UserID:  p.ID,
+			Score:   p.Score,
+			Play:    visiblePlay(g, p),
+			Offline: p.Offline,
+		})
+	}
+
+	// Two player clients only know about a single opponent
+	if len(state.Opponents) == 1 {
+		state.TheirScore = state.Opponents[0].Score
+		state.TheirPlay = state.Opponents[0].Play
+	}
+	return state
+}
+
+// spectatorState builds the view of the game for spectators, who see every player as an opponent
+func spectatorState(g *game.Game) GameState {
+	state := stateFor(g, &game.Player{})
+	state.Spectating = true
+	state.MatchWinner = false
+	return state
+}
+
+// addRoundResult adds the outcome of the round which just resolved to a view of the game
+func addRoundResult(g *game.Game, state *GameState) {
+	state.RoundSummary = g.RoundSummary
+	if g.Winner == "Tie" {
+		state.RoundSummary = "Tie Game"
+	}
+	if g.LastResult != nil && len(g.LastResult.Forfeits) > 0 {
+		state.Forfeits = g.LastResult.Forfeits
+	}
+}
+
+// NotifyPlayers sends out a notification about a game round to all connected parties
+func (s *LambdaSvc) NotifyPlayers(g *game.Game) error {
+	for _, p := range g.SortedPlayers() {
+		state := stateFor(g, p)
+		state.Winner = p.WonLastRound
+		addRoundResult(g, &state)
+		s.SendPlayerState(g, p, protocol.TYPE_ROUND_RESULT, &state)
+
+		// older clients see the matchOver flag in the state instead
+		if g.MatchOver && p.Protocol > 0 {
+			s.send(p.Address, p.Protocol, protocol.TYPE_MATCH_OVER, matchOver(g))
+		}
+	}
+	s.NotifySpectators(g)
 	return nil
 }
 
+// NotifySpectators sends the result of a round to everyone spectating the game.
+// Spectators whose connection is gone are forgotten.
+func (s *LambdaSvc) NotifySpectators(g *game.Game) {
+	state := spectatorState(g)
+	addRoundResult(g, &state)
+	for address, sp := range g.Spectators {
+		err := s.send(address, sp.Protocol, protocol.TYPE_ROUND_RESULT, state)
+		if err == nil && g.MatchOver && sp.Protocol > 0 {
+			err = s.send(address, sp.Protocol, protocol.TYPE_MATCH_OVER, matchOver(g))
+		}
+		if errors.Is(err, notify.ErrConnectionGone) {
+			if err := s.store.RemoveSpectator(g.ID, address); err != nil {
+				fmt.Printf("Unable to remove spectator %s: %s\n", address, err)
+			}
+			delete(g.Spectators, address)
+		}
+	}
+}
+
+// matchOver builds the announcement of a finished match
+func matchOver(g *game.Game) MatchOverMessage {
+	mo := MatchOverMessage{
+		GameID: g.ID,
+		Winner: g.MatchWinner,
+		Scores: make(map[string]int, len(g.Players)),
+	}
+	for _, p := range g.Players {
+		mo.Scores[p.ID] = p.Score
+	}
+	return mo
+}
+
+// send encodes a message for a connection in the protocol version it speaks, and sends it
+func (s *LambdaSvc) send(address string, version int, msgType string, payload interface{}) error {
+	// bots and players whose connection is gone have nowhere to send to
+	if address == "" {
+		return nil
+	}
+	b, err := protocol.Encode(version, msgType, payload)
+	if err != nil {
+		return err
+	}
+	err = s.ws.Send(address, b)
+	if err != nil {
+		fmt.Printf("Error sending %s to player %s\n", msgType, err)
+		return err
+	}
+	return nil
+}
+
+// SendPlayerState sends a state or roundResult message to a player. If their connection is gone,
+// the message is kept for them to receive when they rejoin, and nothing more is sent to that connection.
+func (s *LambdaSvc) SendPlayerState(g *game.Game, p *game.Player, msgType string, gs *GameState) error {
+	if bot.IsBot(p.ID) {
+		return nil
+	}
+	err := s.send(p.Address, p.Protocol, msgType, gs)
+	if p.Address != "" && !errors.Is(err, notify.ErrConnectionGone) {
+		return err
+	}
+
+	b, err := protocol.Encode(p.Protocol, msgType, gs)
+	if err != nil {
+		return err
+	}
+	err = s.store.StorePending(g.ID, p.ID, p.Address, string(b))
+	if err != nil {
+		fmt.Printf("Unable to keep state for %s: %s\n", p.ID, err)
+		return err
+	}
+	p.Address = ""
+	p.Pending = string(b)
+	p.Offline = true
+	return nil
+}
+
+// SendGameState will send a game state to the acting player
+func (s *LambdaSvc) SendGameState(gc *game.GameContext) error {
+	state := stateFor(gc.Game, gc.ActingPlayer)
+	return s.SendPlayerState(gc.Game, gc.ActingPlayer, protocol.TYPE_STATE, &state)
+}
+
+// SendPresence tells everyone else in the game that a player disconnected or reconnected
+func (s *LambdaSvc) SendPresence(g *game.Game, userID, status string) error {
+	pm := PresenceMessage{
+		GameID: g.ID,
+		UserID: userID,
+		Status: status,
+	}
+	for _, p := range g.SortedPlayers() {
+		if p.ID == userID || p.Offline {
+			continue
+		}
+		s.send(p.Address, p.Protocol, protocol.TYPE_PRESENCE, pm)
+	}
+	return nil
+}
+
+// History sends every resolved round of a game to the requesting connection
+func (s *LambdaSvc) History(connectionID string, message PlayerMessage) error {
+	rounds, err := s.store.History(message.GameID)
+	if err != nil {
+		return err
+	}
+
+	hm := HistoryMessage{
+		GameID: message.GameID,
+		Rounds: make([]RoundRecord, 0, len(rounds)),
+	}
+	for _, r := range rounds {
+		hm.Rounds = append(hm.Rounds, RoundRecord{
+			Round:   r.Round,
+			Plays:   r.Plays,
+			Winners: r.Winners,
+			Summary: r.Summary,
+		})
+	}
+
+	return s.send(connectionID, message.V, protocol.TYPE_HISTORY, hm)
+}
+
+// Stats sends a player's lifetime statistics to the requesting connection
+func (s *LambdaSvc) Stats(connectionID string, message PlayerMessage) error {
+	st, err := s.store.Stats(message.UID)
+	if err != nil {
+		return err
+	}
+
+	sm := StatsMessage{
+		UserID:      message.UID,
+		Games:       st.Games,
+		MatchesWon:  st.MatchesWon,
+		MatchesLost: st.MatchesLost,
+		MatchesTied: st.MatchesTied,
+		RoundsWon:   st.RoundsWon,
+		RoundsLost:  st.RoundsLost,
+		RoundsTied:  st.RoundsTied,
+		Moves:       st.Moves,
+	}
+	if sm.Moves == nil {
+		sm.Moves = map[string]int{}
+	}
+	return s.send(connectionID, message.V, protocol.TYPE_STATS, sm)
+}
+
+// Spectate lets a connection follow a game without playing in it. Spectators get the state now,
+// then the result of each round once it resolves, so they never see a play before it counts.
+func (s *LambdaSvc) Spectate(connectionID string, message PlayerMessage) error {
+	g, err := s.store.Load(message.GameID)
+	if err != nil {
+		return err
+	}
+	err = s.store.StoreSpectator(g.ID, connectionID, message.V)
+	if err != nil {
+		return err
+	}
+	// the connection index lets a dropped spectator be cleaned up, without losing track of
+	// a game the connection plays in
+	err = s.store.StoreSpectating(connectionID, g.ID)
+	if err != nil {
+		fmt.Printf("unable to store connection: %s\n", err)
+	}
+	return s.send(connectionID, message.V, protocol.TYPE_STATE, spectatorState(g))
+}
+
+// Leaderboard sends the best rated players, and the requesting player's rank
+func (s *LambdaSvc) Leaderboard(connectionID string, message PlayerMessage) error {
+	n := message.Limit
+	switch {
+	case n < 0 || n > MAX_LEADERBOARD_SIZE:
+		return fmt.Errorf("%w: leaderboards have up to %d players", ErrBadRequest, MAX_LEADERBOARD_SIZE)
+	case n == 0:
+		n = LEADERBOARD_SIZE
+	}
+
+	board, err := s.store.Leaderboard(n)
+	if err != nil {
+		return err
+	}
+	lm := LeaderboardMessage{UserID: message.UID, Players: make([]LeaderboardEntry, 0, len(board))}
+	for _, r := range board {
+		lm.Players = append(lm.Players, LeaderboardEntry{
+			Rank:      r.Rank,
+			UserID:    r.UserID,
+			Rating:    r.Rating.Rating,
+			Deviation: r.Rating.Deviation,
+		})
+	}
+
+	if message.UID != "" {
+		lm.Rank, err = s.store.Rank(message.UID)
+		if err != nil {
+			return err
+		}
+		r, err := s.store.Rating(message.UID)
+		if err != nil {
+			return err
+		}
+		lm.Rating, lm.Deviation = r.Rating, r.Deviation
+	}
+	return s.send(connectionID, message.V, protocol.TYPE_LEADERBOARD, lm)
+}
+
 // JoinGame joins a game in progress
 func (s *LambdaSvc) JoinGame(connectionID string, message PlayerMessage) error {
+	return s.joinGame(connectionID, message, false)
+}
 
-	g, err := s.store.Load(message.GameID)
+// joinGame seats or rejoins a player, reading the game consistently if asked to
+func (s *LambdaSvc) joinGame(connectionID string, message PlayerMessage, consistent bool) error {
+	load := s.store.Load
+	if consistent {
+		load = s.store.LoadConsistent
+	}
+	g, err := load(message.GameID)
+	if err != nil {
+		fmt.Printf("Unable to load game: %s\n", err)
+		return err
+	}
+	wasOffline := false
+	p, seated := g.Players[message.UID]
+	if seated {
+		wasOffline = p.Offline
+	}
 	gc, err := game.NewGameContext(message.UID, connectionID, g)
+	if err != nil {
+		return err
+	}
+	// anything which couldn't be delivered while they were gone is sent instead of the plain state
+	pending := gc.ActingPlayer.Pending
+	gc.ActingPlayer.Pending = ""
+	gc.ActingPlayer.Protocol = message.V
 
-	err = s.store.StorePlayer(gc)
+	if seated {
+		err = s.store.StorePlayer(gc)
+		if err != nil {
+			fmt.Printf("unable to store player: %s\n", err)
+		}
+	} else {
+		// the game may have filled up since it was loaded, in which case the seat isn't ours
+		err = s.store.ClaimSeat(gc)
+		if errors.Is(err, store.ErrAlreadySeated) && !consistent {
+			// another join by the same player got there first, so this one rejoins their seat,
+			// once, with a read that's sure to see it
+			return s.joinGame(connectionID, message, true)
+		}
+		if err != nil {
+			fmt.Printf("unable to claim seat: %s\n", err)
+			return err
+		}
+	}
+	err = s.store.StoreConnection(connectionID, g.ID, message.UID)
 	if err != nil {
-		fmt.Printf("unable to store player: %s\n", err)
+		fmt.Printf("unable to store connection: %s\n", err)
+	}
+	if wasOffline {
+		s.SendPresence(g, message.UID, PRESENCE_RECONNECTED)
 	}
 
-	err = s.SendGameState(gc)
+	if pending != "" {
+		err = s.ws.Send(connectionID, []byte(pending))
+	} else {
+		err = s.SendGameState(gc)
+	}
 	if err != nil {
 		fmt.Printf("Got an error sending the game state to the new player: %s\n", err)
 		return err
 	}
-	return nil
+	// catch up on what was said while they were away
+	return s.SendRecentChat(g.ID, connectionID, message.V)
 }
 
 // NewGame creates a new game record in the database
 func (s *LambdaSvc) NewGame(connectionID string, message PlayerMessage) error {
 	g := game.NewGame()
+	if message.Ruleset != "" {
+		if _, err := game.LookupRuleset(message.Ruleset); err != nil {
+			return err
+		}
+		g.Ruleset = message.Ruleset
+	}
+	g.Format = game.MatchFormat{Mode: message.MatchFormat, Length: message.MatchLength}
+	if err := g.Format.Validate(); err != nil {
+		return err
+	}
+	g.MaxPlayers = message.MaxPlayers
+	g.Scoring = message.Scoring
+	g.FairPlay = message.FairPlay
+	if err := g.ValidateRoom(); err != nil {
+		return err
+	}
+	g.RoundTimeout = message.RoundTimeout
+	g.MaxMisses = message.MaxMisses
+	if err := g.ValidateClock(); err != nil {
+		return err
+	}
 	gc, err := game.NewGameContext(message.UID, connectionID, g)
+	if err != nil {
+		return err
+	}
+	gc.ActingPlayer.Protocol = message.V
+
+	if message.Opponent != "" {
+		if !bot.IsBot(message.Opponent) {
+			return fmt.Errorf("%w: unknown opponent %s", game.ErrInvalidOptions, message.Opponent)
+		}
+		if _, err := bot.New(message.Opponent); err != nil {
+			return err
+		}
+		if g.FairPlay || g.Seats() != game.NUM_PLAYERS {
+			return fmt.Errorf("%w: bots only play two player games without commit and reveal", game.ErrInvalidOptions)
+		}
+		if _, err := game.NewGameContext(message.Opponent, "", g); err != nil {
+			return err
+		}
+	}
 
 	err = s.store.StoreAll(g)
 	if err != nil {
 		fmt.Printf("unable to store game: %s %+v", err, g)
 		return err
 	}
+	err = s.store.StoreConnection(connectionID, g.ID, message.UID)
+	if err != nil {
+		fmt.Printf("unable to store connection: %s\n", err)
+	}
 
 	err = s.SendGameState(gc)
 	if err != nil {
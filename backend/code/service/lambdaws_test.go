@@ -0,0 +1,1085 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// testSvc builds a service backed by the in-memory store and a recording notifier
+func testSvc() (*LambdaSvc, *store.Memory, *notify.Recorder) {
+	st := store.NewMemory()
+	rec := &notify.Recorder{}
+	return NewLambdaSvc(st, rec), st, rec
+}
+
+// send delivers a player message to the $default route and returns the status code
+func send(t *testing.T, s *LambdaSvc, connectionID string, message PlayerMessage) int {
+	t.Helper()
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("unable to marshal message: %s", err)
+	}
+	resp, err := s.Default(events.APIGatewayWebsocketProxyRequest{
+		Body: string(body),
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "$default",
+		},
+	})
+	if err != nil {
+		t.Fatalf("default route returned an error: %s", err)
+	}
+	return resp.(events.APIGatewayProxyResponse).StatusCode
+}
+
+// lastState decodes the most recent GameState sent to a connection
+func lastState(t *testing.T, rec *notify.Recorder, connectionID string) GameState {
+	t.Helper()
+	msgs := rec.To(connectionID)
+	if len(msgs) == 0 {
+		t.Fatalf("no messages sent to %s", connectionID)
+	}
+	gs := GameState{}
+	if err := json.Unmarshal([]byte(msgs[len(msgs)-1]), &gs); err != nil {
+		t.Fatalf("unable to decode game state: %s", err)
+	}
+	return gs
+}
+
+// startGame creates a game for p1 and joins p2 to it, returning the game ID
+func startGame(t *testing.T, s *LambdaSvc, rec *notify.Recorder) string {
+	t.Helper()
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"}); code != 200 {
+		t.Fatalf("new game failed: %d", code)
+	}
+	gameID := lastState(t, rec, "conn1").GameID
+	if code := send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID}); code != 200 {
+		t.Fatalf("join game failed: %d", code)
+	}
+	rec.Reset()
+	return gameID
+}
+
+func TestNewGame(t *testing.T) {
+	s, st, rec := testSvc()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"}); code != 200 {
+		t.Fatalf("new game failed: %d", code)
+	}
+
+	msgs := rec.To("conn1")
+	if len(msgs) != 1 {
+		t.Fatalf("expected exactly one message to the new player: %+v", msgs)
+	}
+	gameID := lastState(t, rec, "conn1").GameID
+	expected := fmt.Sprintf(`{"round":1,"gameId":"%s","yourScore":0,"theirScore":0,"winner":false,"ruleset":"rpsls"}`, gameID)
+	if msgs[0] != expected {
+		t.Errorf("unexpected new game state:\n got: %s\nwant: %s", msgs[0], expected)
+	}
+
+	g, err := st.Load(gameID)
+	if err != nil {
+		t.Fatalf("new game was not stored: %s", err)
+	}
+	if g.Players["p1"] == nil || g.Players["p1"].Address != "conn1" {
+		t.Errorf("creating player was not stored with the game: %+v", g.Players)
+	}
+}
+
+func TestJoinGame(t *testing.T) {
+	s, st, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"})
+	gameID := lastState(t, rec, "conn1").GameID
+
+	if code := send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID}); code != 200 {
+		t.Fatalf("join game failed: %d", code)
+	}
+	expected := fmt.Sprintf(`{"round":1,"gameId":"%s","yourScore":0,"theirScore":0,"winner":false,"ruleset":"rpsls","opponents":[{"userId":"p1","score":0}]}`, gameID)
+	if msgs := rec.To("conn2"); len(msgs) != 1 || msgs[0] != expected {
+		t.Errorf("unexpected join state:\n got: %v\nwant: %s", msgs, expected)
+	}
+
+	g, _ := st.Load(gameID)
+	if len(g.Players) != 2 {
+		t.Errorf("both players should be stored: %+v", g.Players)
+	}
+
+	if code := send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p3", GameID: gameID}); code != 400 {
+		t.Errorf("third player should not be able to join: %d", code)
+	}
+
+	if code := send(t, s, "conn4", PlayerMessage{Action: "join", UID: "p4", GameID: "MISSING"}); code != 400 {
+		t.Errorf("joining a missing game should fail: %d", code)
+	}
+}
+
+func TestConcurrentJoins(t *testing.T) {
+	s, st, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"})
+	gameID := lastState(t, rec, "conn1").GameID
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.JoinGame(fmt.Sprintf("join%d", i), PlayerMessage{Action: "join", UID: fmt.Sprintf("joiner%d", i), GameID: gameID})
+		}(i)
+	}
+	wg.Wait()
+
+	seated := 0
+	for _, err := range errs {
+		if err == nil {
+			seated++
+		} else if !errors.Is(err, game.ErrGameFull) {
+			t.Errorf("losing joiners should find the game full: %v", err)
+		}
+	}
+	if g, _ := st.Load(gameID); seated != 1 || len(g.Players) != 2 {
+		t.Errorf("exactly one joiner should get the seat, got %d: %+v", seated, g.Players)
+	}
+}
+
+// joinedMeanwhile is a store where, the first time a seat is claimed, the same player joins
+// from another connection just before
+type joinedMeanwhile struct {
+	*store.Memory
+	connectionID string
+}
+
+func (jm *joinedMeanwhile) ClaimSeat(gc *game.GameContext) error {
+	if jm.connectionID != "" {
+		g, _ := jm.Load(gc.Game.ID)
+		other, _ := game.NewGameContext(gc.ActingPlayer.ID, jm.connectionID, g)
+		jm.connectionID = ""
+		if err := jm.Memory.ClaimSeat(other); err != nil {
+			return err
+		}
+	}
+	return jm.Memory.ClaimSeat(gc)
+}
+
+func TestJoinTwiceAtOnce(t *testing.T) {
+	st := &joinedMeanwhile{Memory: store.NewMemory(), connectionID: "conn2"}
+	rec := &notify.Recorder{}
+	s := NewLambdaSvc(st, rec)
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"})
+	gameID := lastState(t, rec, "conn1").GameID
+
+	if code := send(t, s, "conn2b", PlayerMessage{Action: "join", UID: "p2", GameID: gameID}); code != 200 {
+		t.Fatalf("losing the race to your own join should still join: %d", code)
+	}
+	g, _ := st.Load(gameID)
+	if len(g.Players) != 2 || g.Players["p2"].Address != "conn2b" {
+		t.Errorf("p2 should keep one seat, on the latest connection: %+v", g.Players["p2"])
+	}
+	if lastState(t, rec, "conn2b").GameID != gameID {
+		t.Errorf("p2 should get the game state")
+	}
+}
+
+// alwaysSeated is a store which never sees the seat it says the player already has
+type alwaysSeated struct {
+	*store.Memory
+	claims, consistentLoads int
+}
+
+func (as *alwaysSeated) ClaimSeat(gc *game.GameContext) error {
+	as.claims++
+	if as.claims > 10 {
+		return errors.New("still claiming")
+	}
+	return fmt.Errorf("%w: %s", store.ErrAlreadySeated, gc.ActingPlayer.ID)
+}
+
+func (as *alwaysSeated) LoadConsistent(gameID string) (*game.Game, error) {
+	as.consistentLoads++
+	return as.Memory.LoadConsistent(gameID)
+}
+
+func TestJoinRetriesOnce(t *testing.T) {
+	st := &alwaysSeated{Memory: store.NewMemory()}
+	rec := &notify.Recorder{}
+	s := NewLambdaSvc(st, rec)
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"})
+	gameID := lastState(t, rec, "conn1").GameID
+
+	if code := send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID}); code == 200 {
+		t.Errorf("a seat which can't be claimed or found should fail the join")
+	}
+	if st.claims != 2 || st.consistentLoads != 1 {
+		t.Errorf("expected one retry with a consistent load, got %d claims and %d consistent loads",
+			st.claims, st.consistentLoads)
+	}
+}
+
+func TestRejoinUpdatesAddress(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	send(t, s, "conn2b", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+
+	g, _ := st.Load(gameID)
+	if g.Players["p2"].Address != "conn2b" {
+		t.Errorf("rejoining should update the player's address: %+v", g.Players["p2"])
+	}
+	if len(rec.To("conn2b")) != 1 {
+		t.Errorf("rejoining player should get the game state")
+	}
+}
+
+func TestPlayRound(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "Rock", Round: 1}); code != 200 {
+		t.Fatalf("first play failed: %d", code)
+	}
+	if len(rec.Messages) != 0 {
+		t.Errorf("nobody should be notified until the round completes: %+v", rec.Messages)
+	}
+
+	if code := send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "scissors", Round: 1}); code != 200 {
+		t.Fatalf("second play failed: %d", code)
+	}
+
+	p1 := fmt.Sprintf(`{"round":2,"gameId":"%s","yourScore":1,"theirScore":0,"winner":true,"yourPlay":"rock","theirPlay":"scissors","roundSummary":"Rock smashes Scissors","ruleset":"rpsls","opponents":[{"userId":"p2","score":0,"play":"scissors"}]}`, gameID)
+	p2 := fmt.Sprintf(`{"round":2,"gameId":"%s","yourScore":0,"theirScore":1,"winner":false,"yourPlay":"scissors","theirPlay":"rock","roundSummary":"Rock smashes Scissors","ruleset":"rpsls","opponents":[{"userId":"p1","score":1,"play":"rock"}]}`, gameID)
+	if msgs := rec.To("conn1"); len(msgs) != 1 || msgs[0] != p1 {
+		t.Errorf("unexpected state for p1:\n got: %v\nwant: %s", msgs, p1)
+	}
+	if msgs := rec.To("conn2"); len(msgs) != 1 || msgs[0] != p2 {
+		t.Errorf("unexpected state for p2:\n got: %v\nwant: %s", msgs, p2)
+	}
+
+	g, _ := st.Load(gameID)
+	if g.Round != 2 || g.PlayCount != 0 {
+		t.Errorf("stored game should be on a fresh round: %+v", g)
+	}
+}
+
+func TestPlayTie(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "spock", Round: 1})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "spock", Round: 1})
+
+	expected := `{"round":2,"gameId":"%s","yourScore":0,"theirScore":0,"winner":false,"yourPlay":"spock","theirPlay":"spock","roundSummary":"Tie Game","ruleset":"rpsls","opponents":[{"userId":"%s","score":0,"play":"spock"}]}`
+	for conn, them := range map[string]string{"conn1": "p2", "conn2": "p1"} {
+		expected := fmt.Sprintf(expected, gameID, them)
+		if msgs := rec.To(conn); len(msgs) != 1 || msgs[0] != expected {
+			t.Errorf("unexpected tie state for %s:\n got: %v\nwant: %s", conn, msgs, expected)
+		}
+	}
+}
+
+func TestPlayRejected(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "dynamite", Round: 1}); code != 400 {
+		t.Errorf("invalid play should be rejected: %d", code)
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+	if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "paper", Round: 1}); code != 400 {
+		t.Errorf("second play in the same round should be rejected: %d", code)
+	}
+	g, _ := st.Load(gameID)
+	if g.Players["p1"].Play != "rock" || g.PlayCount != 1 {
+		t.Errorf("rejected play should not be stored: %+v %+v", g, g.Players["p1"])
+	}
+
+	if code := send(t, s, "conn3", PlayerMessage{Action: "play", UID: "p3", GameID: gameID, Play: "rock", Round: 1}); code != 400 {
+		t.Errorf("play from someone outside the game should be rejected: %d", code)
+	}
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "dance", UID: "p1"}); code != 400 {
+		t.Errorf("unknown action should be rejected: %d", code)
+	}
+}
+
+func TestMultipleRounds(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	rounds := [][2]string{{"rock", "scissors"}, {"paper", "scissors"}, {"lizard", "spock"}}
+	for i, plays := range rounds {
+		send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: plays[0], Round: i + 1})
+		send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: plays[1], Round: i + 1})
+	}
+
+	gs := lastState(t, rec, "conn1")
+	if gs.Round != 4 || gs.YourScore != 2 || gs.TheirScore != 1 {
+		t.Errorf("unexpected state after three rounds: %+v", gs)
+	}
+	if gs.RoundSummary != "Lizard poisons Spock" || !gs.Winner {
+		t.Errorf("unexpected final round result: %+v", gs)
+	}
+}
+
+func TestRuleset(t *testing.T) {
+	s, st, rec := testSvc()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", Ruleset: "calvinball"}); code != 400 {
+		t.Errorf("unknown ruleset should be rejected: %d", code)
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", Ruleset: "rps"})
+	gs := lastState(t, rec, "conn1")
+	if gs.Ruleset != "rps" {
+		t.Errorf("new game should report its ruleset: %+v", gs)
+	}
+	g, _ := st.Load(gs.GameID)
+	if g.Ruleset != "rps" {
+		t.Errorf("ruleset should be stored with the game: %+v", g)
+	}
+
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gs.GameID})
+	if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gs.GameID, Play: "spock", Round: 1}); code != 400 {
+		t.Errorf("spock is not a valid play in classic rps: %d", code)
+	}
+}
+
+func TestBestOfThree(t *testing.T) {
+	s, st, rec := testSvc()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 4}); code != 400 {
+		t.Errorf("best of an even number should be rejected: %d", code)
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 3})
+	gameID := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+
+	for round := 1; round <= 2; round++ {
+		send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "paper", Round: round})
+		send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "spock", Round: round})
+	}
+
+	p1 := fmt.Sprintf(`{"round":3,"gameId":"%s","yourScore":2,"theirScore":0,"winner":true,"yourPlay":"paper","theirPlay":"spock","roundSummary":"Paper disproves Spock","ruleset":"rpsls","matchFormat":"bestof","matchLength":3,"matchOver":true,"matchWinner":true,"opponents":[{"userId":"p2","score":0,"play":"spock"}]}`, gameID)
+	p2 := fmt.Sprintf(`{"round":3,"gameId":"%s","yourScore":0,"theirScore":2,"winner":false,"yourPlay":"spock","theirPlay":"paper","roundSummary":"Paper disproves Spock","ruleset":"rpsls","matchFormat":"bestof","matchLength":3,"matchOver":true,"opponents":[{"userId":"p1","score":2,"play":"paper"}]}`, gameID)
+	if msgs := rec.To("conn1"); msgs[len(msgs)-1] != p1 {
+		t.Errorf("unexpected final state for p1:\n got: %s\nwant: %s", msgs[len(msgs)-1], p1)
+	}
+	if msgs := rec.To("conn2"); msgs[len(msgs)-1] != p2 {
+		t.Errorf("unexpected final state for p2:\n got: %s\nwant: %s", msgs[len(msgs)-1], p2)
+	}
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 3}); code != 400 {
+		t.Errorf("plays after the match is over should be rejected: %d", code)
+	}
+	g, _ := st.Load(gameID)
+	if !g.MatchOver || g.MatchWinner != "p1" || g.Format.Length != 3 {
+		t.Errorf("match result should be stored: %+v", g)
+	}
+}
+
+func TestFourPlayerRoom(t *testing.T) {
+	s, st, rec := testSvc()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MaxPlayers: 9}); code != 400 {
+		t.Errorf("rooms bigger than the maximum should be rejected: %d", code)
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MaxPlayers: 4})
+	gameID := lastState(t, rec, "conn1").GameID
+	for _, p := range []string{"2", "3", "4"} {
+		if code := send(t, s, "conn"+p, PlayerMessage{Action: "join", UID: "p" + p, GameID: gameID}); code != 200 {
+			t.Fatalf("player %s should be able to join: %d", p, code)
+		}
+	}
+	if code := send(t, s, "conn5", PlayerMessage{Action: "join", UID: "p5", GameID: gameID}); code != 400 {
+		t.Errorf("fifth player should not fit: %d", code)
+	}
+	rec.Reset()
+
+	plays := map[string]string{"1": "rock", "2": "scissors", "3": "lizard", "4": "paper"}
+	for p, play := range plays {
+		send(t, s, "conn"+p, PlayerMessage{Action: "play", UID: "p" + p, GameID: gameID, Play: play, Round: 1})
+	}
+
+	// rock beats scissors and lizard, scissors beats paper and lizard, lizard beats paper, paper beats rock
+	expected := map[string]int{"p1": 2, "p2": 2, "p3": 1, "p4": 1}
+	g, _ := st.Load(gameID)
+	for id, score := range expected {
+		if g.Players[id].Score != score {
+			t.Errorf("%s should have %d points: %+v", id, score, g.Players[id])
+		}
+	}
+
+	gs := lastState(t, rec, "conn1")
+	if len(gs.Opponents) != 3 || gs.TheirPlay != "" || gs.MaxPlayers != 4 {
+		t.Fatalf("multi player state should list every opponent instead of a single one: %+v", gs)
+	}
+	if gs.Opponents[0].UserID != "p2" || gs.Opponents[0].Play != "scissors" || gs.Opponents[0].Score != 2 {
+		t.Errorf("unexpected opponent state: %+v", gs.Opponents[0])
+	}
+	if !gs.Winner || gs.YourScore != 2 {
+		t.Errorf("p1 scored this round: %+v", gs)
+	}
+}
+
+func TestJoinHidesUnresolvedPlays(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+	send(t, s, "conn2b", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+
+	gs := lastState(t, rec, "conn2b")
+	if gs.TheirPlay != "" || gs.Opponents[0].Play != "" {
+		t.Errorf("rejoining should not reveal a play from the current round: %+v", gs)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	rounds := [][2]string{{"rock", "scissors"}, {"spock", "spock"}}
+	for i, plays := range rounds {
+		send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: plays[0], Round: i + 1})
+		send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: plays[1], Round: i + 1})
+	}
+	rec.Reset()
+
+	if code := send(t, s, "conn2", PlayerMessage{Action: "history", UID: "p2", GameID: gameID}); code != 200 {
+		t.Fatalf("history failed: %d", code)
+	}
+	expected := fmt.Sprintf(`{"type":"history","gameId":"%s","rounds":[`+
+		`{"round":1,"plays":{"p1":"rock","p2":"scissors"},"winners":["p1"],"summary":"Rock smashes Scissors"},`+
+		`{"round":2,"plays":{"p1":"spock","p2":"spock"},"summary":"Both played Spock, tie"}]}`, gameID)
+	if msgs := rec.To("conn2"); len(msgs) != 1 || msgs[0] != expected {
+		t.Errorf("unexpected history:\n got: %v\nwant: %s", msgs, expected)
+	}
+}
+
+func TestFairPlay(t *testing.T) {
+	s, st, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", FairPlay: true})
+	gs := lastState(t, rec, "conn1")
+	if !gs.FairPlay || gs.Phase != "commit" {
+		t.Errorf("fair play games should start in the commit phase: %+v", gs)
+	}
+	gameID := gs.GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	rec.Reset()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1}); code != 400 {
+		t.Errorf("plain plays should be rejected in fair play games: %d", code)
+	}
+	rec.Reset()
+
+	send(t, s, "conn1", PlayerMessage{Action: "commit", UID: "p1", GameID: gameID, Commitment: game.Commitment("rock", "salt1")})
+	if len(rec.Messages) != 0 {
+		t.Errorf("nobody should hear anything until everyone commits: %+v", rec.Messages)
+	}
+	g, _ := st.Load(gameID)
+	if g.Players["p1"].Play != "" {
+		t.Errorf("the server should not know the committed play: %+v", g.Players["p1"])
+	}
+
+	send(t, s, "conn2", PlayerMessage{Action: "commit", UID: "p2", GameID: gameID, Commitment: game.Commitment("lizard", "salt2")})
+	for _, conn := range []string{"conn1", "conn2"} {
+		if gs := lastState(t, rec, conn); gs.Phase != "reveal" || gs.TheirPlay != "" {
+			t.Errorf("%s should be asked to reveal, without seeing any plays: %+v", conn, gs)
+		}
+	}
+	rec.Reset()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "reveal", UID: "p1", GameID: gameID, Play: "rock", Nonce: "salt1"}); code != 200 {
+		t.Fatalf("reveal failed: %d", code)
+	}
+	send(t, s, "conn2", PlayerMessage{Action: "reveal", UID: "p2", GameID: gameID, Play: "lizard", Nonce: "salt2"})
+
+	gs = lastState(t, rec, "conn1")
+	if !gs.Winner || gs.RoundSummary != "Rock crushes Lizard" || gs.Phase != "commit" || gs.Round != 2 {
+		t.Errorf("unexpected result after reveals: %+v", gs)
+	}
+}
+
+func TestFairPlayBadReveal(t *testing.T) {
+	s, _, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", FairPlay: true})
+	gameID := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+
+	send(t, s, "conn1", PlayerMessage{Action: "commit", UID: "p1", GameID: gameID, Commitment: game.Commitment("rock", "salt1")})
+	send(t, s, "conn2", PlayerMessage{Action: "commit", UID: "p2", GameID: gameID, Commitment: game.Commitment("lizard", "salt2")})
+	rec.Reset()
+
+	// p2 tries to change their move
+	send(t, s, "conn2", PlayerMessage{Action: "reveal", UID: "p2", GameID: gameID, Play: "paper", Nonce: "salt2"})
+	send(t, s, "conn1", PlayerMessage{Action: "reveal", UID: "p1", GameID: gameID, Play: "rock", Nonce: "salt1"})
+
+	gs := lastState(t, rec, "conn2")
+	if gs.Winner || gs.TheirScore != 1 || gs.RoundSummary != "p2 forfeits" {
+		t.Errorf("a bad reveal should forfeit the round: %+v", gs)
+	}
+}
+
+func TestBotOpponent(t *testing.T) {
+	s, st, rec := testSvc()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", Opponent: "bot:psychic"}); code != 400 {
+		t.Errorf("unknown strategies should be rejected: %d", code)
+	}
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "bot:random"}); code != 400 {
+		t.Errorf("humans should not be able to use bot ids: %d", code)
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", Opponent: "bot:frequency"})
+	gameID := lastState(t, rec, "conn1").GameID
+
+	for round := 1; round <= 5; round++ {
+		rec.Reset()
+		if code := send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: round}); code != 200 {
+			t.Fatalf("round %d: play failed: %d", round, code)
+		}
+		gs := lastState(t, rec, "conn1")
+		if gs.Round != round+1 || gs.TheirPlay == "" {
+			t.Fatalf("round %d: bot should play straight away: %+v", round, gs)
+		}
+	}
+
+	// after seeing rock every round, the frequency bot always counters it
+	gs := lastState(t, rec, "conn1")
+	if beats, _ := game.Beats(gs.TheirPlay, "rock"); !beats {
+		t.Errorf("frequency bot should counter rock, played %s", gs.TheirPlay)
+	}
+	history, _ := st.History(gameID)
+	if len(history) != 5 {
+		t.Errorf("bot rounds should be in the history: %+v", history)
+	}
+	if stats, _ := st.Stats("p1"); stats.RoundsWon+stats.RoundsLost+stats.RoundsTied != 5 {
+		t.Errorf("the player's rounds against the bot should count: %+v", stats)
+	}
+	if stats, _ := st.Stats("bot:frequency"); stats.Games != 0 || len(stats.Moves) != 0 {
+		t.Errorf("bots should not have stats: %+v", stats)
+	}
+	for _, m := range rec.Messages {
+		if m.Destination == "" {
+			t.Errorf("nothing should be sent to the bot: %+v", m)
+		}
+	}
+}
+
+func TestRoundTimeout(t *testing.T) {
+	s, _, rec := testSvc()
+
+	if code := send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MaxMisses: 2}); code != 400 {
+		t.Errorf("a miss limit without a timeout should be rejected: %d", code)
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", RoundTimeout: 30, MaxMisses: 2})
+	gameID := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+
+	for round := 1; round <= 2; round++ {
+		rec.Reset()
+		start := time.Now().Unix()
+		send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: round})
+		if err := s.ExpireRounds(start + 1); err != nil {
+			t.Fatalf("unable to expire rounds: %s", err)
+		}
+		if len(rec.Messages) != 0 {
+			t.Fatalf("round %d should not expire early: %+v", round, rec.Messages)
+		}
+
+		if err := s.ExpireRounds(start + 31); err != nil {
+			t.Fatalf("unable to expire rounds: %s", err)
+		}
+		for _, conn := range []string{"conn1", "conn2"} {
+			gs := lastState(t, rec, conn)
+			if gs.Round != round+1 || len(gs.Forfeits) != 1 || gs.Forfeits[0] != "p2" || gs.RoundSummary != "p2 forfeits" {
+				t.Errorf("round %d: %s should be told p2 forfeited: %+v", round, conn, gs)
+			}
+		}
+	}
+
+	gs := lastState(t, rec, "conn1")
+	if !gs.MatchOver || !gs.MatchWinner || gs.YourScore != 2 {
+		t.Errorf("p2 should forfeit the match after two misses: %+v", gs)
+	}
+}
+
+func TestConcurrentResolution(t *testing.T) {
+	s, st, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1"})
+	gameID := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+
+	// two invocations both see p2's play complete the round
+	g, _ := st.Load(gameID)
+	gc, _ := game.NewGameContext("p2", "conn2", g)
+	gc.Play("paper")
+	if err := st.StorePlay(gc); err != nil {
+		t.Fatalf("unable to store play: %s", err)
+	}
+	first, _ := st.Load(gameID)
+	second, _ := st.Load(gameID)
+
+	rec.Reset()
+	if err := s.resolveRound(first); err != nil {
+		t.Fatalf("unable to resolve round: %s", err)
+	}
+	if err := s.resolveRound(second); err != nil {
+		t.Errorf("losing the race to resolve a round isn't an error: %s", err)
+	}
+	if len(rec.To("conn1")) != 1 || len(rec.To("conn2")) != 1 {
+		t.Errorf("players should hear the result once: %v %v", rec.To("conn1"), rec.To("conn2"))
+	}
+	if second.Round != 2 || second.Players["p2"].Score != 1 {
+		t.Errorf("the loser should see the stored result: %+v", second)
+	}
+	if history, _ := st.History(gameID); len(history) != 1 {
+		t.Errorf("the round should be recorded once: %+v", history)
+	}
+}
+
+func TestRacingResolution(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+	g, _ := st.Load(gameID)
+	gc, _ := game.NewGameContext("p2", "conn2", g)
+	gc.Play("paper")
+	if err := st.StorePlay(gc); err != nil {
+		t.Fatalf("unable to store play: %s", err)
+	}
+
+	// both resolvers load the completed round, then resolve it at the same time
+	copies := make([]*game.Game, 2)
+	for i := range copies {
+		copies[i], _ = st.Load(gameID)
+	}
+	rec.Reset()
+	start := make(chan struct{})
+	errs := make([]error, len(copies))
+	var wg sync.WaitGroup
+	for i := range copies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = s.resolveRound(copies[i])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("neither resolver should fail: %s", err)
+		}
+	}
+	for _, conn := range []string{"conn1", "conn2"} {
+		results := 0
+		for _, body := range rec.To(conn) {
+			if strings.Contains(body, "roundSummary") {
+				results++
+			}
+		}
+		if results != 1 {
+			t.Errorf("%s should get exactly one round result: %v", conn, rec.To(conn))
+		}
+	}
+}
+
+// disconnect delivers a $disconnect event for a connection
+func disconnect(t *testing.T, s *LambdaSvc, connectionID string) {
+	t.Helper()
+	_, err := s.Disconnect(events.APIGatewayWebsocketProxyRequest{
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "$disconnect",
+		},
+	})
+	if err != nil {
+		t.Fatalf("disconnect route returned an error: %s", err)
+	}
+}
+
+func TestDisconnectPresence(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	// connections which never joined a game are ignored
+	disconnect(t, s, "stranger")
+
+	rec.Reset()
+	disconnect(t, s, "conn2")
+	g, _ := st.Load(gameID)
+	if !g.Players["p2"].Offline {
+		t.Errorf("p2 should be marked offline")
+	}
+	if msgs := rec.To("conn1"); len(msgs) != 1 || msgs[0] != `{"type":"presence","gameId":"`+gameID+`","userId":"p2","status":"disconnected"}` {
+		t.Errorf("p1 should be told p2 disconnected: %v", msgs)
+	}
+	if len(rec.To("conn2")) != 0 {
+		t.Errorf("nothing should be sent to the dropped connection")
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	g, _ = st.Load(gameID)
+	if g.Players["p2"].Offline || g.Players["p2"].Address != "conn3" {
+		t.Errorf("joining again should bring p2 back online: %+v", g.Players["p2"])
+	}
+	if msgs := rec.To("conn1"); len(msgs) != 1 || msgs[0] != `{"type":"presence","gameId":"`+gameID+`","userId":"p2","status":"reconnected"}` {
+		t.Errorf("p1 should be told p2 reconnected: %v", msgs)
+	}
+
+	// an old connection closing after the player moved on must not mark them offline again
+	send(t, s, "conn4", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	rec.Reset()
+	disconnect(t, s, "conn3")
+	g, _ = st.Load(gameID)
+	if g.Players["p2"].Offline || len(rec.Messages) != 0 {
+		t.Errorf("a stale disconnect should change nothing: %+v %+v", g.Players["p2"], rec.Messages)
+	}
+}
+
+func TestOfflineOpponentState(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+	disconnect(t, s, "conn2")
+
+	rec.Reset()
+	send(t, s, "conn1", PlayerMessage{Action: "join", UID: "p1", GameID: gameID})
+	gs := lastState(t, rec, "conn1")
+	if len(gs.Opponents) != 1 || !gs.Opponents[0].Offline {
+		t.Errorf("state should show the opponent is offline: %+v", gs)
+	}
+}
+
+func TestGoneConnection(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "rock", Round: 1})
+	rec.MarkGone("conn2")
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "scissors", Round: 1})
+
+	g, _ := st.Load(gameID)
+	p2 := g.Players["p2"]
+	if p2.Address != "" || !p2.Offline || p2.Pending == "" {
+		t.Fatalf("a gone connection should be cleared and the state kept: %+v", p2)
+	}
+	if gs := lastState(t, rec, "conn1"); gs.Round != 2 || gs.Winner {
+		t.Errorf("p1 should still get the result: %+v", gs)
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	gs := lastState(t, rec, "conn3")
+	if gs.Round != 2 || !gs.Winner || gs.RoundSummary != "Rock smashes Scissors" {
+		t.Errorf("rejoining should deliver the missed round result: %+v", gs)
+	}
+	g, _ = st.Load(gameID)
+	if g.Players["p2"].Pending != "" || g.Players["p2"].Address != "conn3" || g.Players["p2"].Offline {
+		t.Errorf("rejoining should clear the pending state: %+v", g.Players["p2"])
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	if gs := lastState(t, rec, "conn3"); gs.RoundSummary != "" {
+		t.Errorf("the missed state should only be delivered once: %+v", gs)
+	}
+}
+
+// lastError decodes the most recent message to a connection as an error
+func lastError(t *testing.T, rec *notify.Recorder, connectionID string) ErrorMessage {
+	t.Helper()
+	msgs := rec.To(connectionID)
+	if len(msgs) == 0 {
+		t.Fatalf("no messages sent to %s", connectionID)
+	}
+	env, err := protocol.Decode([]byte(msgs[len(msgs)-1]))
+	if err != nil || env.Type != protocol.TYPE_ERROR {
+		t.Fatalf("expected an error message, got %s", msgs[len(msgs)-1])
+	}
+	em := ErrorMessage{}
+	if err := json.Unmarshal(env.Data, &em); err != nil {
+		t.Fatalf("unable to decode error message: %s", err)
+	}
+	return em
+}
+
+func TestErrorMessages(t *testing.T) {
+	s, _, rec := testSvc()
+	gameID := startGame(t, s, rec)
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+
+	cases := []struct {
+		name    string
+		conn    string
+		message PlayerMessage
+		code    string
+	}{
+		{"unknown action", "conn1", PlayerMessage{Action: "dance", UID: "p1"}, protocol.CODE_BAD_REQUEST},
+		{"reserved user", "conn1", PlayerMessage{Action: "new", UID: "bot:random"}, protocol.CODE_BAD_REQUEST},
+		{"missing game", "conn3", PlayerMessage{Action: "join", UID: "p3", GameID: "MISSING"}, protocol.CODE_GAME_NOT_FOUND},
+		{"full game", "conn3", PlayerMessage{Action: "join", UID: "p3", GameID: gameID}, protocol.CODE_GAME_FULL},
+		{"invalid play", "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "dynamite", Round: 1}, protocol.CODE_INVALID_PLAY},
+		{"second play", "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "paper", Round: 1}, protocol.CODE_STALE_ROUND},
+		{"commit without fair play", "conn1", PlayerMessage{Action: "commit", UID: "p1", GameID: gameID, Commitment: game.Commitment("rock", "n")}, protocol.CODE_WRONG_MODE},
+		{"bad options", "conn1", PlayerMessage{Action: "new", UID: "p1", MaxPlayers: 9}, protocol.CODE_INVALID_OPTIONS},
+		{"unknown ruleset", "conn1", PlayerMessage{Action: "new", UID: "p1", Ruleset: "calvinball"}, protocol.CODE_UNKNOWN_RULESET},
+	}
+	for _, c := range cases {
+		rec.Reset()
+		c.message.RequestID = c.name
+		if code := send(t, s, c.conn, c.message); code != 400 {
+			t.Errorf("%s: expected a 400, got %d", c.name, code)
+		}
+		em := lastError(t, rec, c.conn)
+		if em.Code != c.code || em.RequestID != c.name || em.Message == "" {
+			t.Errorf("%s: expected %s, got %+v", c.name, c.code, em)
+		}
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p3", GameID: gameID, RequestID: "r1"})
+	expected := `{"type":"error","code":"GAME_FULL","message":"unable to assign player: game is already full","requestId":"r1"}`
+	if msgs := rec.To("conn3"); len(msgs) != 1 || msgs[0] != expected {
+		t.Errorf("unexpected error message: %v", msgs)
+	}
+}
+
+func TestUndecodableMessage(t *testing.T) {
+	s, _, rec := testSvc()
+	resp, _ := s.Default(events.APIGatewayWebsocketProxyRequest{
+		Body: "not json",
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: "conn1",
+			RouteKey:     "$default",
+		},
+	})
+	if resp.(events.APIGatewayProxyResponse).StatusCode != 400 {
+		t.Errorf("undecodable messages should be rejected: %+v", resp)
+	}
+	if em := lastError(t, rec, "conn1"); em.Code != protocol.CODE_BAD_REQUEST {
+		t.Errorf("undecodable messages should be a bad request: %+v", em)
+	}
+}
+
+// sendV1 delivers a player message in a version 1 envelope
+func sendV1(t *testing.T, s *LambdaSvc, connectionID string, message PlayerMessage) {
+	t.Helper()
+	body, err := protocol.EncodeRequest(1, message)
+	if err != nil {
+		t.Fatalf("unable to encode message: %s", err)
+	}
+	s.Default(events.APIGatewayWebsocketProxyRequest{
+		Body: string(body),
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "$default",
+		},
+	})
+}
+
+func TestProtocolVersions(t *testing.T) {
+	s, _, rec := testSvc()
+
+	sendV1(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 1})
+	env, err := protocol.Decode([]byte(rec.To("conn1")[0]))
+	if err != nil || env.V != 1 || env.Type != protocol.TYPE_STATE {
+		t.Fatalf("v1 clients should get envelopes: %+v %v", env, err)
+	}
+	gs := GameState{}
+	json.Unmarshal(env.Data, &gs)
+
+	// an old client joins the same game
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gs.GameID})
+	rec.Reset()
+	sendV1(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gs.GameID, Play: "rock", Round: 1})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gs.GameID, Play: "scissors", Round: 1})
+
+	v1 := rec.To("conn1")
+	expected := []string{
+		`{"v":1,"type":"roundResult","data":{"round":2,"gameId":"` + gs.GameID + `","yourScore":1,"theirScore":0,"winner":true,"yourPlay":"rock","theirPlay":"scissors","roundSummary":"Rock smashes Scissors","ruleset":"rpsls","matchFormat":"bestof","matchLength":1,"matchOver":true,"matchWinner":true,"opponents":[{"userId":"p2","score":0,"play":"scissors"}]}}`,
+		`{"v":1,"type":"matchOver","data":{"gameId":"` + gs.GameID + `","winner":"p1","scores":{"p1":1,"p2":0}}}`,
+	}
+	if !reflect.DeepEqual(v1, expected) {
+		t.Errorf("unexpected v1 messages:\n%s", strings.Join(v1, "\n"))
+	}
+
+	v0 := rec.To("conn2")
+	if len(v0) != 1 || strings.Contains(v0[0], `"v"`) || !strings.Contains(v0[0], `"matchOver":true`) {
+		t.Errorf("v0 clients should only get the flat state: %v", v0)
+	}
+
+	rec.Reset()
+	sendV1(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gs.GameID, Play: "rock", Round: 2, RequestID: "late"})
+	if msgs := rec.To("conn1"); len(msgs) != 1 || msgs[0] != `{"v":1,"type":"error","data":{"code":"MATCH_OVER","message":"match is over, no more plays allowed","requestId":"late"}}` {
+		t.Errorf("v1 errors should be enveloped: %v", msgs)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, _, rec := testSvc()
+
+	rec.Reset()
+	send(t, s, "conn1", PlayerMessage{Action: "stats", UID: "p1"})
+	if msgs := rec.To("conn1"); len(msgs) != 1 || msgs[0] != `{"type":"stats","userId":"p1","games":0,"matchesWon":0,"matchesLost":0,"matchesTied":0,"roundsWon":0,"roundsLost":0,"roundsTied":0,"moves":{}}` {
+		t.Errorf("new players should have empty stats: %v", msgs)
+	}
+
+	// two best of one matches, which p1 wins then ties the second round of another game
+	for i, plays := range [][2]string{{"rock", "scissors"}, {"paper", "paper"}} {
+		send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 1 + 2*i})
+		gameID := lastState(t, rec, "conn1").GameID
+		send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+		send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: plays[0], Round: 1})
+		send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: plays[1], Round: 1})
+	}
+
+	rec.Reset()
+	sendV1(t, s, "conn1", PlayerMessage{Action: "stats", UID: "p1"})
+	env, _ := protocol.Decode([]byte(rec.To("conn1")[0]))
+	sm := StatsMessage{}
+	json.Unmarshal(env.Data, &sm)
+	expected := StatsMessage{UserID: "p1", Games: 2, MatchesWon: 1, RoundsWon: 1, RoundsTied: 1, Moves: map[string]int{"rock": 1, "paper": 1}}
+	if env.Type != protocol.TYPE_STATS || !reflect.DeepEqual(sm, expected) {
+		t.Errorf("unexpected stats: %s %+v", env.Type, sm)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	s, _, rec := testSvc()
+
+	// p1 beats p2, and p3 beats a bot, which doesn't count
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 1})
+	gameID := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID})
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "scissors", Round: 1})
+	send(t, s, "conn3", PlayerMessage{Action: "new", UID: "p3", MatchFormat: "bestof", MatchLength: 1, Opponent: "bot:random"})
+	gameID = lastState(t, rec, "conn3").GameID
+	send(t, s, "conn3", PlayerMessage{Action: "play", UID: "p3", GameID: gameID, Play: "rock", Round: 1})
+
+	rec.Reset()
+	sendV1(t, s, "conn2", PlayerMessage{Action: "leaderboard", UID: "p2"})
+	env, _ := protocol.Decode([]byte(rec.To("conn2")[0]))
+	lm := LeaderboardMessage{}
+	json.Unmarshal(env.Data, &lm)
+
+	// from the defaults, one win against an equal player is worth about 162.3 points
+	if env.Type != protocol.TYPE_LEADERBOARD || len(lm.Players) != 2 {
+		t.Fatalf("expected both rated players on the leaderboard: %s %+v", env.Type, lm)
+	}
+	if lm.Players[0].UserID != "p1" || lm.Players[0].Rank != 1 || fmt.Sprintf("%.1f", lm.Players[0].Rating) != "1662.3" {
+		t.Errorf("the winner should top the leaderboard: %+v", lm.Players[0])
+	}
+	if lm.Players[1].UserID != "p2" || lm.Players[1].Rank != 2 || fmt.Sprintf("%.1f", lm.Players[1].Rating) != "1337.7" {
+		t.Errorf("the loser should come second: %+v", lm.Players[1])
+	}
+	if lm.UserID != "p2" || lm.Rank != 2 || lm.Rating != lm.Players[1].Rating || lm.Deviation >= 350 {
+		t.Errorf("the requesting player's rank should be included: %+v", lm)
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "leaderboard", UID: "p3", Limit: 1})
+	if msgs := rec.To("conn3"); len(msgs) != 1 || !strings.HasPrefix(msgs[0], `{"type":"leaderboard","players":[{"rank":1,"userId":"p1",`) ||
+		!strings.HasSuffix(msgs[0], `],"userId":"p3","rank":0,"rating":1500,"deviation":350}`) {
+		t.Errorf("unrated players should get the default rating and no rank: %v", msgs)
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "leaderboard", UID: "p3", Limit: 1000})
+	if code := lastError(t, rec, "conn3").Code; code != protocol.CODE_BAD_REQUEST {
+		t.Errorf("oversized leaderboards should be refused, got %s", code)
+	}
+}
+
+func TestSpectate(t *testing.T) {
+	s, st, rec := testSvc()
+	gameID := startGame(t, s, rec)
+
+	send(t, s, "watcher", PlayerMessage{Action: "spectate", GameID: gameID})
+	if msgs := rec.To("watcher"); len(msgs) != 1 || msgs[0] != `{"round":1,"gameId":"`+gameID+`","yourScore":0,"theirScore":0,"winner":false,"ruleset":"rpsls","opponents":[{"userId":"p1","score":0},{"userId":"p2","score":0}],"spectating":true}` {
+		t.Errorf("spectators should get the state with every player: %v", msgs)
+	}
+	sendV1(t, s, "watcher2", PlayerMessage{Action: "spectate", GameID: gameID})
+
+	// nothing is shown until the round resolves
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1})
+	if len(rec.To("watcher")) != 1 || len(rec.To("watcher2")) != 1 {
+		t.Errorf("spectators shouldn't hear about plays before the round resolves: %v", rec.To("watcher"))
+	}
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "paper", Round: 1})
+	state := lastState(t, rec, "watcher")
+	if !state.Spectating || state.Round != 2 || state.RoundSummary != "Paper covers Rock" || len(state.Opponents) != 2 ||
+		state.Opponents[0].Play != "rock" || state.Opponents[1].Play != "paper" || state.Opponents[1].Score != 1 {
+		t.Errorf("spectators should get the round result: %+v", state)
+	}
+	env, _ := protocol.Decode([]byte(rec.To("watcher2")[1]))
+	if env.Type != protocol.TYPE_ROUND_RESULT {
+		t.Errorf("v1 spectators should get a roundResult, got %s", env.Type)
+	}
+
+	// spectators can't play
+	rec.Reset()
+	send(t, s, "watcher", PlayerMessage{Action: "play", UID: "p3", GameID: gameID, Play: "rock", Round: 2})
+	if code := lastError(t, rec, "watcher").Code; code != protocol.CODE_GAME_FULL {
+		t.Errorf("spectators shouldn't get a seat, got %s", code)
+	}
+
+	// one spectator leaves, the other's connection is gone
+	disconnect(t, s, "watcher")
+	rec.MarkGone("watcher2")
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 2})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "paper", Round: 2})
+	if g, _ := st.Load(gameID); len(g.Spectators) != 0 {
+		t.Errorf("gone spectators should be cleaned up: %+v", g.Spectators)
+	}
+	if g, _ := st.Load(gameID); g.Players["p1"].Offline {
+		t.Errorf("a spectator leaving shouldn't affect the players")
+	}
+
+	rec.Reset()
+	send(t, s, "watcher", PlayerMessage{Action: "spectate", GameID: "NOPE"})
+	if code := lastError(t, rec, "watcher").Code; code != protocol.CODE_GAME_NOT_FOUND {
+		t.Errorf("spectating a missing game should fail with GAME_NOT_FOUND, got %s", code)
+	}
+}
+
+func TestSpectateWhilePlaying(t *testing.T) {
+	s, st, rec := testSvc()
+	send(t, s, "conn3", PlayerMessage{Action: "new", UID: "p3"})
+	watched := lastState(t, rec, "conn3").GameID
+	played := startGame(t, s, rec)
+
+	// p1 watches another game from the connection they play on
+	send(t, s, "conn1", PlayerMessage{Action: "spectate", UID: "p1", GameID: watched})
+	disconnect(t, s, "conn1")
+
+	if g, _ := st.Load(played); !g.Players["p1"].Offline {
+		t.Errorf("p1 should be offline in the game they play in")
+	}
+	if msgs := rec.To("conn2"); len(msgs) != 1 || msgs[0] != `{"type":"presence","gameId":"`+played+`","userId":"p1","status":"disconnected"}` {
+		t.Errorf("p2 should be told p1 disconnected: %v", msgs)
+	}
+	if g, _ := st.Load(watched); len(g.Spectators) != 0 {
+		t.Errorf("p1 should stop spectating: %+v", g.Spectators)
+	}
+}
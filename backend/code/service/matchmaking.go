@@ -0,0 +1,191 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// BAND_GROWTH is how many rating points a queued player's band widens by for every second they wait
+const BAND_GROWTH = 5
+
+// Queue puts a player in the matchmaking queue for a ruleset, then looks for an opponent
+func (s *LambdaSvc) Queue(connectionID string, message PlayerMessage) error {
+	ruleset := message.Ruleset
+	if ruleset == "" {
+		ruleset = game.DEFAULT_RULESET
+	}
+	if _, err := game.LookupRuleset(ruleset); err != nil {
+		return err
+	}
+	if message.Band < 0 {
+		return fmt.Errorf("%w: band can't be negative", ErrBadRequest)
+	}
+	r, err := s.store.Rating(message.UID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	err = s.store.Enqueue(store.QueueEntry{
+		UserID:       message.UID,
+		ConnectionID: connectionID,
+		Ruleset:      ruleset,
+		Rating:       r.Rating,
+		Band:         message.Band,
+		Joined:       now,
+		Protocol:     message.V,
+	})
+	if err != nil {
+		return err
+	}
+	// remember who is on the connection, so they leave the queue if it drops. A connection
+	// which already joined a game keeps pointing at it.
+	if _, _, err := s.store.LookupConnection(connectionID); errors.Is(err, store.ErrNoConnection) {
+		if err := s.store.StoreConnection(connectionID, "", message.UID); err != nil {
+			fmt.Printf("unable to store connection: %s\n", err)
+		}
+	}
+
+	err = s.send(connectionID, message.V, protocol.TYPE_QUEUE, QueueMessage{
+		UserID:  message.UID,
+		Status:  protocol.QUEUE_QUEUED,
+		Ruleset: ruleset,
+		Rating:  r.Rating,
+		Band:    message.Band,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the player is queued either way, matching can be retried by the sweeper
+	if err := s.Matchmake(now); err != nil {
+		fmt.Printf("Unable to matchmake: %s\n", err)
+	}
+	return nil
+}
+
+// Dequeue takes a player out of the matchmaking queue
+func (s *LambdaSvc) Dequeue(connectionID string, message PlayerMessage) error {
+	err := s.store.Dequeue(message.UID, "")
+	if err != nil {
+		return err
+	}
+	return s.send(connectionID, message.V, protocol.TYPE_QUEUE, QueueMessage{
+		UserID: message.UID,
+		Status: protocol.QUEUE_DEQUEUED,
+	})
+}
+
+// accepts reports whether a queued player would play an opponent with the given rating by now.
+// Their band widens by BAND_GROWTH for every second they've waited.
+func accepts(e store.QueueEntry, rating float64, now int64) bool {
+	if e.Band == 0 {
+		return true
+	}
+	band := float64(e.Band) + BAND_GROWTH*float64(now-e.Joined)
+	return math.Abs(e.Rating-rating) <= band
+}
+
+// compatible reports whether two queued players can be matched with each other
+func compatible(a, b store.QueueEntry, now int64) bool {
+	return a.UserID != b.UserID && a.Ruleset == b.Ruleset && accepts(a, b.Rating, now) && accepts(b, a.Rating, now)
+}
+
+// Matchmake pairs up compatible players in the matchmaking queue, longest waiting first, and starts
+// a game for each pair. It runs whenever someone queues, and from the timer, since bands widen over time.
+func (s *LambdaSvc) Matchmake(now int64) error {
+	waiting, err := s.store.Waiting(now)
+	if err != nil {
+		return err
+	}
+
+	matched := make(map[string]bool, len(waiting))
+	for i, a := range waiting {
+		if matched[a.UserID] {
+			continue
+		}
+		for _, b := range waiting[i+1:] {
+			if matched[b.UserID] || !compatible(a, b, now) {
+				continue
+			}
+			err := s.startMatch(a, b)
+			if err != nil {
+				// usually someone else matched one of them first, the next run will find out
+				fmt.Printf("Unable to match %s with %s: %s\n", a.UserID, b.UserID, err)
+				break
+			}
+			matched[a.UserID] = true
+			matched[b.UserID] = true
+			break
+		}
+	}
+	return nil
+}
+
+// startMatch takes two players out of the queue and starts a game between them. Taking them out
+// is conditional, so a player can only be matched once even with several matchmakers running.
+// If the game can't be stored both go back in the queue.
+func (s *LambdaSvc) startMatch(a, b store.QueueEntry) error {
+	err := s.store.Dequeue(a.UserID, a.ConnectionID)
+	if err != nil {
+		return err
+	}
+	err = s.store.Dequeue(b.UserID, b.ConnectionID)
+	if err != nil {
+		// put the first player back where they were
+		if qerr := s.store.Enqueue(a); qerr != nil {
+			fmt.Printf("Unable to requeue %s: %s\n", a.UserID, qerr)
+		}
+		return err
+	}
+
+	g := game.NewGame()
+	g.Ruleset = a.Ruleset
+	for _, e := range []store.QueueEntry{a, b} {
+		gc, err := game.NewGameContext(e.UserID, e.ConnectionID, g)
+		if err != nil {
+			return err
+		}
+		gc.ActingPlayer.Protocol = e.Protocol
+	}
+	err = s.store.StoreAll(g)
+	if err != nil {
+		fmt.Printf("unable to store matched game: %s\n", err)
+		// put both players back, so the next run can match them again, and tell them why they wait
+		for _, e := range []store.QueueEntry{a, b} {
+			if qerr := s.store.Enqueue(e); qerr != nil {
+				fmt.Printf("Unable to requeue %s: %s\n", e.UserID, qerr)
+			}
+			s.SendError(e.ConnectionID, e.Protocol, "", err)
+		}
+		return err
+	}
+	s.announceMatch(g)
+	return nil
+}
+
+// announceMatch points each player's connection at a newly created game, and tells them
+// who they were matched with before sending them the game
+func (s *LambdaSvc) announceMatch(g *game.Game) {
+	for _, p := range g.SortedPlayers() {
+		err := s.store.StoreConnection(p.Address, g.ID, p.ID)
+		if err != nil {
+			fmt.Printf("unable to store connection: %s\n", err)
+		}
+		mm := MatchedMessage{GameID: g.ID, Ruleset: g.Ruleset, Opponents: []string{}}
+		for _, o := range g.SortedPlayers() {
+			if o.ID != p.ID {
+				mm.Opponents = append(mm.Opponents, o.ID)
+			}
+		}
+		s.send(p.Address, p.Protocol, protocol.TYPE_MATCHED, mm)
+		state := stateFor(g, p)
+		s.SendPlayerState(g, p, protocol.TYPE_STATE, &state)
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/rating"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+func TestMatchmaking(t *testing.T) {
+	s, st, rec := testSvc()
+
+	send(t, s, "conn1", PlayerMessage{Action: "queue", UID: "p1"})
+	if msgs := rec.To("conn1"); len(msgs) != 1 || msgs[0] != `{"type":"queue","userId":"p1","status":"queued","ruleset":"rpsls","rating":1500,"band":0}` {
+		t.Errorf("expected confirmation of queueing: %v", msgs)
+	}
+	// someone waiting for a different ruleset isn't a match
+	send(t, s, "conn3", PlayerMessage{Action: "queue", UID: "p3", Ruleset: "rps"})
+
+	rec.Reset()
+	send(t, s, "conn2", PlayerMessage{Action: "queue", UID: "p2"})
+	state := lastState(t, rec, "conn1")
+	if msgs := rec.To("conn1"); len(msgs) != 2 || msgs[0] != `{"type":"matched","gameId":"`+state.GameID+`","ruleset":"rpsls","opponents":["p2"]}` {
+		t.Errorf("p1 should be told about the match, then get the game: %v", msgs)
+	}
+	if msgs := rec.To("conn2"); len(msgs) != 3 || lastState(t, rec, "conn2").GameID != state.GameID {
+		t.Errorf("p2 should be queued, matched and get the game: %v", msgs)
+	}
+	if len(rec.To("conn3")) != 0 {
+		t.Errorf("p3 should still be waiting: %v", rec.To("conn3"))
+	}
+
+	// the game is a normal one
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: state.GameID, Play: "rock", Round: 1})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: state.GameID, Play: "lizard", Round: 1})
+	if s := lastState(t, rec, "conn2"); s.Round != 2 || s.TheirPlay != "rock" {
+		t.Errorf("matched players should be able to play: %+v", s)
+	}
+	if waiting, _ := st.Waiting(time.Now().Unix()); len(waiting) != 1 || waiting[0].UserID != "p3" {
+		t.Errorf("matched players should leave the queue: %+v", waiting)
+	}
+
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "dequeue", UID: "p3"})
+	if msgs := rec.To("conn3"); len(msgs) != 1 || msgs[0] != `{"type":"queue","userId":"p3","status":"dequeued","ruleset":"","rating":0,"band":0}` {
+		t.Errorf("expected confirmation of dequeueing: %v", msgs)
+	}
+	send(t, s, "conn3", PlayerMessage{Action: "dequeue", UID: "p3"})
+	if code := lastError(t, rec, "conn3").Code; code != protocol.CODE_NOT_QUEUED {
+		t.Errorf("dequeueing twice should fail with NOT_QUEUED, got %s", code)
+	}
+}
+
+func TestMatchmakingBands(t *testing.T) {
+	s, st, rec := testSvc()
+	st.StoreRating("strong", rating.Rating{Rating: 1800, Deviation: 100, Volatility: 0.06})
+
+	send(t, s, "conn1", PlayerMessage{Action: "queue", UID: "strong", Band: 100})
+	send(t, s, "conn2", PlayerMessage{Action: "queue", UID: "new", Band: 100})
+	if len(rec.To("conn1")) != 1 || len(rec.To("conn2")) != 1 {
+		t.Fatalf("players 300 points apart shouldn't match straight away: %v %v", rec.To("conn1"), rec.To("conn2"))
+	}
+
+	// after 30 seconds the bands are 250 wide, after 40 they reach 300
+	now := time.Now().Unix()
+	s.Matchmake(now + 30)
+	if len(rec.To("conn1")) != 1 {
+		t.Errorf("bands shouldn't have widened enough yet: %v", rec.To("conn1"))
+	}
+	s.Matchmake(now + 40)
+	if msgs := rec.To("conn1"); len(msgs) != 3 || lastState(t, rec, "conn1").GameID != lastState(t, rec, "conn2").GameID {
+		t.Errorf("widened bands should match the players: %v", msgs)
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	s, st, rec := testSvc()
+
+	send(t, s, "conn1", PlayerMessage{Action: "queue", UID: "p1"})
+	disconnect(t, s, "conn1")
+	if waiting, _ := st.Waiting(time.Now().Unix()); len(waiting) != 0 {
+		t.Errorf("disconnecting should leave the queue: %+v", waiting)
+	}
+
+	rec.Reset()
+	send(t, s, "conn2", PlayerMessage{Action: "queue", UID: "p2"})
+	if msgs := rec.To("conn2"); len(msgs) != 1 {
+		t.Errorf("nobody should be left to match with: %v", msgs)
+	}
+}
+
+// unstorableGames is a store which fails to store games while broken is set
+type unstorableGames struct {
+	*store.Memory
+	broken bool
+}
+
+func (u *unstorableGames) StoreAll(g *game.Game) error {
+	if u.broken {
+		return errors.New("storage unavailable")
+	}
+	return u.Memory.StoreAll(g)
+}
+
+func TestMatchStoreFailure(t *testing.T) {
+	st := &unstorableGames{Memory: store.NewMemory(), broken: true}
+	rec := &notify.Recorder{}
+	s := NewLambdaSvc(st, rec)
+
+	send(t, s, "conn1", PlayerMessage{Action: "queue", UID: "p1"})
+	send(t, s, "conn2", PlayerMessage{Action: "queue", UID: "p2"})
+	for _, conn := range []string{"conn1", "conn2"} {
+		if code := lastError(t, rec, conn).Code; code != protocol.CODE_INTERNAL {
+			t.Errorf("%s should be told the match failed, got %s", conn, code)
+		}
+	}
+	if waiting, _ := st.Waiting(time.Now().Unix()); len(waiting) != 2 {
+		t.Fatalf("both players should still be queued: %+v", waiting)
+	}
+
+	st.broken = false
+	s.Matchmake(time.Now().Unix())
+	if lastState(t, rec, "conn1").GameID != lastState(t, rec, "conn2").GameID {
+		t.Errorf("the next run should match them")
+	}
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jbarratt/rpsls/backend/code/bot"
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// finishedGame loads a game whose match is over, checking the message comes from one of its players
+func (s *LambdaSvc) finishedGame(connectionID string, message PlayerMessage) (*game.Game, error) {
+	g, err := s.store.Load(message.GameID)
+	if err != nil {
+		return nil, err
+	}
+	p, found := g.Players[message.UID]
+	if !found || p.Address != connectionID {
+		return nil, fmt.Errorf("%w: only players in the game can answer a rematch", ErrBadRequest)
+	}
+	if !g.MatchOver {
+		return nil, fmt.Errorf("%w, no rematch yet", game.ErrMatchNotOver)
+	}
+	return g, nil
+}
+
+// Rematch asks for a rematch of a finished game, or accepts one somebody else asked for
+// when accept is set. Once every player wants one, it starts.
+func (s *LambdaSvc) Rematch(connectionID string, message PlayerMessage, accept bool) error {
+	g, err := s.finishedGame(connectionID, message)
+	if err != nil {
+		return err
+	}
+	// asking again after the rematch started just gets the new game
+	if g.NextGame != "" {
+		return s.sendRematchStarted(g, g.Players[message.UID])
+	}
+	if accept {
+		asked := false
+		for _, p := range g.Players {
+			asked = asked || (p.Rematch && p.ID != message.UID)
+		}
+		if !asked {
+			return fmt.Errorf("%w: nobody asked for a rematch", ErrBadRequest)
+		}
+	}
+
+	err = s.store.StoreRematch(g, message.UID, true)
+	if err != nil {
+		return err
+	}
+	// bots are always up for another game
+	for _, p := range g.Players {
+		if bot.IsBot(p.ID) {
+			p.Rematch = true
+		}
+	}
+	if g.RematchAgreed() {
+		return s.startRematch(g)
+	}
+
+	rm := RematchMessage{GameID: g.ID, UserID: message.UID, Status: protocol.REMATCH_REQUESTED}
+	for _, p := range g.SortedPlayers() {
+		if p.ID != message.UID {
+			s.send(p.Address, p.Protocol, protocol.TYPE_REMATCH, rm)
+		}
+	}
+	return nil
+}
+
+// DeclineRematch turns down a rematch of a finished game, which clears everyone's request
+func (s *LambdaSvc) DeclineRematch(connectionID string, message PlayerMessage) error {
+	g, err := s.finishedGame(connectionID, message)
+	if err != nil {
+		return err
+	}
+	if g.NextGame != "" {
+		return fmt.Errorf("%w: %s", store.ErrRematchStarted, g.NextGame)
+	}
+	for _, p := range g.SortedPlayers() {
+		if p.Rematch {
+			if err := s.store.StoreRematch(g, p.ID, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	rm := RematchMessage{GameID: g.ID, UserID: message.UID, Status: protocol.REMATCH_DECLINED}
+	for _, p := range g.SortedPlayers() {
+		if p.ID != message.UID {
+			s.send(p.Address, p.Protocol, protocol.TYPE_REMATCH, rm)
+		}
+	}
+	return nil
+}
+
+// startRematch creates the rematch of a game everyone agreed to play again, and sends it to the players.
+// The rematch is stored before it is linked, so the game a link points to always exists. Linking is
+// conditional, so if several players accept at once only one rematch starts and the others are deleted.
+func (s *LambdaSvc) startRematch(g *game.Game) error {
+	next := g.Rematch()
+	err := s.store.StoreAll(next)
+	if err != nil {
+		fmt.Printf("unable to store rematch: %s\n", err)
+		return err
+	}
+	err = s.store.LinkRematch(g.ID, next.ID)
+	if err != nil {
+		if derr := s.store.DeleteGame(next.ID); derr != nil {
+			fmt.Printf("Unable to delete unused rematch %s: %s\n", next.ID, derr)
+		}
+		if errors.Is(err, store.ErrRematchStarted) {
+			// someone else got there first, and is telling everyone
+			return nil
+		}
+		return err
+	}
+	g.NextGame = next.ID
+
+	// the first rematch starts the series, which counts the match before it
+	if g.Series == "" {
+		if err := s.store.AddSeriesResult(next.Series, g.MatchWinner); err != nil {
+			fmt.Printf("Unable to start series %s: %s\n", next.Series, err)
+		}
+	}
+
+	for _, p := range next.SortedPlayers() {
+		if p.Address != "" {
+			if err := s.store.StoreConnection(p.Address, next.ID, p.ID); err != nil {
+				fmt.Printf("unable to store connection: %s\n", err)
+			}
+		}
+		s.sendRematchStarted(g, p)
+		state := stateFor(next, p)
+		s.SendPlayerState(next, p, protocol.TYPE_STATE, &state)
+	}
+	return nil
+}
+
+// sendRematchStarted tells a player the rematch of a game started, and how the series stands
+func (s *LambdaSvc) sendRematchStarted(g *game.Game, p *game.Player) error {
+	sr, err := s.store.Series(g.SeriesID())
+	if err != nil {
+		return err
+	}
+	return s.send(p.Address, p.Protocol, protocol.TYPE_REMATCH, RematchMessage{
+		GameID:     g.ID,
+		Status:     protocol.REMATCH_STARTED,
+		NextGameID: g.NextGame,
+		SeriesID:   sr.ID,
+		Matches:    sr.Matches,
+		Wins:       sr.Wins,
+		Ties:       sr.Ties,
+	})
+}
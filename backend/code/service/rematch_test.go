@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// lastRematch decodes the newest rematch message sent to a connection
+func lastRematch(t *testing.T, rec *notify.Recorder, connectionID string) RematchMessage {
+	t.Helper()
+	msgs := rec.To(connectionID)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		env, err := protocol.Decode([]byte(msgs[i]))
+		if err == nil && env.Type == protocol.TYPE_REMATCH {
+			rm := RematchMessage{}
+			json.Unmarshal(env.Data, &rm)
+			return rm
+		}
+	}
+	t.Fatalf("no rematch message sent to %s: %v", connectionID, msgs)
+	return RematchMessage{}
+}
+
+// playMatch plays a best of one match between p1 and p2
+func playMatch(t *testing.T, s *LambdaSvc, rec *notify.Recorder, gameID, p1Play, p2Play string) {
+	t.Helper()
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: p1Play, Round: 1})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: p2Play, Round: 1})
+	if !lastState(t, rec, "conn1").MatchOver {
+		t.Fatalf("match should be over")
+	}
+}
+
+func TestRematch(t *testing.T) {
+	s, _, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 1})
+	first := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: first})
+
+	send(t, s, "conn1", PlayerMessage{Action: "rematch", UID: "p1", GameID: first})
+	if code := lastError(t, rec, "conn1").Code; code != protocol.CODE_MATCH_NOT_OVER {
+		t.Errorf("no rematch before the match is over, got %s", code)
+	}
+	playMatch(t, s, rec, first, "rock", "scissors")
+
+	send(t, s, "conn2", PlayerMessage{Action: "acceptRematch", UID: "p2", GameID: first})
+	if code := lastError(t, rec, "conn2").Code; code != protocol.CODE_BAD_REQUEST {
+		t.Errorf("nothing to accept yet, got %s", code)
+	}
+
+	// asked, then declined
+	send(t, s, "conn1", PlayerMessage{Action: "rematch", UID: "p1", GameID: first})
+	if rm := lastRematch(t, rec, "conn2"); !reflect.DeepEqual(rm, RematchMessage{GameID: first, UserID: "p1", Status: protocol.REMATCH_REQUESTED}) {
+		t.Errorf("p2 should be asked for a rematch: %+v", rm)
+	}
+	send(t, s, "conn2", PlayerMessage{Action: "declineRematch", UID: "p2", GameID: first})
+	if rm := lastRematch(t, rec, "conn1"); rm.Status != protocol.REMATCH_DECLINED || rm.UserID != "p2" {
+		t.Errorf("p1 should hear the rematch was declined: %+v", rm)
+	}
+	send(t, s, "conn2", PlayerMessage{Action: "acceptRematch", UID: "p2", GameID: first})
+	if code := lastError(t, rec, "conn2").Code; code != protocol.CODE_BAD_REQUEST {
+		t.Errorf("a declined rematch can't be accepted, got %s", code)
+	}
+
+	// asked and accepted
+	rec.Reset()
+	send(t, s, "conn1", PlayerMessage{Action: "rematch", UID: "p1", GameID: first})
+	send(t, s, "conn2", PlayerMessage{Action: "acceptRematch", UID: "p2", GameID: first})
+	for _, conn := range []string{"conn1", "conn2"} {
+		rm := lastRematch(t, rec, conn)
+		if rm.Status != protocol.REMATCH_STARTED || rm.NextGameID == "" || rm.SeriesID != first || rm.Matches != 1 || !reflect.DeepEqual(rm.Wins, map[string]int{"p1": 1}) {
+			t.Errorf("%s should be told the rematch started: %+v", conn, rm)
+		}
+		state := lastState(t, rec, conn)
+		if state.GameID != rm.NextGameID || state.SeriesID != first || state.Round != 1 || state.YourScore != 0 || state.MatchLength != 1 {
+			t.Errorf("%s should get the fresh rematch: %+v", conn, state)
+		}
+	}
+	second := lastState(t, rec, "conn1").GameID
+
+	// asking again just gets the rematch which already started
+	rec.Reset()
+	send(t, s, "conn2", PlayerMessage{Action: "rematch", UID: "p2", GameID: first})
+	if rm := lastRematch(t, rec, "conn2"); rm.NextGameID != second || len(rec.To("conn1")) != 0 {
+		t.Errorf("a late rematch request should get the started rematch: %+v", rm)
+	}
+	send(t, s, "conn2", PlayerMessage{Action: "declineRematch", UID: "p2", GameID: first})
+	if code := lastError(t, rec, "conn2").Code; code != protocol.CODE_REMATCH_STARTED {
+		t.Errorf("too late to decline, got %s", code)
+	}
+
+	// the series keeps counting
+	playMatch(t, s, rec, second, "rock", "paper")
+	send(t, s, "conn2", PlayerMessage{Action: "rematch", UID: "p2", GameID: second})
+	send(t, s, "conn1", PlayerMessage{Action: "acceptRematch", UID: "p1", GameID: second})
+	rm := lastRematch(t, rec, "conn1")
+	if rm.SeriesID != first || rm.Matches != 2 || !reflect.DeepEqual(rm.Wins, map[string]int{"p1": 1, "p2": 1}) {
+		t.Errorf("the series should count both matches: %+v", rm)
+	}
+}
+
+// storedGames is a store which remembers the ID of every game stored whole
+type storedGames struct {
+	*store.Memory
+	ids []string
+}
+
+func (sg *storedGames) StoreAll(g *game.Game) error {
+	sg.ids = append(sg.ids, g.ID)
+	return sg.Memory.StoreAll(g)
+}
+
+func TestRematchRace(t *testing.T) {
+	st := &storedGames{Memory: store.NewMemory()}
+	rec := &notify.Recorder{}
+	s := NewLambdaSvc(st, rec)
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 1})
+	first := lastState(t, rec, "conn1").GameID
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: first})
+	playMatch(t, s, rec, first, "rock", "scissors")
+
+	// both players accept at once, each with their own copy of the finished game
+	a, _ := st.Load(first)
+	b, _ := st.Load(first)
+	st.ids = nil
+	if err := s.startRematch(a); err != nil {
+		t.Fatalf("unable to start rematch: %s", err)
+	}
+	if err := s.startRematch(b); err != nil {
+		t.Fatalf("losing the race should not be an error: %s", err)
+	}
+
+	g, _ := st.Load(first)
+	if len(st.ids) != 2 || g.NextGame != st.ids[0] {
+		t.Fatalf("the first rematch should be linked: %v %s", st.ids, g.NextGame)
+	}
+	if _, err := st.Load(st.ids[1]); !errors.Is(err, store.ErrGameNotFound) {
+		t.Errorf("the rematch which lost the race should be deleted: %v", err)
+	}
+}
+
+func TestBotRematch(t *testing.T) {
+	s, _, rec := testSvc()
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", MatchFormat: "bestof", MatchLength: 1, Opponent: "bot:random"})
+	gameID := lastState(t, rec, "conn1").GameID
+	// the bot plays at random, so ties can drag the match out
+	for round := 1; !lastState(t, rec, "conn1").MatchOver; round++ {
+		send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: round})
+	}
+
+	send(t, s, "conn1", PlayerMessage{Action: "rematch", UID: "p1", GameID: gameID})
+	rm := lastRematch(t, rec, "conn1")
+	if rm.Status != protocol.REMATCH_STARTED || lastState(t, rec, "conn1").GameID != rm.NextGameID {
+		t.Errorf("bots should accept a rematch straight away: %+v", rm)
+	}
+}
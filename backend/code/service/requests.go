@@ -0,0 +1,93 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+)
+
+// ErrRequestInProgress is returned for a retry of a request which is still running
+var ErrRequestInProgress = errors.New("request is still running")
+
+// replyRecorder passes messages on, keeping a copy of those sent to the connection a request came from
+type replyRecorder struct {
+	notify.Notifier
+	connectionID string
+	replies      []string
+}
+
+// Send delivers the message, and keeps it if it's a reply. Replies are kept even if the
+// connection is gone, since a retry is likely to come from a new one.
+func (r *replyRecorder) Send(destination string, body []byte) error {
+	if destination == r.connectionID {
+		r.replies = append(r.replies, string(body))
+	}
+	return r.Notifier.Send(destination, body)
+}
+
+// repeatedError is the error a request failed with, given again to a retry of it
+type repeatedError struct {
+	code    string
+	message string
+}
+
+func (e *repeatedError) Error() string {
+	return e.message
+}
+
+// once runs a message with a request ID, unless the player sent it recently. Then the replies the
+// first one got are sent again, to whichever connection the retry came from, and it fails the same way.
+// Requests which failed unexpectedly are forgotten, so a retry gets another go.
+func (s *LambdaSvc) once(connectionID string, message PlayerMessage) error {
+	earlier, err := s.store.BeginRequest(message.UID, message.RequestID, time.Now().Unix())
+	if errors.Is(err, store.ErrDuplicateRequest) {
+		return s.repeat(connectionID, earlier)
+	}
+	if err != nil {
+		fmt.Printf("Unable to begin request %s: %s\n", message.RequestID, err)
+		return err
+	}
+
+	// the replies are recorded on a copy of the service, so other requests aren't
+	replies := &replyRecorder{Notifier: s.ws, connectionID: connectionID}
+	rs := *s
+	rs.ws = replies
+	err = rs.run(connectionID, message)
+
+	r := &store.RequestItem{UserID: message.UID, RequestID: message.RequestID, Replies: replies.replies}
+	if err != nil {
+		em := errorMessage(message.RequestID, err)
+		if em.Code == protocol.CODE_INTERNAL {
+			if ferr := s.store.ForgetRequest(message.UID, message.RequestID); ferr != nil {
+				fmt.Printf("Unable to forget request %s: %s\n", message.RequestID, ferr)
+			}
+			return err
+		}
+		r.ErrorCode, r.ErrorMessage = em.Code, em.Message
+	}
+	if ferr := s.store.FinishRequest(r, time.Now().Unix()); ferr != nil {
+		fmt.Printf("Unable to record request %s: %s\n", message.RequestID, ferr)
+	}
+	return err
+}
+
+// repeat gives a retry the outcome of the request it repeats
+func (s *LambdaSvc) repeat(connectionID string, r *store.RequestItem) error {
+	if !r.Done {
+		return fmt.Errorf("%w: %s", ErrRequestInProgress, r.RequestID)
+	}
+	for _, reply := range r.Replies {
+		if err := s.ws.Send(connectionID, []byte(reply)); err != nil {
+			fmt.Printf("Unable to repeat reply to request %s: %s\n", r.RequestID, err)
+			return err
+		}
+	}
+	if r.ErrorCode != "" {
+		return &repeatedError{code: r.ErrorCode, message: r.ErrorMessage}
+	}
+	return nil
+}
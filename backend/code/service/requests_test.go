@@ -0,0 +1,65 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+)
+
+func TestRetriedRequests(t *testing.T) {
+	s, st, rec := testSvc()
+
+	// a retried new game gets the same game back, even on a new connection
+	send(t, s, "conn1", PlayerMessage{Action: "new", UID: "p1", RequestID: "r1"})
+	first := rec.To("conn1")
+	send(t, s, "conn1b", PlayerMessage{Action: "new", UID: "p1", RequestID: "r1"})
+	if retried := rec.To("conn1b"); len(first) != 1 || !reflect.DeepEqual(first, retried) {
+		t.Fatalf("the retry should get the original replies: %v then %v", first, retried)
+	}
+	if len(rec.To("conn1")) != 1 {
+		t.Errorf("the original connection shouldn't hear about the retry: %v", rec.To("conn1"))
+	}
+	gameID := lastState(t, rec, "conn1").GameID
+
+	// the same request ID from someone else is a different request
+	send(t, s, "conn2", PlayerMessage{Action: "join", UID: "p2", GameID: gameID, RequestID: "r1"})
+	if gs := lastState(t, rec, "conn2"); gs.GameID != gameID {
+		t.Fatalf("p2 should have joined: %+v", gs)
+	}
+
+	rec.Reset()
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "rock", Round: 1, RequestID: "r2"})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "scissors", Round: 1, RequestID: "r2"})
+	result := rec.To("conn2")
+	rec.Reset()
+	if code := send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "scissors", Round: 1, RequestID: "r2"}); code != 200 {
+		t.Errorf("a retried play should succeed like the original, got %d", code)
+	}
+	if retried := rec.To("conn2"); !reflect.DeepEqual(result, retried) || len(rec.To("conn1")) != 0 {
+		t.Errorf("only the retrying player should get the result again: %v then %v", result, retried)
+	}
+	if history, _ := st.History(gameID); len(history) != 1 {
+		t.Errorf("the play shouldn't run twice: %+v", history)
+	}
+
+	// failures are repeated too, without running the request again
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p3", GameID: gameID, RequestID: "r3"})
+	original := lastError(t, rec, "conn3")
+	rec.Reset()
+	send(t, s, "conn3", PlayerMessage{Action: "join", UID: "p3", GameID: gameID, RequestID: "r3"})
+	if em := lastError(t, rec, "conn3"); em != original || em.Code != protocol.CODE_GAME_FULL || em.RequestID != "r3" {
+		t.Errorf("the retry should fail the same way: %+v then %+v", original, em)
+	}
+	if len(rec.To("conn3")) != 1 {
+		t.Errorf("only the error should be sent again: %v", rec.To("conn3"))
+	}
+
+	// a retry while the request is still running can't get its outcome yet
+	st.BeginRequest("p1", "r4", time.Now().Unix())
+	send(t, s, "conn1", PlayerMessage{Action: "stats", UID: "p1", RequestID: "r4"})
+	if code := lastError(t, rec, "conn1").Code; code != protocol.CODE_REQUEST_IN_PROGRESS {
+		t.Errorf("expected REQUEST_IN_PROGRESS, got %s", code)
+	}
+}
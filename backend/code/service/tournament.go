@@ -0,0 +1,243 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+	"github.com/jbarratt/rpsls/backend/code/tournament"
+)
+
+// TOURNAMENT_RETRIES is how many times a tournament update is tried again when someone else
+// changed the tournament first, e.g. two matches of a round finishing together
+const TOURNAMENT_RETRIES = 5
+
+// updateTournament loads a tournament, changes it with update, creates a game for every match
+// that leaves without one, and stores it all. The games are stored first, so a tournament never
+// points at a game which doesn't exist. If the tournament changed in the meantime the games are
+// deleted and the whole thing is tried again on the newer version, so update must be safe to repeat.
+func (s *LambdaSvc) updateTournament(tournamentID string, update func(*tournament.Tournament) error) (*tournament.Tournament, []*game.Game, error) {
+	for attempt := 0; ; attempt++ {
+		t, err := s.store.LoadTournament(tournamentID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := update(t); err != nil {
+			return nil, nil, err
+		}
+		games, err := scheduleMatches(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, g := range games {
+			if err := s.store.StoreAll(g); err != nil {
+				fmt.Printf("unable to store tournament match: %s\n", err)
+				s.deleteGames(games[:i])
+				return nil, nil, err
+			}
+		}
+
+		err = s.store.StoreTournament(t)
+		if err != nil {
+			s.deleteGames(games)
+		}
+		if errors.Is(err, store.ErrStaleTournament) && attempt < TOURNAMENT_RETRIES {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return t, games, nil
+	}
+}
+
+// deleteGames removes the games scheduled by a tournament update which didn't go through
+func (s *LambdaSvc) deleteGames(games []*game.Game) {
+	for _, g := range games {
+		if err := s.store.DeleteGame(g.ID); err != nil {
+			fmt.Printf("Unable to delete unused tournament match %s: %s\n", g.ID, err)
+		}
+	}
+}
+
+// CreateTournament sets up a tournament which players can register for. Whoever creates it
+// organizes it, and is the only one who can start it.
+func (s *LambdaSvc) CreateTournament(connectionID string, message PlayerMessage) error {
+	format := message.TournamentFormat
+	if format == "" {
+		format = tournament.FORMAT_SINGLE_ELIMINATION
+	}
+	t, err := tournament.New(format)
+	if err != nil {
+		return err
+	}
+	t.Name = message.Name
+	t.Organizer = message.UID
+	if message.Ruleset != "" {
+		t.Ruleset = message.Ruleset
+	}
+	if message.MatchFormat != "" {
+		t.Match = game.MatchFormat{Mode: message.MatchFormat, Length: message.MatchLength}
+	}
+	t.Rounds = message.Rounds
+	t.RoundTimeout = message.RoundTimeout
+	t.MaxMisses = message.MaxMisses
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	err = s.store.StoreTournament(t)
+	if err != nil {
+		fmt.Printf("unable to store tournament: %s\n", err)
+		return err
+	}
+	return s.send(connectionID, message.V, protocol.TYPE_TOURNAMENT, tournamentView(t))
+}
+
+// RegisterTournament signs a player up for a tournament from this connection. Registering again
+// moves a registered player to the new connection, which works after the start too.
+func (s *LambdaSvc) RegisterTournament(connectionID string, message PlayerMessage) error {
+	t, _, err := s.updateTournament(message.TournamentID, func(t *tournament.Tournament) error {
+		return t.Register(tournament.Entrant{UserID: message.UID, ConnectionID: connectionID, Protocol: message.V})
+	})
+	if err != nil {
+		return err
+	}
+	s.sendStandings(t)
+	return nil
+}
+
+// StartTournament closes registration, seeds the players by rating and starts the first round
+func (s *LambdaSvc) StartTournament(connectionID string, message PlayerMessage) error {
+	t, games, err := s.updateTournament(message.TournamentID, func(t *tournament.Tournament) error {
+		if t.Organizer != message.UID {
+			return fmt.Errorf("%w: only the organizer can start the tournament", ErrBadRequest)
+		}
+		ratings := make(map[string]float64, len(t.Entrants))
+		for _, e := range t.Entrants {
+			r, err := s.store.Rating(e.UserID)
+			if err != nil {
+				return err
+			}
+			ratings[e.UserID] = r.Rating
+		}
+		t.Seed(ratings)
+		return t.Start()
+	})
+	if err != nil {
+		return err
+	}
+	return s.startMatches(t, games)
+}
+
+// ViewTournament sends a tournament's standings and matches to the requesting connection
+func (s *LambdaSvc) ViewTournament(connectionID string, message PlayerMessage) error {
+	t, err := s.store.LoadTournament(message.TournamentID)
+	if err != nil {
+		return err
+	}
+	return s.send(connectionID, message.V, protocol.TYPE_TOURNAMENT, tournamentView(t))
+}
+
+// advanceTournament reports the result of a finished tournament match, which starts the next
+// round once every match of this one is in. Each match is only counted once, however often
+// the result is reported.
+func (s *LambdaSvc) advanceTournament(g *game.Game) error {
+	if !g.MatchOver || g.Tournament == "" {
+		return nil
+	}
+	t, games, err := s.updateTournament(g.Tournament, func(t *tournament.Tournament) error {
+		return t.Report(g.ID, g.MatchWinner)
+	})
+	if errors.Is(err, tournament.ErrUnknownMatch) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.startMatches(t, games)
+}
+
+// scheduleMatches creates a game for every match of the current round which doesn't have one yet,
+// seating the players at the connections they registered from. The games aren't stored here.
+func scheduleMatches(t *tournament.Tournament) ([]*game.Game, error) {
+	games := []*game.Game{}
+	for _, p := range t.Unscheduled() {
+		g := game.NewGame()
+		g.Ruleset = t.Ruleset
+		g.Format = t.Match
+		g.RoundTimeout = t.RoundTimeout
+		g.MaxMisses = t.MaxMisses
+		g.Tournament = t.ID
+		for _, id := range []string{p.A, p.B} {
+			e := t.Entrant(id)
+			gc, err := game.NewGameContext(e.UserID, e.ConnectionID, g)
+			if err != nil {
+				return nil, err
+			}
+			gc.ActingPlayer.Protocol = e.Protocol
+		}
+		p.GameID = g.ID
+		games = append(games, g)
+	}
+	return games, nil
+}
+
+// startMatches sends the games of a newly scheduled round to their players, then tells everyone
+// registered how the tournament stands
+func (s *LambdaSvc) startMatches(t *tournament.Tournament, games []*game.Game) error {
+	for _, g := range games {
+		s.announceMatch(g)
+	}
+	s.sendStandings(t)
+	return nil
+}
+
+// sendStandings sends the tournament to every registered player
+func (s *LambdaSvc) sendStandings(t *tournament.Tournament) {
+	tm := tournamentView(t)
+	for _, e := range t.Entrants {
+		s.send(e.ConnectionID, e.Protocol, protocol.TYPE_TOURNAMENT, tm)
+	}
+}
+
+// tournamentView builds the description of a tournament sent to players
+func tournamentView(t *tournament.Tournament) TournamentMessage {
+	tm := TournamentMessage{
+		TournamentID: t.ID,
+		Name:         t.Name,
+		Organizer:    t.Organizer,
+		Format:       t.Format,
+		State:        t.State,
+		Round:        t.Round,
+		Rounds:       t.Rounds,
+		Ruleset:      t.Ruleset,
+		MatchFormat:  t.Match.Mode,
+		MatchLength:  t.Match.Length,
+		Standings:    []TournamentStanding{},
+		Pairings:     []TournamentPairing{},
+		Winner:       t.Winner,
+	}
+	for _, st := range t.Standings() {
+		tm.Standings = append(tm.Standings, TournamentStanding{
+			Rank:       st.Rank,
+			UserID:     st.UserID,
+			Points:     st.Points,
+			Wins:       st.Wins,
+			Losses:     st.Losses,
+			Ties:       st.Ties,
+			Byes:       st.Byes,
+			Eliminated: st.Eliminated,
+		})
+	}
+	for _, p := range t.Pairings {
+		tp := TournamentPairing{Round: p.Round, Players: []string{p.A}, GameID: p.GameID, Winner: p.Winner}
+		if !p.Bye() {
+			tp.Players = append(tp.Players, p.B)
+		}
+		tm.Pairings = append(tm.Pairings, tp)
+	}
+	return tm
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jbarratt/rpsls/backend/code/notify"
+	"github.com/jbarratt/rpsls/backend/code/protocol"
+	"github.com/jbarratt/rpsls/backend/code/store"
+	"github.com/jbarratt/rpsls/backend/code/tournament"
+)
+
+// lastTournament decodes the newest tournament message sent to a connection
+func lastTournament(t *testing.T, rec *notify.Recorder, connectionID string) TournamentMessage {
+	t.Helper()
+	msgs := rec.To(connectionID)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		env, err := protocol.Decode([]byte(msgs[i]))
+		if err == nil && env.Type == protocol.TYPE_TOURNAMENT {
+			tm := TournamentMessage{}
+			json.Unmarshal(env.Data, &tm)
+			return tm
+		}
+	}
+	t.Fatalf("no tournament message sent to %s: %v", connectionID, msgs)
+	return TournamentMessage{}
+}
+
+// currentMatch returns the game of a player's match in the tournament's current round
+func currentMatch(t *testing.T, tm TournamentMessage, userID string) string {
+	t.Helper()
+	for _, p := range tm.Pairings {
+		if p.Round == tm.Round && p.GameID != "" && (p.Players[0] == userID || p.Players[1] == userID) {
+			return p.GameID
+		}
+	}
+	t.Fatalf("%s has no match in round %d: %+v", userID, tm.Round, tm.Pairings)
+	return ""
+}
+
+func TestTournament(t *testing.T) {
+	s, _, rec := testSvc()
+
+	send(t, s, "conn1", PlayerMessage{Action: "createTournament", UID: "p1", Name: "cup", MatchFormat: "bestof", MatchLength: 1})
+	tm := lastTournament(t, rec, "conn1")
+	if tm.State != tournament.STATE_REGISTERING || tm.Format != tournament.FORMAT_SINGLE_ELIMINATION || tm.Organizer != "p1" {
+		t.Fatalf("expected a single elimination tournament open for registration: %+v", tm)
+	}
+	id := tm.TournamentID
+
+	send(t, s, "conn1", PlayerMessage{Action: "startTournament", UID: "p1", TournamentID: id})
+	if code := lastError(t, rec, "conn1").Code; code != protocol.CODE_NOT_ENOUGH_PLAYERS {
+		t.Errorf("starting without players should fail with NOT_ENOUGH_PLAYERS, got %s", code)
+	}
+	for i := 1; i <= 3; i++ {
+		send(t, s, fmt.Sprintf("conn%d", i), PlayerMessage{Action: "registerTournament", UID: fmt.Sprintf("p%d", i), TournamentID: id})
+	}
+	if tm := lastTournament(t, rec, "conn1"); len(tm.Standings) != 3 {
+		t.Errorf("registered players should be told about each registration: %+v", tm)
+	}
+
+	send(t, s, "conn2", PlayerMessage{Action: "startTournament", UID: "p2", TournamentID: id})
+	if code := lastError(t, rec, "conn2").Code; code != protocol.CODE_BAD_REQUEST {
+		t.Errorf("only the organizer should be able to start, got %s", code)
+	}
+	rec.Reset()
+	send(t, s, "conn1", PlayerMessage{Action: "startTournament", UID: "p1", TournamentID: id})
+	tm = lastTournament(t, rec, "conn2")
+	if tm.State != tournament.STATE_RUNNING || tm.Round != 1 || tm.Rounds != 2 || len(tm.Pairings) != 2 {
+		t.Fatalf("expected the first of two rounds to start: %+v", tm)
+	}
+	// the top seed has a bye, so only p2 and p3 get a game
+	if len(rec.To("conn1")) != 1 || len(rec.To("conn2")) != 3 {
+		t.Errorf("p2 should be matched, get the game and the standings, p1 just the standings: %v %v", rec.To("conn1"), rec.To("conn2"))
+	}
+	send(t, s, "conn4", PlayerMessage{Action: "registerTournament", UID: "p4", TournamentID: id})
+	if code := lastError(t, rec, "conn4").Code; code != protocol.CODE_REGISTRATION_CLOSED {
+		t.Errorf("registering after the start should fail with REGISTRATION_CLOSED, got %s", code)
+	}
+
+	gameID := currentMatch(t, tm, "p2")
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "rock", Round: 1})
+	send(t, s, "conn3", PlayerMessage{Action: "play", UID: "p3", GameID: gameID, Play: "scissors", Round: 1})
+	tm = lastTournament(t, rec, "conn1")
+	if tm.Round != 2 {
+		t.Fatalf("the winner should advance to the final: %+v", tm)
+	}
+
+	gameID = currentMatch(t, tm, "p1")
+	send(t, s, "conn1", PlayerMessage{Action: "play", UID: "p1", GameID: gameID, Play: "paper", Round: 1})
+	send(t, s, "conn2", PlayerMessage{Action: "play", UID: "p2", GameID: gameID, Play: "rock", Round: 1})
+	tm = lastTournament(t, rec, "conn3")
+	if tm.State != tournament.STATE_FINISHED || tm.Winner != "p1" || tm.Standings[0].UserID != "p1" {
+		t.Errorf("p1 should have won the tournament: %+v", tm)
+	}
+
+	rec.Reset()
+	send(t, s, "conn5", PlayerMessage{Action: "tournament", UID: "p5", TournamentID: id})
+	if tm := lastTournament(t, rec, "conn5"); tm.Winner != "p1" || len(tm.Pairings) != 3 {
+		t.Errorf("anyone should be able to view the tournament: %+v", tm)
+	}
+	send(t, s, "conn5", PlayerMessage{Action: "tournament", UID: "p5", TournamentID: "NOPE"})
+	if code := lastError(t, rec, "conn5").Code; code != protocol.CODE_TOURNAMENT_NOT_FOUND {
+		t.Errorf("expected TOURNAMENT_NOT_FOUND, got %s", code)
+	}
+}
+
+// racedTournaments is a store which checks that every game a tournament points at exists when
+// the tournament is stored, and fails the next store as stale while race is set
+type racedTournaments struct {
+	*storedGames
+	t    *testing.T
+	race bool
+}
+
+func (rt *racedTournaments) StoreTournament(tt *tournament.Tournament) error {
+	for _, p := range tt.Pairings {
+		if _, err := rt.Load(p.GameID); p.GameID != "" && err != nil {
+			rt.t.Errorf("tournament stored before its game %s", p.GameID)
+		}
+	}
+	if rt.race {
+		rt.race = false
+		return store.ErrStaleTournament
+	}
+	return rt.Memory.StoreTournament(tt)
+}
+
+func TestTournamentGamesStoredFirst(t *testing.T) {
+	st := &racedTournaments{storedGames: &storedGames{Memory: store.NewMemory()}, t: t}
+	rec := &notify.Recorder{}
+	s := NewLambdaSvc(st, rec)
+
+	send(t, s, "conn1", PlayerMessage{Action: "createTournament", UID: "p1", Name: "cup"})
+	id := lastTournament(t, rec, "conn1").TournamentID
+	for i := 1; i <= 2; i++ {
+		send(t, s, fmt.Sprintf("conn%d", i), PlayerMessage{Action: "registerTournament", UID: fmt.Sprintf("p%d", i), TournamentID: id})
+	}
+
+	// someone else changes the tournament while it starts, so the first schedule is thrown away
+	st.race = true
+	send(t, s, "conn1", PlayerMessage{Action: "startTournament", UID: "p1", TournamentID: id})
+	gameID := currentMatch(t, lastTournament(t, rec, "conn1"), "p1")
+	if len(st.ids) != 2 || st.ids[1] != gameID {
+		t.Fatalf("the match should be scheduled again after the race: %v %s", st.ids, gameID)
+	}
+	if _, err := st.Load(st.ids[0]); !errors.Is(err, store.ErrGameNotFound) {
+		t.Errorf("the game of the lost update should be deleted: %v", err)
+	}
+	for _, msg := range rec.To("conn2") {
+		if strings.Contains(msg, st.ids[0]) {
+			t.Errorf("players should only hear about the game which counts: %s", msg)
+		}
+	}
+}
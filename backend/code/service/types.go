@@ -1,22 +1,32 @@
 package service
 
-// GameState structures for sending to players. Fields are optional especially on setup
-type GameState struct {
-	Round        int    `json:"round"`
-	GameID       string `json:"gameId"`
-	YourScore    int    `json:"yourScore"`
-	TheirScore   int    `json:"theirScore"`
-	Winner       bool   `json:"winner"`
-	YourPlay     string `json:"yourPlay,omitempty"`
-	TheirPlay    string `json:"theirPlay,omitempty"`
-	RoundSummary string `json:"roundSummary,omitempty"`
-}
+import "github.com/jbarratt/rpsls/backend/code/protocol"
 
-// PlayerMessage are what we get from the players
-type PlayerMessage struct {
-	Action string `json:"action"`
-	UID    string `json:"userId"`
-	GameID string `json:"gameId"`
-	Play   string `json:"play"`
-	Round  int    `json:"round"`
-}
+// The message types live in the protocol package, so Go clients can share them.
+// These aliases keep the service's existing names.
+type (
+	GameState          = protocol.GameState
+	OpponentState      = protocol.OpponentState
+	PlayerMessage      = protocol.PlayerMessage
+	PresenceMessage    = protocol.PresenceMessage
+	ErrorMessage       = protocol.ErrorMessage
+	HistoryMessage     = protocol.HistoryMessage
+	RoundRecord        = protocol.RoundRecord
+	MatchOverMessage   = protocol.MatchOverMessage
+	StatsMessage       = protocol.StatsMessage
+	LeaderboardMessage = protocol.LeaderboardMessage
+	LeaderboardEntry   = protocol.LeaderboardEntry
+	QueueMessage       = protocol.QueueMessage
+	MatchedMessage     = protocol.MatchedMessage
+	ChatMessage        = protocol.ChatMessage
+	RematchMessage     = protocol.RematchMessage
+	TournamentMessage  = protocol.TournamentMessage
+	TournamentStanding = protocol.TournamentStanding
+	TournamentPairing  = protocol.TournamentPairing
+)
+
+// Presence statuses
+const (
+	PRESENCE_DISCONNECTED = protocol.PRESENCE_DISCONNECTED
+	PRESENCE_RECONNECTED  = protocol.PRESENCE_RECONNECTED
+)
@@ -2,13 +2,21 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/jbarratt/rpsls/backend/code/bot"
 	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/rating"
+	"github.com/jbarratt/rpsls/backend/code/tournament"
 )
 
 // GameItem is for game status items
@@ -20,26 +28,286 @@ type GameItem struct {
 	Plays   int
 	Players map[string]PlayerItem
 	GameID  string
+	Ruleset string
+	// MatchFormat and MatchLength are the game's MatchFormat
+	MatchFormat string
+	MatchLength int
+	MatchOver   bool
+	MatchWinner string
+	MaxPlayers  int
+	Scoring     string
+	FairPlay    bool
+	Reveals     int
+	// RoundTimeout and MaxMisses are the game's clock settings
+	RoundTimeout int
+	MaxMisses    int
+	// Deadline is left out while the clock isn't running, so the first play can start it
+	Deadline int64 `dynamodbav:",omitempty"`
+	// Series and NextGame link rematches together
+	Series   string `dynamodbav:",omitempty"`
+	NextGame string `dynamodbav:",omitempty"`
+	// Tournament is set on tournament matches, whose results advance the tournament
+	Tournament string `dynamodbav:",omitempty"`
+	// Spectators is indexed by connection id
+	Spectators map[string]SpectatorItem
+	// Version is the game's Version, which round resolution is conditional on
+	Version int
 	Expires int64
 }
 
+// SpectatorItem is a connection watching a game
+type SpectatorItem struct {
+	Address  string
+	Protocol int
+}
+
+// RoundItem records a single resolved round, stored under the game's partition key
+type RoundItem struct {
+	PK       string
+	SK       string
+	Type     string
+	GameID   string
+	Round    int
+	Plays    map[string]string
+	Winner   string
+	Winners  []string
+	Summary  string
+	Forfeits []string
+	Expires  int64
+}
+
 type PlayerItem struct {
-	ID      string
-	Address string
-	Play    string
-	Round   int
-	Score   int
+	ID          string
+	Address     string
+	Play        string
+	Round       int
+	Score       int
+	Commitment  string
+	RevealRound int
+	Forfeit     bool
+	Misses      int
+	Offline     bool
+	Pending     string
+	Protocol    int
+	Rematch     bool
+}
+
+// StatsItem holds a player's lifetime statistics, under PLAYER#<userId>
+type StatsItem struct {
+	PK          string
+	SK          string
+	Type        string
+	UserID      string
+	Games       int
+	MatchesWon  int
+	MatchesLost int
+	MatchesTied int
+	RoundsWon   int
+	RoundsLost  int
+	RoundsTied  int
+	Moves       map[string]int
+	// Board is set to LEADERBOARD once the player is rated, which puts them in the Leaderboard index
+	Board      string  `dynamodbav:",omitempty"`
+	Rating     float64 `dynamodbav:",omitempty"`
+	Deviation  float64 `dynamodbav:",omitempty"`
+	Volatility float64 `dynamodbav:",omitempty"`
+}
+
+// Ranking is a player's place on the leaderboard
+type Ranking struct {
+	// Rank is 1 for the best player, and shared by players with the same rating
+	Rank   int
+	UserID string
+	Rating rating.Rating
+}
+
+const (
+	// LEADERBOARD is the Board of every rated player
+	LEADERBOARD = "RATED"
+	// leaderboardIndex is the global secondary index on Board, sorted by Rating
+	leaderboardIndex = "Leaderboard"
+)
+
+// ConnectionItem indexes a connection to the game and user it last joined as.
+// The game it spectates, if any, is another ConnectionItem under the same PK with the SK SPECTATING,
+// so watching a game never loses track of the one the connection plays in.
+type ConnectionItem struct {
+	PK      string
+	SK      string
+	Type    string
+	GameID  string
+	UserID  string
+	Expires int64
+}
+
+// SeriesItem holds the running total of a series of rematches, under SERIES#<seriesId>
+type SeriesItem struct {
+	PK       string
+	SK       string
+	Type     string
+	SeriesID string
+	Matches  int
+	Wins     map[string]int
+	Ties     int
+	Expires  int64
+}
+
+// TournamentItem holds a whole tournament, under TOURNAMENT#<tournamentId>. Its Version is
+// checked on every write, so concurrent updates can't overwrite each other.
+type TournamentItem struct {
+	PK   string
+	SK   string
+	Type string
+	tournament.Tournament
+	Expires int64
+}
+
+// RequestItem records a request a player sent with a requestId, under PLAYER#<userId> with a
+// REQUEST#<requestId> sort key, so a retry of it gets the same outcome instead of running again
+type RequestItem struct {
+	PK        string
+	SK        string
+	Type      string
+	UserID    string
+	RequestID string
+	// Done is set once the request has been handled, until then it is still running
+	Done bool
+	// Replies are the messages sent back to the connection the request came from, in order
+	Replies []string
+	// ErrorCode and ErrorMessage are what the player was told if the request failed
+	ErrorCode    string `dynamodbav:",omitempty"`
+	ErrorMessage string `dynamodbav:",omitempty"`
+	Expires      int64
+}
+
+// ChatItem is a chat message kept with a game, under the game's partition key
+type ChatItem struct {
+	PK     string
+	SK     string
+	Type   string
+	GameID string
+	UserID string
+	Text   string `dynamodbav:",omitempty"`
+	Emote  string `dynamodbav:",omitempty"`
+	// Sent is when the message was sent, in unix milliseconds
+	Sent    int64
+	Expires int64
+}
+
+// ChatLimitItem counts a player's chat messages in the current rate limit window
+type ChatLimitItem struct {
+	PK      string
+	SK      string
+	Window  int64
+	Count   int
+	Expires int64
+}
+
+// QueueEntry is a player waiting in the matchmaking queue
+type QueueEntry struct {
+	UserID       string
+	ConnectionID string
+	Ruleset      string
+	// Rating is the player's rating when they joined the queue
+	Rating float64
+	// Band is how far from Rating an opponent can be rated when the player joins, 0 for anyone
+	Band int
+	// Joined is when the player joined the queue, in unix seconds
+	Joined   int64
+	Protocol int
+}
+
+// QueueItem holds a QueueEntry. The whole queue shares PK QUEUE, with a USER#<userId> SK per player.
+type QueueItem struct {
+	PK   string
+	SK   string
+	Type string
+	QueueEntry
+	Expires int64
 }
 
+// QUEUE_EXPIRY is how many seconds a player waits in the matchmaking queue before they're dropped
+const QUEUE_EXPIRY = 600
+
+// REQUEST_TTL is how many seconds the outcome of a request is kept for retries of it
+const REQUEST_TTL = 3600
+
+// REQUEST_TIMEOUT is how many seconds a request can run for. A retry after that runs the request
+// again, as whatever was handling it must have given up.
+const REQUEST_TIMEOUT = 30
+
 // GameStore interface declares the
 type GameStore interface {
 	Load(string) (*game.Game, error)
+	LoadConsistent(string) (*game.Game, error)
 	StoreAll(*game.Game) error
+	DeleteGame(gameID string) error
 	StoreRound(*game.Game) error
 	StorePlay(*game.GameContext) error
 	StorePlayer(*game.GameContext) error
+	ClaimSeat(*game.GameContext) error
+	StoreCommit(*game.GameContext) error
+	StoreReveal(*game.GameContext) error
+	History(string) ([]game.RoundResult, error)
+	ExpiredGames(int64) ([]string, error)
+	StoreConnection(connectionID, gameID, userID string) error
+	LookupConnection(connectionID string) (gameID, userID string, err error)
+	DeleteConnection(connectionID string) error
+	StoreSpectating(connectionID, gameID string) error
+	LookupSpectating(connectionID string) (gameID string, err error)
+	StoreOffline(g *game.Game, userID, connectionID string) error
+	StorePending(gameID, userID, connectionID, pending string) error
+	Stats(userID string) (game.Stats, error)
+	Rating(userID string) (rating.Rating, error)
+	StoreRating(userID string, r rating.Rating) error
+	Leaderboard(n int) ([]Ranking, error)
+	Rank(userID string) (int, error)
+	Enqueue(e QueueEntry) error
+	Waiting(now int64) ([]QueueEntry, error)
+	Dequeue(userID, connectionID string) error
+	StoreSpectator(gameID, connectionID string, protocol int) error
+	RemoveSpectator(gameID, connectionID string) error
+	LimitChat(gameID, userID string, window int64, limit int) error
+	StoreChat(c *ChatItem) error
+	RecentChat(gameID string, n int) ([]ChatItem, error)
+	StoreRematch(g *game.Game, userID string, want bool) error
+	LinkRematch(gameID, nextGameID string) error
+	AddSeriesResult(seriesID, winner string) error
+	Series(seriesID string) (game.Series, error)
+	LoadTournament(tournamentID string) (*tournament.Tournament, error)
+	StoreTournament(t *tournament.Tournament) error
+	BeginRequest(userID, requestID string, now int64) (*RequestItem, error)
+	FinishRequest(r *RequestItem, now int64) error
+	ForgetRequest(userID, requestID string) error
 }
 
+var (
+	// ErrGameNotFound is returned when loading a game which doesn't exist, or has expired
+	ErrGameNotFound = errors.New("no such game")
+	// ErrStaleRound is returned when a play, commit, reveal or resolved round no longer fits the stored game,
+	// usually because the round moved on or the player already acted in it
+	ErrStaleRound = errors.New("round has moved on")
+	// ErrNoConnection is returned when looking up a connection which never joined a game
+	ErrNoConnection = errors.New("no game for connection")
+	// ErrNotQueued is returned when taking a player out of the matchmaking queue who isn't in it,
+	// e.g. because someone else was matched with them first
+	ErrNotQueued = errors.New("player is not queued")
+	// ErrChatLimited is returned when a player has sent as many chat messages as they can for now
+	ErrChatLimited = errors.New("too many chat messages")
+	// ErrRematchStarted is returned when changing a finished game's rematch after it was created
+	ErrRematchStarted = errors.New("rematch already started")
+	// ErrNotAPlayer is returned when answering a rematch of a game the player wasn't in
+	ErrNotAPlayer = errors.New("not a player in the game")
+	// ErrTournamentNotFound is returned when loading a tournament which doesn't exist, or has expired
+	ErrTournamentNotFound = errors.New("no such tournament")
+	// ErrStaleTournament is returned when storing a tournament which changed since it was loaded
+	ErrStaleTournament = errors.New("tournament has changed")
+	// ErrDuplicateRequest is returned when beginning a request the player already sent recently
+	ErrDuplicateRequest = errors.New("request already received")
+	// ErrAlreadySeated is returned when claiming a seat for a player who has one, e.g. from joining twice at once
+	ErrAlreadySeated = errors.New("player already has a seat")
+)
+
 // Store stores the dynamo client and other metadata needed, like the table
 type Store struct {
 	d         *dynamodb.DynamoDB
@@ -56,11 +324,21 @@ func New(d *dynamodb.DynamoDB, tableName string) *Store {
 
 // Load returns a populated game based on a gameID, or error if no game exists
 func (s *Store) Load(gameID string) (*game.Game, error) {
+	return s.load(gameID, false)
+}
+
+// LoadConsistent is Load, but sure to see every write made before it
+func (s *Store) LoadConsistent(gameID string) (*game.Game, error) {
+	return s.load(gameID, true)
+}
+
+func (s *Store) load(gameID string, consistent bool) (*game.Game, error) {
 
 	gi := GameItem{}
 
 	input := &dynamodb.GetItemInput{
-		TableName: aws.String(s.tableName),
+		TableName:      aws.String(s.tableName),
+		ConsistentRead: aws.Bool(consistent),
 		Key: map[string]*dynamodb.AttributeValue{
 			"PK": {
 				S: aws.String(fmt.Sprintf("GAME#%s", gameID)),
@@ -76,6 +354,9 @@ func (s *Store) Load(gameID string) (*game.Game, error) {
 		fmt.Println(err.Error())
 		return nil, err
 	}
+	if len(result.Item) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
 	err = dynamodbattribute.UnmarshalMap(result.Item, &gi)
 	if err != nil {
 		fmt.Println("Error reading game record")
@@ -91,6 +372,23 @@ func UpdateGameFromItem(g *game.Game, gi *GameItem) {
 	g.ID = gi.GameID
 	g.Round = gi.Round
 	g.PlayCount = gi.Plays
+	if gi.Ruleset != "" {
+		g.Ruleset = gi.Ruleset
+	}
+	g.Format = game.MatchFormat{Mode: gi.MatchFormat, Length: gi.MatchLength}
+	g.MatchOver = gi.MatchOver
+	g.MatchWinner = gi.MatchWinner
+	g.MaxPlayers = gi.MaxPlayers
+	g.Scoring = gi.Scoring
+	g.FairPlay = gi.FairPlay
+	g.RevealCount = gi.Reveals
+	g.RoundTimeout = gi.RoundTimeout
+	g.MaxMisses = gi.MaxMisses
+	g.Deadline = gi.Deadline
+	g.Series = gi.Series
+	g.NextGame = gi.NextGame
+	g.Tournament = gi.Tournament
+	g.Version = gi.Version
 	for id, p := range gi.Players {
 		// Check to see if this game already has that player
 		gp, found := g.Players[id]
@@ -100,16 +398,36 @@ func UpdateGameFromItem(g *game.Game, gi *GameItem) {
 			gp.Play = p.Play
 			gp.Round = p.Round
 			gp.Score = p.Score
+			gp.Commitment = p.Commitment
+			gp.RevealRound = p.RevealRound
+			gp.Forfeit = p.Forfeit
+			gp.Misses = p.Misses
+			gp.Offline = p.Offline
+			gp.Pending = p.Pending
+			gp.Protocol = p.Protocol
+			gp.Rematch = p.Rematch
 		} else {
 			// Need to add a player for this game entry
 			g.Players[id] = &game.Player{
-				ID:      id,
-				Address: p.Address,
-				Round:   p.Round,
-				Score:   p.Score,
-				Play:    p.Play}
+				ID:          id,
+				Address:     p.Address,
+				Round:       p.Round,
+				Score:       p.Score,
+				Play:        p.Play,
+				Commitment:  p.Commitment,
+				RevealRound: p.RevealRound,
+				Forfeit:     p.Forfeit,
+				Misses:      p.Misses,
+				Offline:     p.Offline,
+				Pending:     p.Pending,
+				Protocol:    p.Protocol,
+				Rematch:     p.Rematch}
 		}
 	}
+	g.Spectators = make(map[string]*game.Spectator, len(gi.Spectators))
+	for address, sp := range gi.Spectators {
+		g.Spectators[address] = &game.Spectator{Address: sp.Address, Protocol: sp.Protocol}
+	}
 }
 
 // UpdateItemFromGame updates a dynamo game item from the game struct
@@ -117,6 +435,22 @@ func UpdateItemFromGame(gi *GameItem, g *game.Game) {
 	gi.GameID = g.ID
 	gi.Round = g.Round
 	gi.Plays = g.PlayCount
+	gi.Ruleset = g.Ruleset
+	gi.MatchFormat = g.Format.Mode
+	gi.MatchLength = g.Format.Length
+	gi.MatchOver = g.MatchOver
+	gi.MatchWinner = g.MatchWinner
+	gi.MaxPlayers = g.MaxPlayers
+	gi.Scoring = g.Scoring
+	gi.FairPlay = g.FairPlay
+	gi.Reveals = g.RevealCount
+	gi.RoundTimeout = g.RoundTimeout
+	gi.MaxMisses = g.MaxMisses
+	gi.Deadline = g.Deadline
+	gi.Series = g.Series
+	gi.NextGame = g.NextGame
+	gi.Tournament = g.Tournament
+	gi.Version = g.Version
 	for id, gp := range g.Players {
 		// Check to see if this GameItem already has that player
 		gip, found := gi.Players[id]
@@ -126,17 +460,71 @@ func UpdateItemFromGame(gi *GameItem, g *game.Game) {
 			gip.Play = gp.Play
 			gip.Round = gp.Round
 			gip.Score = gp.Score
+			gip.Commitment = gp.Commitment
+			gip.RevealRound = gp.RevealRound
+			gip.Forfeit = gp.Forfeit
+			gip.Misses = gp.Misses
+			gip.Offline = gp.Offline
+			gip.Pending = gp.Pending
+			gip.Protocol = gp.Protocol
+			gip.Rematch = gp.Rematch
+			gi.Players[id] = gip
 		} else {
 			// Need to add a player for this game entry
 			gi.Players[id] = PlayerItem{
-				ID:      id,
-				Address: gp.Address,
-				Round:   gp.Round,
-				Play:    gp.Play,
-				Score:   gp.Score,
+				ID:          id,
+				Address:     gp.Address,
+				Round:       gp.Round,
+				Play:        gp.Play,
+				Score:       gp.Score,
+				Commitment:  gp.Commitment,
+				RevealRound: gp.RevealRound,
+				Forfeit:     gp.Forfeit,
+				Misses:      gp.Misses,
+				Offline:     gp.Offline,
+				Pending:     gp.Pending,
+				Protocol:    gp.Protocol,
+				Rematch:     gp.Rematch,
 			}
 		}
 	}
+	gi.Spectators = make(map[string]SpectatorItem, len(g.Spectators))
+	for address, sp := range g.Spectators {
+		gi.Spectators[address] = SpectatorItem{Address: sp.Address, Protocol: sp.Protocol}
+	}
+}
+
+// roundKey is the sort key of a round history item, padded so rounds sort in order
+func roundKey(round int) string {
+	return fmt.Sprintf("ROUND#%04d", round)
+}
+
+// RoundItemFromResult builds the history item for a resolved round
+func RoundItemFromResult(gameID string, r *game.RoundResult) *RoundItem {
+	return &RoundItem{
+		PK:       fmt.Sprintf("GAME#%s", gameID),
+		SK:       roundKey(r.Round),
+		Type:     "RoundItem",
+		GameID:   gameID,
+		Round:    r.Round,
+		Plays:    r.Plays,
+		Winner:   r.Winner,
+		Winners:  r.Winners,
+		Summary:  r.Summary,
+		Forfeits: r.Forfeits,
+	}
+}
+
+// ResultFromRoundItem converts a history item back to a RoundResult
+func ResultFromRoundItem(ri *RoundItem) game.RoundResult {
+	return game.RoundResult{
+		Round:    ri.Round,
+		Plays:    ri.Plays,
+		Winner:   ri.Winner,
+		Winners:  ri.Winners,
+		Summary:  ri.Summary,
+		Forfeits: ri.Forfeits,
+	}
 }
 
 // StoreAll takes a Game and persists the entire thing
@@ -176,6 +564,19 @@ func (s *Store) StoreAll(g *game.Game) error {
 	return nil
 }
 
+// DeleteGame removes a game which was stored but never started, e.g. one which lost a race to be linked
+func (s *Store) DeleteGame(gameID string) error {
+	_, err := s.d.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       gameKey(gameID),
+	})
+	if err != nil {
+		fmt.Printf("Error deleting game: %s\n", err)
+		return err
+	}
+	return nil
+}
+
 // StorePlay takes a GameContext and stores the bits needed if a play has been made
 // It updates the Game with the current status as well
 func (s *Store) StorePlay(gc *game.GameContext) error {
@@ -190,6 +591,9 @@ func (s *Store) StorePlay(gc *game.GameContext) error {
 			":round": {
 				N: aws.String(fmt.Sprintf("%d", gc.Game.Round)),
 			},
+			":false": {
+				BOOL: aws.Bool(false),
+			},
 		},
 		ExpressionAttributeNames: map[string]*string{
 			"#pxid":  aws.String(gc.ActingPlayer.ID),
@@ -204,15 +608,57 @@ func (s *Store) StorePlay(gc *game.GameContext) error {
 				S: aws.String(fmt.Sprintf("GAME#%s", gc.Game.ID)),
 			},
 		},
-		ConditionExpression: aws.String(fmt.Sprintf("#round = :round and Players.#pxid.Round < :round")),
-		UpdateExpression:    aws.String(fmt.Sprintf("SET Plays = Plays + :count, Players.#pxid.Play = :play, Players.#pxid.Round = :round")),
-		ReturnValues:        aws.String("ALL_NEW"),
+		// games stored before match formats existed have no MatchOver at all
+		ConditionExpression: aws.String("#round = :round and Players.#pxid.Round < :round and (attribute_not_exists(MatchOver) or MatchOver = :false)"),
+		UpdateExpression:    aws.String("ADD Version :count SET Plays = Plays + :count, Players.#pxid.Play = :play, Players.#pxid.Round = :round"),
 	}
+	startClock(gc.Game, input)
 
-	result, err := s.d.UpdateItem(input)
+	err := s.updateAndRefresh(gc.Game, input)
 	if err != nil {
 		fmt.Printf("got an error storing a dynamo play\n")
 		fmt.Println(err.Error())
+		return staleRound(err)
+	}
+	return nil
+}
+
+// gameKey returns the primary key of a game's GameItem
+func gameKey(gameID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("GAME#%s", gameID)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("GAME#%s", gameID)),
+		},
+	}
+}
+
+// startClock adds the game's deadline to a play or commit update, unless another play already started the clock
+func startClock(g *game.Game, input *dynamodb.UpdateItemInput) {
+	if g.Deadline == 0 {
+		return
+	}
+	input.ExpressionAttributeValues[":deadline"] = &dynamodb.AttributeValue{
+		N: aws.String(fmt.Sprintf("%d", g.Deadline)),
+	}
+	input.UpdateExpression = aws.String(*input.UpdateExpression + ", Deadline = if_not_exists(Deadline, :deadline)")
+}
+
+// staleRound turns a failed condition on a round update into ErrStaleRound
+func staleRound(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return fmt.Errorf("%w: %s", ErrStaleRound, aerr.Message())
+	}
+	return err
+}
+
+// updateAndRefresh runs an update which returns ALL_NEW values, and copies them into the game
+func (s *Store) updateAndRefresh(g *game.Game, input *dynamodb.UpdateItemInput) error {
+	input.ReturnValues = aws.String("ALL_NEW")
+	result, err := s.d.UpdateItem(input)
+	if err != nil {
 		return err
 	}
 
@@ -220,17 +666,127 @@ func (s *Store) StorePlay(gc *game.GameContext) error {
 	err = dynamodbattribute.UnmarshalMap(result.Attributes, &item)
 	if err != nil {
 		fmt.Println("unmarshal error: unable to retrieve game values")
-		fmt.Printf(err.Error())
 		return err
 	}
-	UpdateGameFromItem(gc.Game, &item)
+	UpdateGameFromItem(g, &item)
+	return nil
+}
+
+// StoreCommit stores the acting player's commitment in a fair play game.
+// Like StorePlay, it only succeeds once per player per round.
+func (s *Store) StoreCommit(gc *game.GameContext) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":commitment": {
+				S: aws.String(gc.ActingPlayer.Commitment),
+			},
+			":count": {
+				N: aws.String("1"),
+			},
+			":round": {
+				N: aws.String(fmt.Sprintf("%d", gc.Game.Round)),
+			},
+			":false": {
+				BOOL: aws.Bool(false),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#pxid":  aws.String(gc.ActingPlayer.ID),
+			"#round": aws.String("Round"),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gc.Game.ID),
+		ConditionExpression: aws.String("#round = :round and Players.#pxid.Round < :round and (attribute_not_exists(MatchOver) or MatchOver = :false)"),
+		UpdateExpression:    aws.String("ADD Version :count SET Plays = Plays + :count, Players.#pxid.Commitment = :commitment, Players.#pxid.Round = :round, Players.#pxid.Forfeit = :false"),
+	}
+	startClock(gc.Game, input)
+
+	err := s.updateAndRefresh(gc.Game, input)
+	if err != nil {
+		fmt.Printf("got an error storing a commitment: %s\n", err)
+		return staleRound(err)
+	}
+	return nil
+}
+
+// StoreReveal stores the acting player's revealed play (or forfeit) in a fair play game.
+// It only succeeds once every player has committed, and once per player per round.
+func (s *Store) StoreReveal(gc *game.GameContext) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":play": {
+				S: aws.String(gc.ActingPlayer.Play),
+			},
+			":forfeit": {
+				BOOL: aws.Bool(gc.ActingPlayer.Forfeit),
+			},
+			":count": {
+				N: aws.String("1"),
+			},
+			":players": {
+				N: aws.String(fmt.Sprintf("%d", len(gc.Game.Players))),
+			},
+			":round": {
+				N: aws.String(fmt.Sprintf("%d", gc.Game.Round)),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#pxid":  aws.String(gc.ActingPlayer.ID),
+			"#round": aws.String("Round"),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gc.Game.ID),
+		ConditionExpression: aws.String("#round = :round and Plays = :players and Players.#pxid.Round = :round and Players.#pxid.RevealRound < :round"),
+		UpdateExpression:    aws.String("ADD Version :count SET Reveals = Reveals + :count, Players.#pxid.Play = :play, Players.#pxid.RevealRound = :round, Players.#pxid.Forfeit = :forfeit"),
+	}
 
+	err := s.updateAndRefresh(gc.Game, input)
+	if err != nil {
+		fmt.Printf("got an error storing a reveal: %s\n", err)
+		return staleRound(err)
+	}
 	return nil
 }
 
-// StorePlayer takes a GameContext and stores the bits needed for an added player
+// StorePlayer stores the connection details of a seated player, e.g. when they rejoin from a new
+// connection. The rest of the player is round state, which only plays and StoreRound change.
 func (s *Store) StorePlayer(gc *game.GameContext) error {
+	av, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		":address":  gc.ActingPlayer.Address,
+		":offline":  gc.ActingPlayer.Offline,
+		":pending":  gc.ActingPlayer.Pending,
+		":protocol": gc.ActingPlayer.Protocol,
+	})
+	if err != nil {
+		fmt.Printf("Unable to marshal player: %s\n", err)
+		return err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: av,
+		ExpressionAttributeNames: map[string]*string{
+			"#pxid": aws.String(gc.ActingPlayer.ID),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gc.Game.ID),
+		ConditionExpression: aws.String("attribute_exists(Players.#pxid)"),
+		UpdateExpression:    aws.String("SET Players.#pxid.Address = :address, Players.#pxid.Offline = :offline, Players.#pxid.Pending = :pending, Players.#pxid.Protocol = :protocol"),
+	}
+
+	_, err = s.d.UpdateItem(input)
+	if err != nil {
+		fmt.Printf("got an error storing the player's connection: %s\n", err)
+		return err
+	}
+	return nil
+}
 
+// ClaimSeat stores a player joining a game. The seat is only taken if one is still free when the
+// update runs, however many players joined since the game was loaded, and fails with
+// game.ErrGameFull otherwise. A player who got a seat in the meantime, e.g. from joining twice
+// at once, keeps it untouched and ClaimSeat fails with ErrAlreadySeated.
+// It updates the Game with the current status as well
+func (s *Store) ClaimSeat(gc *game.GameContext) error {
 	gi := &GameItem{}
 	gi.Players = make(map[string]PlayerItem)
 	UpdateItemFromGame(gi, gc.Game)
@@ -246,42 +802,1300 @@ func (s *Store) StorePlayer(gc *game.GameContext) error {
 			":player": {
 				M: pv,
 			},
+			":seats": {
+				N: aws.String(fmt.Sprintf("%d", gc.Game.Seats())),
+			},
+			":count": {
+				N: aws.String("1"),
+			},
 		},
 		ExpressionAttributeNames: map[string]*string{
 			"#pxid":    aws.String(gc.ActingPlayer.ID),
 			"#players": aws.String("Players"),
 		},
-		TableName: aws.String(s.tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {
-				S: aws.String(fmt.Sprintf("GAME#%s", gc.Game.ID)),
-			},
-			"SK": {
-				S: aws.String(fmt.Sprintf("GAME#%s", gc.Game.ID)),
-			},
-		},
-		UpdateExpression: aws.String(fmt.Sprintf("SET #players.#pxid = :player")),
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gc.Game.ID),
+		ConditionExpression: aws.String("attribute_not_exists(#players.#pxid) and size(#players) < :seats"),
+		UpdateExpression:    aws.String("ADD Version :count SET #players.#pxid = :player"),
 	}
 
-	_, err = s.d.UpdateItem(input)
+	err = s.updateAndRefresh(gc.Game, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return s.unclaimedSeat(gc)
+	}
 	if err != nil {
-		fmt.Printf("got an error storing the player's ID: %+v\n", input)
-		fmt.Println(err.Error())
+		fmt.Printf("got an error claiming a seat: %s\n", err)
 		return err
 	}
 	return nil
 }
 
-// StoreRound takes a Game and stores the next round
-// For now takes a tiny risk of a race condition updating non-essential data, by uploading the whole
-// item. (e.g. could blow out another player's connection if it changed at the exact wrong time.)
+// unclaimedSeat reads the game back to tell why a seat couldn't be claimed
+func (s *Store) unclaimedSeat(gc *game.GameContext) error {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		Key:            gameKey(gc.Game.ID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		fmt.Printf("got an error reading a full game: %s\n", err)
+		return err
+	}
+	if len(result.Item) == 0 {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gc.Game.ID)
+	}
+	gi := GameItem{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &gi); err != nil {
+		return err
+	}
+	if _, seated := gi.Players[gc.ActingPlayer.ID]; seated {
+		return fmt.Errorf("%w: %s in %s", ErrAlreadySeated, gc.ActingPlayer.ID, gc.Game.ID)
+	}
+	return fmt.Errorf("%w: no seat left in %s", game.ErrGameFull, gc.Game.ID)
+}
+
+// StoreRound takes a Game and stores the next round, along with the history of the one just resolved.
+// Only the round state is written, so connections, spectators and rematch requests which changed in
+// the meantime are kept. The update is conditional on the game's Version: if anything moved the round
+// on since the game was loaded, e.g. another invocation resolving it first, it fails with ErrStaleRound
+// and nothing is recorded, so the caller should load the game to see the result.
+// Once the round is written it stands: failing to record its history or stats is logged, not
+// returned, so the caller still tells the players. Bots don't keep stats.
 func (s *Store) StoreRound(g *game.Game) error {
+	values := map[string]interface{}{
+		":round":   g.Round,
+		":plays":   g.PlayCount,
+		":reveals": g.RevealCount,
+		":over":    g.MatchOver,
+		":winner":  g.MatchWinner,
+		":version": g.Version,
+		":next":    g.Version + 1,
+		":expires": time.Now().Unix() + 2_592_000, // TTL: expire in 30 days
+	}
+	names := map[string]*string{
+		"#round": aws.String("Round"),
+	}
+	set := []string{
+		"#round = :round", "Plays = :plays", "Reveals = :reveals", "MatchOver = :over",
+		"MatchWinner = :winner", "Version = :next", "Expires = :expires",
+	}
+	for i, p := range g.SortedPlayers() {
+		name := fmt.Sprintf("#p%d", i)
+		names[name] = aws.String(p.ID)
+		for _, f := range []struct {
+			attr  string
+			value interface{}
+		}{
+			{"Play", p.Play},
+			{"#round", p.Round},
+			{"Score", p.Score},
+			{"Commitment", p.Commitment},
+			{"RevealRound", p.RevealRound},
+			{"Forfeit", p.Forfeit},
+			{"Misses", p.Misses},
+		} {
+			value := fmt.Sprintf(":p%d%s", i, strings.TrimPrefix(f.attr, "#"))
+			values[value] = f.value
+			set = append(set, fmt.Sprintf("Players.%s.%s = %s", name, f.attr, value))
+		}
+	}
+	update := "SET " + strings.Join(set, ", ")
+	if g.Deadline != 0 {
+		values[":deadline"] = g.Deadline
+		update += ", Deadline = :deadline"
+	} else {
+		update += " REMOVE Deadline"
+	}
+	condition := "Version = :version"
+	if g.Version == 0 {
+		// games stored before versions were added don't have one
+		condition = "(attribute_not_exists(Version) or Version = :version)"
+	}
 
-	// given that the whole record is being stored, this method works
-	err := s.StoreAll(g)
+	av, err := dynamodbattribute.MarshalMap(values)
 	if err != nil {
-		fmt.Printf("Got an error when trying to store a completed round: %s", err)
+		fmt.Printf("Got error marshalling round: %s\n", err)
 		return err
 	}
+	_, err = s.d.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: av,
+		ExpressionAttributeNames:  names,
+		TableName:                 aws.String(s.tableName),
+		Key:                       gameKey(g.ID),
+		ConditionExpression:       aws.String(condition),
+		UpdateExpression:          aws.String(update),
+	})
+	if err != nil {
+		fmt.Printf("Got an error when trying to store a completed round: %s\n", err)
+		return staleRound(err)
+	}
+	g.Version++
+
+	if g.LastResult == nil {
+		return nil
+	}
+	ri := RoundItemFromResult(g.ID, g.LastResult)
+	ri.Expires = time.Now().Unix() + 2_592_000 // TTL: expire along with the game
+	av, err = dynamodbattribute.MarshalMap(ri)
+	if err == nil {
+		_, err = s.d.PutItem(&dynamodb.PutItemInput{
+			Item:      av,
+			TableName: aws.String(s.tableName),
+		})
+	}
+	if err != nil {
+		fmt.Printf("Got an error storing round history for %s: %s\n", g.ID, err)
+	}
+
+	for userID, delta := range g.StatsDelta() {
+		if bot.IsBot(userID) {
+			continue
+		}
+		err = s.addStats(userID, delta)
+		if err != nil {
+			fmt.Printf("Got an error updating stats for %s: %s\n", userID, err)
+		}
+	}
 	return nil
 }
+
+// statsKey returns the primary key of a player's StatsItem
+func statsKey(userID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("PLAYER#%s", userID)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("PLAYER#%s", userID)),
+		},
+	}
+}
+
+// addStats adds to a player's lifetime stats, creating their StatsItem if needed
+func (s *Store) addStats(userID string, delta game.Stats) error {
+	count := func(n int) *dynamodb.AttributeValue {
+		return &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", n))}
+	}
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":games":       count(delta.Games),
+			":matcheswon":  count(delta.MatchesWon),
+			":matcheslost": count(delta.MatchesLost),
+			":matchestied": count(delta.MatchesTied),
+			":roundswon":   count(delta.RoundsWon),
+			":roundslost":  count(delta.RoundsLost),
+			":roundstied":  count(delta.RoundsTied),
+			":type":        {S: aws.String("StatsItem")},
+			":uid":         {S: aws.String(userID)},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#type": aws.String("Type"),
+		},
+		TableName: aws.String(s.tableName),
+		Key:       statsKey(userID),
+	}
+	update := "ADD Games :games, MatchesWon :matcheswon, MatchesLost :matcheslost, MatchesTied :matchestied, " +
+		"RoundsWon :roundswon, RoundsLost :roundslost, RoundsTied :roundstied SET #type = :type, UserID = :uid"
+	i := 0
+	for move, n := range delta.Moves {
+		name, value := fmt.Sprintf("#move%d", i), fmt.Sprintf(":move%d", i)
+		input.ExpressionAttributeNames[name] = aws.String(move)
+		input.ExpressionAttributeValues[value] = count(n)
+		update += fmt.Sprintf(", Moves.%s = if_not_exists(Moves.%s, :zero) + %s", name, name, value)
+		input.ExpressionAttributeValues[":zero"] = count(0)
+		i++
+	}
+	input.UpdateExpression = aws.String(update)
+
+	_, err := s.d.UpdateItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationException" && len(delta.Moves) > 0 {
+		// the player has no Moves map to add to yet, so create it and try again
+		_, err = s.d.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       statsKey(userID),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			},
+			UpdateExpression: aws.String("SET Moves = if_not_exists(Moves, :empty)"),
+		})
+		if err == nil {
+			_, err = s.d.UpdateItem(input)
+		}
+	}
+	return err
+}
+
+// Stats returns a player's lifetime statistics, which are empty for players who haven't finished a round
+func (s *Store) Stats(userID string) (game.Stats, error) {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       statsKey(userID),
+	})
+	if err != nil {
+		fmt.Printf("Error fetching stats: %s\n", err)
+		return game.Stats{}, err
+	}
+
+	si := StatsItem{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &si)
+	if err != nil {
+		fmt.Println("Error reading stats record")
+		return game.Stats{}, err
+	}
+	return StatsFromItem(&si), nil
+}
+
+// StatsFromItem converts a stored StatsItem to game Stats
+func StatsFromItem(si *StatsItem) game.Stats {
+	return game.Stats{
+		Games:       si.Games,
+		MatchesWon:  si.MatchesWon,
+		MatchesLost: si.MatchesLost,
+		MatchesTied: si.MatchesTied,
+		RoundsWon:   si.RoundsWon,
+		RoundsLost:  si.RoundsLost,
+		RoundsTied:  si.RoundsTied,
+		Moves:       si.Moves,
+	}
+}
+
+// loadRating fetches a player's rating, and whether they've been rated at all
+func (s *Store) loadRating(userID string) (rating.Rating, bool, error) {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String(s.tableName),
+		Key:                  statsKey(userID),
+		ProjectionExpression: aws.String("Board, Rating, Deviation, Volatility"),
+	})
+	if err != nil {
+		fmt.Printf("Error fetching rating: %s\n", err)
+		return rating.Rating{}, false, err
+	}
+
+	si := StatsItem{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &si)
+	if err != nil {
+		fmt.Println("Error reading rating")
+		return rating.Rating{}, false, err
+	}
+	if si.Board == "" {
+		return rating.Default(), false, nil
+	}
+	return RatingFromItem(&si), true, nil
+}
+
+// Rating returns a player's rating, which is the default for players who haven't finished a rated match
+func (s *Store) Rating(userID string) (rating.Rating, error) {
+	r, _, err := s.loadRating(userID)
+	return r, err
+}
+
+// StoreRating sets a player's rating, putting them on the leaderboard
+func (s *Store) StoreRating(userID string, r rating.Rating) error {
+	number := func(f float64) *dynamodb.AttributeValue {
+		return &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(f, 'f', -1, 64))}
+	}
+	_, err := s.d.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       statsKey(userID),
+		ExpressionAttributeNames: map[string]*string{
+			"#type": aws.String("Type"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":type":       {S: aws.String("StatsItem")},
+			":uid":        {S: aws.String(userID)},
+			":board":      {S: aws.String(LEADERBOARD)},
+			":rating":     number(r.Rating),
+			":deviation":  number(r.Deviation),
+			":volatility": number(r.Volatility),
+		},
+		UpdateExpression: aws.String("SET #type = :type, UserID = :uid, Board = :board, Rating = :rating, " +
+			"Deviation = :deviation, Volatility = :volatility"),
+	})
+	if err != nil {
+		fmt.Printf("Got an error storing the rating of %s: %s\n", userID, err)
+	}
+	return err
+}
+
+// Leaderboard returns the n highest rated players, best first
+func (s *Store) Leaderboard(n int) ([]Ranking, error) {
+	result, err := s.d.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		IndexName:              aws.String(leaderboardIndex),
+		KeyConditionExpression: aws.String("Board = :board"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":board": {S: aws.String(LEADERBOARD)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(int64(n)),
+	})
+	if err != nil {
+		fmt.Printf("Error querying the leaderboard: %s\n", err)
+		return nil, err
+	}
+
+	items := []StatsItem{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &items)
+	if err != nil {
+		fmt.Println("Error reading the leaderboard")
+		return nil, err
+	}
+	board := make([]Ranking, 0, len(items))
+	for i := range items {
+		board = append(board, Ranking{UserID: items[i].UserID, Rating: RatingFromItem(&items[i])})
+	}
+	rank(board)
+	return board, nil
+}
+
+// Rank returns a player's place on the leaderboard, or 0 if they aren't rated.
+// It counts the players rated above them, so is slower the further down they are.
+func (s *Store) Rank(userID string) (int, error) {
+	r, rated, err := s.loadRating(userID)
+	if err != nil || !rated {
+		return 0, err
+	}
+
+	above := int64(0)
+	err = s.d.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		IndexName:              aws.String(leaderboardIndex),
+		KeyConditionExpression: aws.String("Board = :board and Rating > :rating"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":board":  {S: aws.String(LEADERBOARD)},
+			":rating": {N: aws.String(strconv.FormatFloat(r.Rating, 'f', -1, 64))},
+		},
+		Select: aws.String(dynamodb.SelectCount),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		above += aws.Int64Value(page.Count)
+		return true
+	})
+	if err != nil {
+		fmt.Printf("Error counting the players above %s: %s\n", userID, err)
+		return 0, err
+	}
+	return int(above) + 1, nil
+}
+
+// RatingFromItem converts a stored StatsItem to the player's rating
+func RatingFromItem(si *StatsItem) rating.Rating {
+	return rating.Rating{
+		Rating:     si.Rating,
+		Deviation:  si.Deviation,
+		Volatility: si.Volatility,
+	}
+}
+
+// rank numbers a leaderboard which is already in order, giving players with the same rating the same rank
+func rank(board []Ranking) {
+	for i := range board {
+		board[i].Rank = i + 1
+		if i > 0 && board[i].Rating.Rating == board[i-1].Rating.Rating {
+			board[i].Rank = board[i-1].Rank
+		}
+	}
+}
+
+// History returns every resolved round of a game, oldest first
+func (s *Store) History(gameID string) ([]game.RoundResult, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		KeyConditionExpression: aws.String("PK = :pk and begins_with(SK, :round)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {
+				S: aws.String(fmt.Sprintf("GAME#%s", gameID)),
+			},
+			":round": {
+				S: aws.String("ROUND#"),
+			},
+		},
+	}
+
+	history := []game.RoundResult{}
+	var unmarshalErr error
+	err := s.d.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, av := range page.Items {
+			ri := RoundItem{}
+			if unmarshalErr = dynamodbattribute.UnmarshalMap(av, &ri); unmarshalErr != nil {
+				return false
+			}
+			history = append(history, ResultFromRoundItem(&ri))
+		}
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		fmt.Printf("Error fetching round history: %s\n", err)
+		return nil, err
+	}
+	return history, nil
+}
+
+// ExpiredGames returns the IDs of games whose round deadline has passed.
+// It scans the whole table, which is fine for a sweeper running once a minute over a small table.
+func (s *Store) ExpiredGames(now int64) ([]string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(s.tableName),
+		FilterExpression: aws.String("#type = :type and Deadline <= :now and (attribute_not_exists(MatchOver) or MatchOver = :false)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#type": aws.String("Type"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":type": {
+				S: aws.String("GameItem"),
+			},
+			":now": {
+				N: aws.String(fmt.Sprintf("%d", now)),
+			},
+			":false": {
+				BOOL: aws.Bool(false),
+			},
+		},
+		ProjectionExpression: aws.String("GameID"),
+	}
+
+	ids := []string{}
+	var unmarshalErr error
+	err := s.d.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, av := range page.Items {
+			gi := GameItem{}
+			if unmarshalErr = dynamodbattribute.UnmarshalMap(av, &gi); unmarshalErr != nil {
+				return false
+			}
+			ids = append(ids, gi.GameID)
+		}
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		fmt.Printf("Error scanning for expired games: %s\n", err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// connectionKey returns the primary key of a connection's ConnectionItem
+func connectionKey(connectionID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("CONN#%s", connectionID)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("CONN#%s", connectionID)),
+		},
+	}
+}
+
+// StoreConnection records which game and user a connection belongs to, so $disconnect can find them
+func (s *Store) StoreConnection(connectionID, gameID, userID string) error {
+	ci := &ConnectionItem{
+		PK:     fmt.Sprintf("CONN#%s", connectionID),
+		SK:     fmt.Sprintf("CONN#%s", connectionID),
+		Type:   "ConnectionItem",
+		GameID: gameID,
+		UserID: userID,
+		// API Gateway drops connections after two hours, a day leaves plenty of room
+		Expires: time.Now().Unix() + 86_400,
+	}
+	av, err := dynamodbattribute.MarshalMap(ci)
+	if err != nil {
+		fmt.Println("Got error marshalling connectionitem:")
+		fmt.Println(err.Error())
+		return err
+	}
+
+	_, err = s.d.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tableName),
+	})
+	if err != nil {
+		fmt.Printf("Error storing connection: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// LookupConnection returns the game and user a connection belongs to, or ErrNoConnection
+func (s *Store) LookupConnection(connectionID string) (string, string, error) {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		Key:            connectionKey(connectionID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		fmt.Printf("Error fetching connection: %s\n", err)
+		return "", "", err
+	}
+	if len(result.Item) == 0 {
+		return "", "", ErrNoConnection
+	}
+
+	ci := ConnectionItem{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &ci)
+	if err != nil {
+		fmt.Println("Error reading connection record")
+		return "", "", err
+	}
+	return ci.GameID, ci.UserID, nil
+}
+
+// DeleteConnection removes a connection, and the game it is spectating, from the index
+func (s *Store) DeleteConnection(connectionID string) error {
+	for _, key := range []map[string]*dynamodb.AttributeValue{connectionKey(connectionID), spectatingKey(connectionID)} {
+		_, err := s.d.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       key,
+		})
+		if err != nil {
+			fmt.Printf("Error deleting connection: %s\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// spectatingKey returns the primary key of the ConnectionItem for the game a connection spectates
+func spectatingKey(connectionID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("CONN#%s", connectionID)),
+		},
+		"SK": {
+			S: aws.String("SPECTATING"),
+		},
+	}
+}
+
+// StoreSpectating records which game a connection is spectating, so $disconnect can stop it
+func (s *Store) StoreSpectating(connectionID, gameID string) error {
+	ci := &ConnectionItem{
+		PK:      fmt.Sprintf("CONN#%s", connectionID),
+		SK:      "SPECTATING",
+		Type:    "ConnectionItem",
+		GameID:  gameID,
+		Expires: time.Now().Unix() + 86_400,
+	}
+	av, err := dynamodbattribute.MarshalMap(ci)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.d.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tableName),
+	})
+	if err != nil {
+		fmt.Printf("Error storing spectating connection: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// LookupSpectating returns the game a connection is spectating, or ErrNoConnection
+func (s *Store) LookupSpectating(connectionID string) (string, error) {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		Key:            spectatingKey(connectionID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		fmt.Printf("Error fetching spectating connection: %s\n", err)
+		return "", err
+	}
+	if len(result.Item) == 0 {
+		return "", ErrNoConnection
+	}
+
+	ci := ConnectionItem{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &ci)
+	if err != nil {
+		return "", err
+	}
+	return ci.GameID, nil
+}
+
+// StoreOffline marks a player offline, as long as they are still on the connection which dropped.
+// If they have already reconnected somewhere else the condition fails and nothing changes.
+// It updates the Game with the current status as well
+func (s *Store) StoreOffline(g *game.Game, userID, connectionID string) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":address": {
+				S: aws.String(connectionID),
+			},
+			":true": {
+				BOOL: aws.Bool(true),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#pxid": aws.String(userID),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(g.ID),
+		ConditionExpression: aws.String("Players.#pxid.Address = :address"),
+		UpdateExpression:    aws.String("SET Players.#pxid.Offline = :true"),
+	}
+
+	err := s.updateAndRefresh(g, input)
+	if err != nil {
+		fmt.Printf("got an error marking a player offline: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// StorePending keeps a message for a player whose connection is gone, and clears their Address
+// so nothing else is sent there. It only applies while the player is still on that connection
+// (or already has none), so a player who rejoined in the meantime isn't knocked offline.
+func (s *Store) StorePending(gameID, userID, connectionID, pending string) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":address": {
+				S: aws.String(connectionID),
+			},
+			":pending": {
+				S: aws.String(pending),
+			},
+			":empty": {
+				S: aws.String(""),
+			},
+			":true": {
+				BOOL: aws.Bool(true),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#pxid": aws.String(userID),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gameID),
+		ConditionExpression: aws.String("Players.#pxid.Address = :address"),
+		UpdateExpression:    aws.String("SET Players.#pxid.Address = :empty, Players.#pxid.Pending = :pending, Players.#pxid.Offline = :true"),
+	}
+
+	_, err := s.d.UpdateItem(input)
+	if err != nil {
+		fmt.Printf("got an error storing a pending message: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// queueKey returns the primary key of a player's QueueItem
+func queueKey(userID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String("QUEUE"),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("USER#%s", userID)),
+		},
+	}
+}
+
+// Enqueue puts a player in the matchmaking queue, replacing any place they already had
+func (s *Store) Enqueue(e QueueEntry) error {
+	qi := &QueueItem{
+		PK:         "QUEUE",
+		SK:         fmt.Sprintf("USER#%s", e.UserID),
+		Type:       "QueueItem",
+		QueueEntry: e,
+		Expires:    e.Joined + QUEUE_EXPIRY,
+	}
+	av, err := dynamodbattribute.MarshalMap(qi)
+	if err != nil {
+		fmt.Println("Got error marshalling queueitem:")
+		fmt.Println(err.Error())
+		return err
+	}
+
+	_, err = s.d.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tableName),
+	})
+	if err != nil {
+		fmt.Printf("Error queueing player: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// Waiting returns every player in the matchmaking queue, longest waiting first.
+// Players who have been there longer than QUEUE_EXPIRY are left out, even before the TTL removes them.
+func (s *Store) Waiting(now int64) ([]QueueEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		KeyConditionExpression: aws.String("PK = :pk"),
+		FilterExpression:       aws.String("Expires > :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {
+				S: aws.String("QUEUE"),
+			},
+			":now": {
+				N: aws.String(fmt.Sprintf("%d", now)),
+			},
+		},
+	}
+
+	waiting := []QueueEntry{}
+	var unmarshalErr error
+	err := s.d.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items := []QueueItem{}
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); unmarshalErr != nil {
+			return false
+		}
+		for _, qi := range items {
+			waiting = append(waiting, qi.QueueEntry)
+		}
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	if err != nil {
+		fmt.Printf("Error reading the matchmaking queue: %s\n", err)
+		return nil, err
+	}
+	sortQueue(waiting)
+	return waiting, nil
+}
+
+// Dequeue takes a player out of the matchmaking queue, failing with ErrNotQueued if they aren't in it.
+// With a connectionID they are only taken out if they queued from that connection.
+func (s *Store) Dequeue(userID, connectionID string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.tableName),
+		Key:                 queueKey(userID),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	}
+	if connectionID != "" {
+		input.ConditionExpression = aws.String("ConnectionID = :conn")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":conn": {S: aws.String(connectionID)},
+		}
+	}
+
+	_, err := s.d.DeleteItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return fmt.Errorf("%w: %s", ErrNotQueued, userID)
+	}
+	if err != nil {
+		fmt.Printf("Error dequeueing player: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// sortQueue orders queued players by how long they've waited, then by ID
+func sortQueue(waiting []QueueEntry) {
+	sort.Slice(waiting, func(i, j int) bool {
+		if waiting[i].Joined != waiting[j].Joined {
+			return waiting[i].Joined < waiting[j].Joined
+		}
+		return waiting[i].UserID < waiting[j].UserID
+	})
+}
+
+// StoreSpectator adds a connection to the spectators of a game, failing with ErrGameNotFound if there's no such game
+func (s *Store) StoreSpectator(gameID, connectionID string, protocol int) error {
+	sv, err := dynamodbattribute.MarshalMap(SpectatorItem{Address: connectionID, Protocol: protocol})
+	if err != nil {
+		fmt.Printf("Unable to marshal spectator object: %s", err)
+		return err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":spectator": {M: sv},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#conn": aws.String(connectionID),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gameID),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		UpdateExpression:    aws.String("SET Spectators.#conn = :spectator"),
+	}
+	_, err = s.d.UpdateItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationException" {
+		// games from before spectators have no map to add to yet, so create it and try again
+		_, err = s.d.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       gameKey(gameID),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			},
+			ConditionExpression: aws.String("attribute_exists(PK)"),
+			UpdateExpression:    aws.String("SET Spectators = if_not_exists(Spectators, :empty)"),
+		})
+		if err == nil {
+			_, err = s.d.UpdateItem(input)
+		}
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
+	if err != nil {
+		fmt.Printf("got an error storing a spectator: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// RemoveSpectator stops a connection spectating a game
+func (s *Store) RemoveSpectator(gameID, connectionID string) error {
+	_, err := s.d.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#conn": aws.String(connectionID),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gameID),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		UpdateExpression:    aws.String("REMOVE Spectators.#conn"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
+	if err != nil {
+		fmt.Printf("got an error removing a spectator: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// chatKey is the sort key of a chat message, which sorts messages in the order they were sent
+func chatKey(sent int64, userID string) string {
+	return fmt.Sprintf("CHAT#%013d#%s", sent, userID)
+}
+
+// LimitChat counts a chat message from a player against their limit for a window of time,
+// failing with ErrChatLimited if they've already sent limit messages in it.
+// Windows are numbered by the caller, and a new window starts the count again.
+func (s *Store) LimitChat(gameID, userID string, window int64, limit int) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"PK": {S: aws.String(fmt.Sprintf("GAME#%s", gameID))},
+		"SK": {S: aws.String(fmt.Sprintf("CHATLIMIT#%s", userID))},
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":window":  {N: aws.String(fmt.Sprintf("%d", window))},
+		":one":     {N: aws.String("1")},
+		":limit":   {N: aws.String(fmt.Sprintf("%d", limit))},
+		":expires": {N: aws.String(fmt.Sprintf("%d", time.Now().Unix()+86_400))},
+	}
+	names := map[string]*string{
+		"#window": aws.String("Window"),
+		"#count":  aws.String("Count"),
+	}
+
+	// count another message in the current window
+	_, err := s.d.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       key,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ConditionExpression:       aws.String("#window = :window and #count < :limit"),
+		UpdateExpression:          aws.String("SET #count = #count + :one"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// or start a new window, unless the player is already at the limit of this one
+		_, err = s.d.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(s.tableName),
+			Key:                       key,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+			ConditionExpression:       aws.String("attribute_not_exists(#window) or #window <> :window"),
+			UpdateExpression:          aws.String("SET #window = :window, #count = :one, Expires = :expires"),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return fmt.Errorf("%w: at most %d at a time", ErrChatLimited, limit)
+		}
+	}
+	if err != nil {
+		fmt.Printf("got an error counting a chat message: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// StoreChat keeps a chat message with its game
+func (s *Store) StoreChat(c *ChatItem) error {
+	c.PK = fmt.Sprintf("GAME#%s", c.GameID)
+	c.SK = chatKey(c.Sent, c.UserID)
+	c.Type = "ChatItem"
+	c.Expires = time.Now().Unix() + 2_592_000 // TTL: expire along with the game
+	av, err := dynamodbattribute.MarshalMap(c)
+	if err != nil {
+		fmt.Println("Got error marshalling chatitem:")
+		fmt.Println(err.Error())
+		return err
+	}
+	_, err = s.d.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tableName),
+	})
+	if err != nil {
+		fmt.Printf("Got an error storing a chat message: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// RecentChat returns the last n chat messages of a game, oldest first
+func (s *Store) RecentChat(gameID string, n int) ([]ChatItem, error) {
+	result, err := s.d.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		KeyConditionExpression: aws.String("PK = :pk and begins_with(SK, :chat)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {
+				S: aws.String(fmt.Sprintf("GAME#%s", gameID)),
+			},
+			":chat": {
+				S: aws.String("CHAT#"),
+			},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(int64(n)),
+	})
+	if err != nil {
+		fmt.Printf("Error querying chat: %s\n", err)
+		return nil, err
+	}
+
+	items := []ChatItem{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &items)
+	if err != nil {
+		fmt.Println("Error reading chat")
+		return nil, err
+	}
+	// newest came first
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, nil
+}
+
+// StoreRematch records whether a player wants a rematch of a finished game, and updates the Game
+// with everyone else's answer. It fails with ErrRematchStarted once the rematch exists, and with
+// ErrNotAPlayer for anyone who didn't play.
+func (s *Store) StoreRematch(g *game.Game, userID string, want bool) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":want": {
+				BOOL: aws.Bool(want),
+			},
+			":true": {
+				BOOL: aws.Bool(true),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#pxid": aws.String(userID),
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(g.ID),
+		ConditionExpression: aws.String("MatchOver = :true and attribute_not_exists(NextGame) and attribute_exists(Players.#pxid)"),
+		UpdateExpression:    aws.String("SET Players.#pxid.Rematch = :want"),
+	}
+
+	err := s.updateAndRefresh(g, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// the condition doesn't say which part failed, so look
+		stored, err := s.LoadConsistent(g.ID)
+		if err != nil {
+			return err
+		}
+		if _, found := stored.Players[userID]; !found {
+			return fmt.Errorf("%w: %s in %s", ErrNotAPlayer, userID, g.ID)
+		}
+		return fmt.Errorf("%w: %s", ErrRematchStarted, g.ID)
+	}
+	if err != nil {
+		fmt.Printf("got an error storing a rematch answer: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// LinkRematch points a finished game at its rematch. Only the first link succeeds, after that
+// it fails with ErrRematchStarted, so a game only ever gets one rematch.
+func (s *Store) LinkRematch(gameID, nextGameID string) error {
+	_, err := s.d.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":next": {
+				S: aws.String(nextGameID),
+			},
+		},
+		TableName:           aws.String(s.tableName),
+		Key:                 gameKey(gameID),
+		ConditionExpression: aws.String("attribute_exists(PK) and attribute_not_exists(NextGame)"),
+		UpdateExpression:    aws.String("SET NextGame = :next"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return fmt.Errorf("%w: %s", ErrRematchStarted, gameID)
+	}
+	if err != nil {
+		fmt.Printf("got an error linking a rematch: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// seriesKey returns the primary key of a SeriesItem
+func seriesKey(seriesID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("SERIES#%s", seriesID)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("SERIES#%s", seriesID)),
+		},
+	}
+}
+
+// AddSeriesResult counts a finished match in a series, won by winner or "Tie"
+func (s *Store) AddSeriesResult(seriesID, winner string) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":type":    {S: aws.String("SeriesItem")},
+			":sid":     {S: aws.String(seriesID)},
+			":expires": {N: aws.String(fmt.Sprintf("%d", time.Now().Unix()+2_592_000))},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#type": aws.String("Type"),
+		},
+		TableName: aws.String(s.tableName),
+		Key:       seriesKey(seriesID),
+	}
+	update := "ADD Matches :one SET #type = :type, SeriesID = :sid, Expires = :expires"
+	if winner == "Tie" {
+		update = "ADD Matches :one, Ties :one SET #type = :type, SeriesID = :sid, Expires = :expires"
+	} else {
+		input.ExpressionAttributeNames["#winner"] = aws.String(winner)
+		input.ExpressionAttributeValues[":zero"] = &dynamodb.AttributeValue{N: aws.String("0")}
+		update += ", Wins.#winner = if_not_exists(Wins.#winner, :zero) + :one"
+	}
+	input.UpdateExpression = aws.String(update)
+
+	_, err := s.d.UpdateItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationException" && winner != "Tie" {
+		// the series has no Wins map to add to yet, so create it and try again
+		_, err = s.d.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       seriesKey(seriesID),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			},
+			UpdateExpression: aws.String("SET Wins = if_not_exists(Wins, :empty)"),
+		})
+		if err == nil {
+			_, err = s.d.UpdateItem(input)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Got an error updating series %s: %s\n", seriesID, err)
+	}
+	return err
+}
+
+// Series returns the running total of a series, which is empty for series with no finished matches
+func (s *Store) Series(seriesID string) (game.Series, error) {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       seriesKey(seriesID),
+	})
+	if err != nil {
+		fmt.Printf("Error fetching series: %s\n", err)
+		return game.Series{}, err
+	}
+
+	si := SeriesItem{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &si)
+	if err != nil {
+		fmt.Println("Error reading series record")
+		return game.Series{}, err
+	}
+	return game.Series{ID: seriesID, Matches: si.Matches, Wins: si.Wins, Ties: si.Ties}, nil
+}
+
+// tournamentKey returns the primary key of a TournamentItem
+func tournamentKey(tournamentID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("TOURNAMENT#%s", tournamentID)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("TOURNAMENT#%s", tournamentID)),
+		},
+	}
+}
+
+// LoadTournament returns a tournament, or ErrTournamentNotFound if it doesn't exist
+func (s *Store) LoadTournament(tournamentID string) (*tournament.Tournament, error) {
+	result, err := s.d.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       tournamentKey(tournamentID),
+	})
+	if err != nil {
+		fmt.Printf("Error fetching tournament: %s\n", err)
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTournamentNotFound, tournamentID)
+	}
+
+	ti := TournamentItem{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &ti)
+	if err != nil {
+		fmt.Println("Error reading tournament record")
+		return nil, err
+	}
+	return &ti.Tournament, nil
+}
+
+// StoreTournament writes a whole tournament, as long as nobody else stored it since it was loaded.
+// Otherwise it fails with ErrStaleTournament, and the caller should load it again and retry.
+// A tournament which was never stored has Version 0. Version is bumped on success.
+func (s *Store) StoreTournament(t *tournament.Tournament) error {
+	ti := &TournamentItem{
+		PK:         fmt.Sprintf("TOURNAMENT#%s", t.ID),
+		SK:         fmt.Sprintf("TOURNAMENT#%s", t.ID),
+		Type:       "TournamentItem",
+		Tournament: *t,
+		Expires:    time.Now().Unix() + 2_592_000, // TTL: expire in 30 days
+	}
+	ti.Version = t.Version + 1
+	av, err := dynamodbattribute.MarshalMap(ti)
+	if err != nil {
+		fmt.Println("Got error marshalling tournamentitem:")
+		fmt.Println(err.Error())
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(s.tableName),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	}
+	if t.Version > 0 {
+		input.ConditionExpression = aws.String("Version = :version")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.Itoa(t.Version))},
+		}
+	}
+
+	_, err = s.d.PutItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return fmt.Errorf("%w: %s", ErrStaleTournament, t.ID)
+	}
+	if err != nil {
+		fmt.Printf("Error storing tournament: %s\n", err)
+		return err
+	}
+	t.Version++
+	return nil
+}
+
+// requestKey returns the primary key of a player's RequestItem
+func requestKey(userID, requestID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("PLAYER#%s", userID)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("REQUEST#%s", requestID)),
+		},
+	}
+}
+
+// BeginRequest records that a player's request is being handled. If the player sent it before,
+// and it hasn't expired, it fails with ErrDuplicateRequest and returns the earlier record instead.
+// Only one of several copies of a request sent at once gets to begin it.
+func (s *Store) BeginRequest(userID, requestID string, now int64) (*RequestItem, error) {
+	r := &RequestItem{
+		UserID:    userID,
+		RequestID: requestID,
+		Expires:   now + REQUEST_TIMEOUT,
+	}
+	av, err := s.marshalRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.d.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tableName),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(fmt.Sprintf("%d", now))},
+		},
+		// expired items can linger until DynamoDB gets around to deleting them
+		ConditionExpression: aws.String("attribute_not_exists(PK) or Expires < :now"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		result, err := s.d.GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(s.tableName),
+			Key:            requestKey(userID, requestID),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			fmt.Printf("got an error loading request %s: %s\n", requestID, err)
+			return nil, err
+		}
+		earlier := &RequestItem{UserID: userID, RequestID: requestID}
+		if err := dynamodbattribute.UnmarshalMap(result.Item, earlier); err != nil {
+			return nil, err
+		}
+		return earlier, fmt.Errorf("%w: %s", ErrDuplicateRequest, requestID)
+	}
+	if err != nil {
+		fmt.Printf("got an error beginning request %s: %s\n", requestID, err)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// FinishRequest stores the outcome of a request, which is kept for REQUEST_TTL
+func (s *Store) FinishRequest(r *RequestItem, now int64) error {
+	r.Done = true
+	r.Expires = now + REQUEST_TTL
+	av, err := s.marshalRequest(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.d.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tableName),
+	})
+	if err != nil {
+		fmt.Printf("got an error finishing request %s: %s\n", r.RequestID, err)
+		return err
+	}
+	return nil
+}
+
+// ForgetRequest drops the record of a request, so a retry runs it again
+func (s *Store) ForgetRequest(userID, requestID string) error {
+	_, err := s.d.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       requestKey(userID, requestID),
+	})
+	if err != nil {
+		fmt.Printf("got an error forgetting request %s: %s\n", requestID, err)
+		return err
+	}
+	return nil
+}
+
+// marshalRequest fills in a RequestItem's keys and marshals it
+func (s *Store) marshalRequest(r *RequestItem) (map[string]*dynamodb.AttributeValue, error) {
+	r.PK = fmt.Sprintf("PLAYER#%s", r.UserID)
+	r.SK = fmt.Sprintf("REQUEST#%s", r.RequestID)
+	r.Type = "RequestItem"
+	av, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		fmt.Printf("Got error marshalling requestitem: %s\n", err)
+		return nil, err
+	}
+	return av, nil
+}
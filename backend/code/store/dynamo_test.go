@@ -1,30 +1,209 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/jbarratt/rpsls/backend/code/game"
 )
 
-func TestGameStore(t *testing.T) {
+// dynamoStore connects to the table named by TABLE_NAME, or skips the test without one
+func dynamoStore(t *testing.T) *Store {
+	t.Helper()
+	if os.Getenv("TABLE_NAME") == "" {
+		t.Skip("TABLE_NAME not set, skipping DynamoDB test (see `make dynamotest`)")
+	}
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
 	if err != nil {
 		t.Fatalf("unable to create session: %s", err)
 	}
+	return New(dynamodb.New(sess), os.Getenv("TABLE_NAME"))
+}
+
+// fakeDynamo returns a Store whose requests never leave the process. respond answers each
+// request with a JSON body or an error.
+func fakeDynamo(t *testing.T, respond func(r *request.Request) (string, error)) *Store {
+	t.Helper()
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("local"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("unable to create session: %s", err)
+	}
+	d := dynamodb.New(sess)
+	d.Handlers.Send.Clear()
+	d.Handlers.Send.PushBack(func(r *request.Request) {
+		body, err := respond(r)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		r.HTTPResponse = &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+	})
+	return New(d, "test")
+}
+
+func TestStoreRoundAfterCommit(t *testing.T) {
+	ops := []string{}
+	s := fakeDynamo(t, func(r *request.Request) (string, error) {
+		ops = append(ops, r.Operation.Name)
+		if len(ops) > 1 {
+			return "", awserr.New("InternalServerError", "unavailable", nil)
+		}
+		return "{}", nil
+	})
+
+	g := game.NewGame()
+	p1, _ := game.NewGameContext("first", "1addr", g)
+	p2, _ := game.NewGameContext("second", "2addr", g)
+	p1.Play("rock")
+	p2.Play("scissors")
+	if err := g.AdvanceGame(); err != nil {
+		t.Fatalf("unable to advance: %s", err)
+	}
+
+	// the versioned update goes through, then neither the history nor the stats can be written
+	if err := s.StoreRound(g); err != nil {
+		t.Errorf("a stored round should stand without its history or stats: %s", err)
+	}
+	want := []string{"UpdateItem", "PutItem", "UpdateItem", "UpdateItem"}
+	if fmt.Sprint(ops) != fmt.Sprint(want) || g.Version != 1 {
+		t.Errorf("expected the round, its history, then both players' stats: %v, version %d", ops, g.Version)
+	}
+}
 
-	s := New(dynamodb.New(sess), os.Getenv("TABLE_NAME"))
+func TestConsistentLookups(t *testing.T) {
+	// a connection is looked up straight after it's stored, so the read must see that write
+	s := fakeDynamo(t, func(r *request.Request) (string, error) {
+		if in, ok := r.Params.(*dynamodb.GetItemInput); !ok || !aws.BoolValue(in.ConsistentRead) {
+			t.Errorf("%s should be a consistent read", r.Operation.Name)
+		}
+		return "{}", nil
+	})
+
+	if _, _, err := s.LookupConnection("conn1"); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("expected no connection: %v", err)
+	}
+	if _, err := s.LookupSpectating("conn1"); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("expected no spectating connection: %v", err)
+	}
+	if _, err := s.LoadConsistent("game1"); !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("expected no game: %v", err)
+	}
+}
 
+func TestRematchConditionFailures(t *testing.T) {
+	g := game.NewGame()
+	game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	g.MatchOver = true
+	g.NextGame = "next"
+	gi := &GameItem{Players: map[string]PlayerItem{}}
+	UpdateItemFromGame(gi, g)
+	av, err := dynamodbattribute.MarshalMap(gi)
+	if err != nil {
+		t.Fatalf("unable to marshal game: %s", err)
+	}
+	stored, err := jsonutil.BuildJSON(&dynamodb.GetItemOutput{Item: av})
+	if err != nil {
+		t.Fatalf("unable to build response: %s", err)
+	}
+
+	// the rematch already started, so the answer's condition fails whoever gives it
+	s := fakeDynamo(t, func(r *request.Request) (string, error) {
+		if r.Operation.Name == "GetItem" {
+			return string(stored), nil
+		}
+		return "", awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+	})
+	if err := s.StoreRematch(g, "third", true); !errors.Is(err, ErrNotAPlayer) {
+		t.Errorf("a non-player should be told they aren't playing, got %v", err)
+	}
+	if err := s.StoreRematch(g, "first", true); !errors.Is(err, ErrRematchStarted) {
+		t.Errorf("a player should be told the rematch started, got %v", err)
+	}
+}
+
+func TestGameStore(t *testing.T) {
+	testGameStore(t, dynamoStore(t))
+}
+
+// TestLegacyGameItem plays into a game stored before match formats, which has no MatchOver attribute
+func TestLegacyGameItem(t *testing.T) {
+	s := dynamoStore(t)
+
+	g := game.NewGame()
+	game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	g.Deadline = 1
+	gi := &GameItem{Players: make(map[string]PlayerItem)}
+	UpdateItemFromGame(gi, g)
+	gi.PK = fmt.Sprintf("GAME#%s", g.ID)
+	gi.SK = gi.PK
+	gi.Type = "GameItem"
+	av, err := dynamodbattribute.MarshalMap(gi)
+	if err != nil {
+		t.Fatalf("unable to marshal game: %s", err)
+	}
+	delete(av, "MatchOver")
+	delete(av, "Version")
+	if _, err := s.d.PutItem(&dynamodb.PutItemInput{Item: av, TableName: aws.String(s.tableName)}); err != nil {
+		t.Fatalf("unable to store game: %s", err)
+	}
+	defer s.DeleteGame(g.ID)
+
+	ids, err := s.ExpiredGames(2)
+	if err != nil {
+		t.Fatalf("unable to find expired games: %s", err)
+	}
+	found := false
+	for _, id := range ids {
+		found = found || id == g.ID
+	}
+	if !found {
+		t.Errorf("a running game without MatchOver should be swept: %v", ids)
+	}
+
+	loaded, err := s.Load(g.ID)
+	if err != nil {
+		t.Fatalf("unable to load game: %s", err)
+	}
+	gc, _ := game.NewGameContext("first", "1addr", loaded)
+	gc.Play("rock")
+	if err := s.StorePlay(gc); err != nil {
+		t.Errorf("a game without MatchOver should take plays: %s", err)
+	}
+}
+
+// testGameStore runs a two player game through any GameStore implementation
+func testGameStore(t *testing.T, s GameStore) {
 	g := game.NewGame()
 	// Simulate first player joining
-	p1gc, err := game.NewGameContext("first", "1addr", g)
+	p1gc, _ := game.NewGameContext("first", "1addr", g)
 
-	err = s.StoreAll(g)
+	err := s.StoreAll(g)
 	if err != nil {
 		t.Fatalf("unable to store game: %s %+v %+v", err, s, g)
 	}
@@ -34,14 +213,26 @@ func TestGameStore(t *testing.T) {
 		t.Fatalf("unable to store player one: %s", err)
 	}
 
-	// Simulate second player joining
+	// Simulate second player joining, while a third has a copy from before the game filled up
+	stale, err := s.Load(g.ID)
+	if err != nil {
+		t.Fatalf("unable to load game from ID: %s", err)
+	}
 	p2gc, err := game.NewGameContext("second", "2addr", g)
 
-	err = s.StorePlayer(p2gc)
+	err = s.ClaimSeat(p2gc)
 	if err != nil {
 		t.Fatalf("unable to store player two: %s", err)
 	}
 
+	p3gc, err := game.NewGameContext("third", "3addr", stale)
+	if err != nil {
+		t.Fatalf("the stale copy should still have a seat: %s", err)
+	}
+	if err := s.ClaimSeat(p3gc); !errors.Is(err, game.ErrGameFull) {
+		t.Errorf("a third player shouldn't get a seat: %v", err)
+	}
+
 	// simulate second player reconnecting
 	g2, err := s.Load(g.ID)
 	if err != nil {
@@ -92,6 +283,11 @@ func TestGameStore(t *testing.T) {
 		t.Errorf("player 2 should have no points: %+v", p2gc2.ActingPlayer)
 	}
 
+	before, err := s.Stats("first")
+	if err != nil {
+		t.Errorf("unable to load stats: %s", err)
+	}
+
 	err = s.StoreRound(p2gc2.Game)
 	if err != nil {
 		t.Errorf("should be able to advance round: %s\n%+v", err, p2gc2)
@@ -100,4 +296,21 @@ func TestGameStore(t *testing.T) {
 	if p2gc2.Game.Round != 2 {
 		t.Errorf("round should have advanced: %s\n%+v\n%+v", err, p2gc2.Game, p2gc2.ActingPlayer)
 	}
+
+	history, err := s.History(g.ID)
+	if err != nil {
+		t.Errorf("unable to load round history: %s", err)
+	}
+	if len(history) != 1 || history[0].Plays["first"] != "rock" || history[0].Plays["second"] != "scissors" {
+		t.Errorf("round history should have the completed round: %+v", history)
+	}
+
+	// stats are lifetime totals, so only look at what this round added
+	after, err := s.Stats("first")
+	if err != nil {
+		t.Errorf("unable to load stats: %s", err)
+	}
+	if after.Games != before.Games+1 || after.RoundsWon != before.RoundsWon+1 || after.Moves["rock"] != before.Moves["rock"]+1 {
+		t.Errorf("storing the round should update stats: %+v then %+v", before, after)
+	}
 }
@@ -0,0 +1,739 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jbarratt/rpsls/backend/code/bot"
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/rating"
+	"github.com/jbarratt/rpsls/backend/code/tournament"
+)
+
+// Memory is a GameStore which keeps games in process memory
+// It is safe for concurrent use, and is intended for tests and local play
+type Memory struct {
+	mu      sync.Mutex
+	games   map[string]*GameItem
+	history map[string][]RoundItem
+	conns   map[string]ConnectionItem
+	// watching is the game each connection spectates, apart from the one it plays in
+	watching map[string]string
+	stats    map[string]*game.Stats
+	ratings  map[string]rating.Rating
+	// board holds every rated player's ID, best first, like the dynamo Leaderboard index
+	board []string
+	queue map[string]QueueItem
+	// chat is indexed by game ID, and chatLimits by game ID and user ID
+	chat        map[string][]ChatItem
+	chatLimits  map[string]ChatLimitItem
+	series      map[string]*game.Series
+	tournaments map[string]*tournament.Tournament
+	// requests is indexed by user ID and request ID. Expired ones are cleared out every
+	// REQUEST_TIMEOUT seconds, as dynamo's TTL would.
+	requests      map[string]RequestItem
+	requestsSwept int64
+}
+
+var _ GameStore = (*Memory)(nil)
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		games:       make(map[string]*GameItem),
+		history:     make(map[string][]RoundItem),
+		conns:       make(map[string]ConnectionItem),
+		watching:    make(map[string]string),
+		stats:       make(map[string]*game.Stats),
+		ratings:     make(map[string]rating.Rating),
+		queue:       make(map[string]QueueItem),
+		chat:        make(map[string][]ChatItem),
+		chatLimits:  make(map[string]ChatLimitItem),
+		series:      make(map[string]*game.Series),
+		tournaments: make(map[string]*tournament.Tournament),
+		requests:    make(map[string]RequestItem),
+	}
+}
+
+// Load returns a populated game based on a gameID, or error if no game exists
+func (m *Memory) Load(gameID string) (*game.Game, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gameID]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
+	g := game.NewGame()
+	UpdateGameFromItem(g, gi)
+	return g, nil
+}
+
+// LoadConsistent is Load: the memory store is always consistent
+func (m *Memory) LoadConsistent(gameID string) (*game.Game, error) {
+	return m.Load(gameID)
+}
+
+// StoreAll takes a Game and persists the entire thing
+func (m *Memory) StoreAll(g *game.Game) error {
+	gi := &GameItem{}
+	gi.Players = make(map[string]PlayerItem)
+	UpdateItemFromGame(gi, g)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.games[g.ID] = gi
+	return nil
+}
+
+// DeleteGame removes a game which was stored but never started
+func (m *Memory) DeleteGame(gameID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.games, gameID)
+	delete(m.history, gameID)
+	return nil
+}
+
+// StoreRound takes a Game and stores the next round, along with the history of the one just resolved.
+// Like the dynamo store it only writes the round state, and only if the game's Version still matches.
+// Bots don't keep stats.
+func (m *Memory) StoreRound(g *game.Game) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[g.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, g.ID)
+	}
+	if gi.Version != g.Version {
+		return fmt.Errorf("%w: game %s changed since it was loaded", ErrStaleRound, g.ID)
+	}
+
+	gi.Round = g.Round
+	gi.Plays = g.PlayCount
+	gi.Reveals = g.RevealCount
+	gi.MatchOver = g.MatchOver
+	gi.MatchWinner = g.MatchWinner
+	gi.Deadline = g.Deadline
+	for id, p := range g.Players {
+		pi, found := gi.Players[id]
+		if !found {
+			continue
+		}
+		pi.Play = p.Play
+		pi.Round = p.Round
+		pi.Score = p.Score
+		pi.Commitment = p.Commitment
+		pi.RevealRound = p.RevealRound
+		pi.Forfeit = p.Forfeit
+		pi.Misses = p.Misses
+		gi.Players[id] = pi
+	}
+	gi.Version++
+	g.Version = gi.Version
+
+	if g.LastResult == nil {
+		return nil
+	}
+
+	ri := RoundItemFromResult(g.ID, g.LastResult)
+	m.history[g.ID] = append(m.history[g.ID], *ri)
+
+	for userID, delta := range g.StatsDelta() {
+		if bot.IsBot(userID) {
+			continue
+		}
+		if m.stats[userID] == nil {
+			m.stats[userID] = &game.Stats{}
+		}
+		m.stats[userID].Add(delta)
+	}
+	return nil
+}
+
+// Stats returns a player's lifetime statistics, which are empty for players who haven't finished a round
+func (m *Memory) Stats(userID string) (game.Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := game.Stats{}
+	if m.stats[userID] != nil {
+		// copy, so callers can't change the stored moves
+		st.Add(*m.stats[userID])
+	}
+	return st, nil
+}
+
+// Rating returns a player's rating, which is the default for players who haven't finished a rated match
+func (m *Memory) Rating(userID string) (rating.Rating, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, found := m.ratings[userID]
+	if !found {
+		return rating.Default(), nil
+	}
+	return r, nil
+}
+
+// above returns how many players on the board are rated higher than r
+func (m *Memory) above(r float64) int {
+	return sort.Search(len(m.board), func(i int) bool {
+		return m.ratings[m.board[i]].Rating <= r
+	})
+}
+
+// StoreRating sets a player's rating, moving them to their new place on the board
+func (m *Memory) StoreRating(userID string, r rating.Rating) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, id := range m.board {
+		if id == userID {
+			m.board = append(m.board[:i], m.board[i+1:]...)
+			break
+		}
+	}
+	m.ratings[userID] = r
+
+	// after everyone rated higher, then by ID among equals
+	i := m.above(r.Rating)
+	for i < len(m.board) && m.ratings[m.board[i]].Rating == r.Rating && m.board[i] < userID {
+		i++
+	}
+	m.board = append(m.board, "")
+	copy(m.board[i+1:], m.board[i:])
+	m.board[i] = userID
+	return nil
+}
+
+// Leaderboard returns the n highest rated players, best first
+func (m *Memory) Leaderboard(n int) ([]Ranking, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n > len(m.board) {
+		n = len(m.board)
+	}
+	board := make([]Ranking, 0, n)
+	for _, id := range m.board[:n] {
+		board = append(board, Ranking{UserID: id, Rating: m.ratings[id]})
+	}
+	rank(board)
+	return board, nil
+}
+
+// Rank returns a player's place on the leaderboard, or 0 if they aren't rated
+func (m *Memory) Rank(userID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, found := m.ratings[userID]
+	if !found {
+		return 0, nil
+	}
+	return m.above(r.Rating) + 1, nil
+}
+
+// History returns every resolved round of a game, oldest first
+func (m *Memory) History(gameID string) ([]game.RoundResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := make([]game.RoundResult, 0, len(m.history[gameID]))
+	for i := range m.history[gameID] {
+		history = append(history, ResultFromRoundItem(&m.history[gameID][i]))
+	}
+	return history, nil
+}
+
+// ExpiredGames returns the IDs of games whose round deadline has passed
+func (m *Memory) ExpiredGames(now int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := []string{}
+	for id, gi := range m.games {
+		if gi.Deadline != 0 && gi.Deadline <= now && !gi.MatchOver {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// StorePlay records the acting player's play, with the same conditions as the dynamo store:
+// the game must still be on the same round, the player must not have played in it yet,
+// and the match must not be over.
+// It updates the Game with the current status as well
+func (m *Memory) StorePlay(gc *game.GameContext) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gc.Game.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gc.Game.ID)
+	}
+	p, found := gi.Players[gc.ActingPlayer.ID]
+	if !found || gi.Round != gc.Game.Round || p.Round >= gc.Game.Round || gi.MatchOver {
+		return fmt.Errorf("%w: play is not valid for this round", ErrStaleRound)
+	}
+
+	p.Play = gc.ActingPlayer.Play
+	p.Round = gc.Game.Round
+	gi.Players[gc.ActingPlayer.ID] = p
+	gi.Plays++
+	gi.Version++
+	if gi.Deadline == 0 {
+		gi.Deadline = gc.Game.Deadline
+	}
+
+	UpdateGameFromItem(gc.Game, gi)
+	return nil
+}
+
+// StoreCommit stores the acting player's commitment, with the same conditions as StorePlay
+func (m *Memory) StoreCommit(gc *game.GameContext) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gc.Game.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gc.Game.ID)
+	}
+	p, found := gi.Players[gc.ActingPlayer.ID]
+	if !found || gi.Round != gc.Game.Round || p.Round >= gc.Game.Round || gi.MatchOver {
+		return fmt.Errorf("%w: commitment is not valid for this round", ErrStaleRound)
+	}
+
+	p.Commitment = gc.ActingPlayer.Commitment
+	p.Round = gc.Game.Round
+	p.Forfeit = false
+	gi.Players[gc.ActingPlayer.ID] = p
+	gi.Plays++
+	gi.Version++
+	if gi.Deadline == 0 {
+		gi.Deadline = gc.Game.Deadline
+	}
+
+	UpdateGameFromItem(gc.Game, gi)
+	return nil
+}
+
+// StoreReveal stores the acting player's revealed play, once everyone has committed
+// and only once per player per round
+func (m *Memory) StoreReveal(gc *game.GameContext) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gc.Game.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gc.Game.ID)
+	}
+	p, found := gi.Players[gc.ActingPlayer.ID]
+	if !found || gi.Round != gc.Game.Round || gi.Plays != len(gi.Players) ||
+		p.Round != gc.Game.Round || p.RevealRound >= gc.Game.Round {
+		return fmt.Errorf("%w: reveal is not valid for this round", ErrStaleRound)
+	}
+
+	p.Play = gc.ActingPlayer.Play
+	p.RevealRound = gc.Game.Round
+	p.Forfeit = gc.ActingPlayer.Forfeit
+	gi.Players[gc.ActingPlayer.ID] = p
+	gi.Reveals++
+	gi.Version++
+
+	UpdateGameFromItem(gc.Game, gi)
+	return nil
+}
+
+// StorePlayer stores the connection details of a seated player
+func (m *Memory) StorePlayer(gc *game.GameContext) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gc.Game.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gc.Game.ID)
+	}
+	p, found := gi.Players[gc.ActingPlayer.ID]
+	if !found {
+		return errors.New("conditional check failed: player has no seat")
+	}
+
+	p.Address = gc.ActingPlayer.Address
+	p.Offline = gc.ActingPlayer.Offline
+	p.Pending = gc.ActingPlayer.Pending
+	p.Protocol = gc.ActingPlayer.Protocol
+	gi.Players[gc.ActingPlayer.ID] = p
+	return nil
+}
+
+// ClaimSeat stores a player joining a game, with the same conditions as the dynamo store
+func (m *Memory) ClaimSeat(gc *game.GameContext) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gc.Game.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gc.Game.ID)
+	}
+	if _, seated := gi.Players[gc.ActingPlayer.ID]; seated {
+		return fmt.Errorf("%w: %s in %s", ErrAlreadySeated, gc.ActingPlayer.ID, gc.Game.ID)
+	}
+	if len(gi.Players) >= gc.Game.Seats() {
+		return fmt.Errorf("%w: no seat left in %s", game.ErrGameFull, gc.Game.ID)
+	}
+
+	// Work on a copy so the stored item doesn't pick up unrelated changes to the game
+	scratch := &GameItem{Players: make(map[string]PlayerItem)}
+	UpdateItemFromGame(scratch, gc.Game)
+	gi.Players[gc.ActingPlayer.ID] = scratch.Players[gc.ActingPlayer.ID]
+	gi.Version++
+
+	UpdateGameFromItem(gc.Game, gi)
+	return nil
+}
+
+// StoreConnection records which game and user a connection belongs to
+func (m *Memory) StoreConnection(connectionID, gameID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[connectionID] = ConnectionItem{GameID: gameID, UserID: userID}
+	return nil
+}
+
+// LookupConnection returns the game and user a connection belongs to, or ErrNoConnection
+func (m *Memory) LookupConnection(connectionID string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ci, found := m.conns[connectionID]
+	if !found {
+		return "", "", ErrNoConnection
+	}
+	return ci.GameID, ci.UserID, nil
+}
+
+// DeleteConnection removes a connection, and the game it is spectating, from the index
+func (m *Memory) DeleteConnection(connectionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, connectionID)
+	delete(m.watching, connectionID)
+	return nil
+}
+
+// StoreSpectating records which game a connection is spectating
+func (m *Memory) StoreSpectating(connectionID, gameID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watching[connectionID] = gameID
+	return nil
+}
+
+// LookupSpectating returns the game a connection is spectating, or ErrNoConnection
+func (m *Memory) LookupSpectating(connectionID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gameID, found := m.watching[connectionID]
+	if !found {
+		return "", ErrNoConnection
+	}
+	return gameID, nil
+}
+
+// StoreOffline marks a player offline, as long as they are still on the connection which dropped
+func (m *Memory) StoreOffline(g *game.Game, userID, connectionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[g.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, g.ID)
+	}
+	p, found := gi.Players[userID]
+	if !found || p.Address != connectionID {
+		return errors.New("conditional check failed: player is not on this connection")
+	}
+
+	p.Offline = true
+	gi.Players[userID] = p
+	UpdateGameFromItem(g, gi)
+	return nil
+}
+
+// StorePending keeps a message for a player whose connection is gone, and clears their Address,
+// as long as they are still on that connection
+func (m *Memory) StorePending(gameID, userID, connectionID, pending string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gameID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
+	p, found := gi.Players[userID]
+	if !found || p.Address != connectionID {
+		return errors.New("conditional check failed: player is not on this connection")
+	}
+
+	p.Address = ""
+	p.Pending = pending
+	p.Offline = true
+	gi.Players[userID] = p
+	return nil
+}
+
+// Enqueue puts a player in the matchmaking queue, replacing any place they already had
+func (m *Memory) Enqueue(e QueueEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue[e.UserID] = QueueItem{QueueEntry: e, Expires: e.Joined + QUEUE_EXPIRY}
+	return nil
+}
+
+// Waiting returns every player in the matchmaking queue who hasn't expired, longest waiting first
+func (m *Memory) Waiting(now int64) ([]QueueEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	waiting := []QueueEntry{}
+	for _, qi := range m.queue {
+		if qi.Expires > now {
+			waiting = append(waiting, qi.QueueEntry)
+		}
+	}
+	sortQueue(waiting)
+	return waiting, nil
+}
+
+// Dequeue takes a player out of the matchmaking queue, with the same conditions as the dynamo store
+func (m *Memory) Dequeue(userID, connectionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	qi, found := m.queue[userID]
+	if !found || (connectionID != "" && qi.ConnectionID != connectionID) {
+		return fmt.Errorf("%w: %s", ErrNotQueued, userID)
+	}
+	delete(m.queue, userID)
+	return nil
+}
+
+// StoreSpectator adds a connection to the spectators of a game, failing with ErrGameNotFound if there's no such game
+func (m *Memory) StoreSpectator(gameID, connectionID string, protocol int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gameID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
+	if gi.Spectators == nil {
+		gi.Spectators = make(map[string]SpectatorItem)
+	}
+	gi.Spectators[connectionID] = SpectatorItem{Address: connectionID, Protocol: protocol}
+	return nil
+}
+
+// RemoveSpectator stops a connection spectating a game
+func (m *Memory) RemoveSpectator(gameID, connectionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gameID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, gameID)
+	}
+	delete(gi.Spectators, connectionID)
+	return nil
+}
+
+// LimitChat counts a chat message from a player against their limit for a window of time,
+// failing with ErrChatLimited if they've already sent limit messages in it
+func (m *Memory) LimitChat(gameID, userID string, window int64, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := gameID + "#" + userID
+	cl := m.chatLimits[key]
+	if cl.Window != window {
+		cl = ChatLimitItem{Window: window}
+	}
+	if cl.Count >= limit {
+		return fmt.Errorf("%w: at most %d at a time", ErrChatLimited, limit)
+	}
+	cl.Count++
+	m.chatLimits[key] = cl
+	return nil
+}
+
+// StoreChat keeps a chat message with its game
+func (m *Memory) StoreChat(c *ChatItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chat[c.GameID] = append(m.chat[c.GameID], *c)
+	return nil
+}
+
+// RecentChat returns the last n chat messages of a game, oldest first
+func (m *Memory) RecentChat(gameID string, n int) ([]ChatItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	chat := m.chat[gameID]
+	if len(chat) > n {
+		chat = chat[len(chat)-n:]
+	}
+	return append([]ChatItem{}, chat...), nil
+}
+
+// StoreRematch records whether a player wants a rematch of a finished game, with the same
+// conditions as the dynamo store, and updates the Game with everyone else's answer
+func (m *Memory) StoreRematch(g *game.Game, userID string, want bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[g.ID]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrGameNotFound, g.ID)
+	}
+	p, found := gi.Players[userID]
+	if !found {
+		return fmt.Errorf("%w: %s in %s", ErrNotAPlayer, userID, g.ID)
+	}
+	if !gi.MatchOver || gi.NextGame != "" {
+		return fmt.Errorf("%w: %s", ErrRematchStarted, g.ID)
+	}
+	p.Rematch = want
+	gi.Players[userID] = p
+	UpdateGameFromItem(g, gi)
+	return nil
+}
+
+// LinkRematch points a finished game at its rematch, failing with ErrRematchStarted if it already has one
+func (m *Memory) LinkRematch(gameID, nextGameID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gi, found := m.games[gameID]
+	if !found || gi.NextGame != "" {
+		return fmt.Errorf("%w: %s", ErrRematchStarted, gameID)
+	}
+	gi.NextGame = nextGameID
+	return nil
+}
+
+// AddSeriesResult counts a finished match in a series, won by winner or "Tie"
+func (m *Memory) AddSeriesResult(seriesID, winner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sr := m.series[seriesID]
+	if sr == nil {
+		sr = &game.Series{ID: seriesID, Wins: map[string]int{}}
+		m.series[seriesID] = sr
+	}
+	sr.Matches++
+	if winner == "Tie" {
+		sr.Ties++
+	} else {
+		sr.Wins[winner]++
+	}
+	return nil
+}
+
+// Series returns the running total of a series, which is empty for series with no finished matches
+func (m *Memory) Series(seriesID string) (game.Series, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sr := game.Series{ID: seriesID}
+	if stored := m.series[seriesID]; stored != nil {
+		sr.Matches, sr.Ties = stored.Matches, stored.Ties
+		sr.Wins = make(map[string]int, len(stored.Wins))
+		for id, n := range stored.Wins {
+			sr.Wins[id] = n
+		}
+	}
+	return sr, nil
+}
+
+// LoadTournament returns a tournament, or ErrTournamentNotFound if it doesn't exist
+func (m *Memory) LoadTournament(tournamentID string) (*tournament.Tournament, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, found := m.tournaments[tournamentID]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrTournamentNotFound, tournamentID)
+	}
+	return t.Clone(), nil
+}
+
+// StoreTournament writes a whole tournament, as long as nobody else stored it since it was loaded.
+// Otherwise it fails with ErrStaleTournament. Version is bumped on success.
+func (m *Memory) StoreTournament(t *tournament.Tournament) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	version := 0
+	if stored, found := m.tournaments[t.ID]; found {
+		version = stored.Version
+	}
+	if version != t.Version {
+		return fmt.Errorf("%w: %s", ErrStaleTournament, t.ID)
+	}
+	t.Version++
+	m.tournaments[t.ID] = t.Clone()
+	return nil
+}
+
+// BeginRequest records that a player's request is being handled, or fails with ErrDuplicateRequest
+// and returns the earlier record if the player sent it before and it hasn't expired
+func (m *Memory) BeginRequest(userID, requestID string, now int64) (*RequestItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now >= m.requestsSwept+REQUEST_TIMEOUT {
+		for key, r := range m.requests {
+			if r.Expires < now {
+				delete(m.requests, key)
+			}
+		}
+		m.requestsSwept = now
+	}
+
+	key := userID + "#" + requestID
+	earlier, found := m.requests[key]
+	if found && earlier.Expires >= now {
+		return &earlier, fmt.Errorf("%w: %s", ErrDuplicateRequest, requestID)
+	}
+	// an expired record is replaced, like the dynamo store's conditional put does
+	m.requests[key] = RequestItem{UserID: userID, RequestID: requestID, Expires: now + REQUEST_TIMEOUT}
+	return nil, nil
+}
+
+// FinishRequest stores the outcome of a request, which is kept for REQUEST_TTL
+func (m *Memory) FinishRequest(r *RequestItem, now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r.Done = true
+	r.Expires = now + REQUEST_TTL
+	stored := *r
+	stored.Replies = append([]string{}, r.Replies...)
+	m.requests[r.UserID+"#"+r.RequestID] = stored
+	return nil
+}
+
+// ForgetRequest drops the record of a request, so a retry runs it again
+func (m *Memory) ForgetRequest(userID, requestID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.requests, userID+"#"+requestID)
+	return nil
+}
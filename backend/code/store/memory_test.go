@@ -0,0 +1,538 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+	"github.com/jbarratt/rpsls/backend/code/rating"
+	"github.com/jbarratt/rpsls/backend/code/tournament"
+)
+
+func TestMemoryGameStore(t *testing.T) {
+	testGameStore(t, NewMemory())
+}
+
+func TestMemoryLoadMissing(t *testing.T) {
+	m := NewMemory()
+	_, err := m.Load("NOPE")
+	if !errors.Is(err, ErrGameNotFound) {
+		t.Errorf("loading a missing game should fail with ErrGameNotFound: %v", err)
+	}
+}
+
+func TestMemoryStorePlayConditions(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	p1gc, _ := game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	if err := m.StoreAll(g); err != nil {
+		t.Fatalf("unable to store game: %s", err)
+	}
+
+	p1gc.Play("rock")
+	if err := m.StorePlay(p1gc); err != nil {
+		t.Fatalf("first play should be stored: %s", err)
+	}
+
+	p1gc.Play("paper")
+	if err := m.StorePlay(p1gc); !errors.Is(err, ErrStaleRound) {
+		t.Errorf("should not be able to play twice in one round: %v", err)
+	}
+
+	g2, _ := m.Load(g.ID)
+	if g2.PlayCount != 1 || g2.Players["first"].Play != "rock" {
+		t.Errorf("rejected play should not change the stored game: %+v %+v", g2, g2.Players["first"])
+	}
+
+	// a context from an older round should be rejected
+	stale, _ := game.NewGameContext("second", "2addr", g2)
+	stale.Game.Round = 0
+	stale.Play("rock")
+	if err := m.StorePlay(stale); err == nil {
+		t.Errorf("should not be able to play for a different round")
+	}
+}
+
+func TestMemoryConcurrentPlays(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	if err := m.StoreAll(g); err != nil {
+		t.Fatalf("unable to store game: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lg, err := m.Load(g.ID)
+			if err != nil {
+				t.Errorf("unable to load game: %s", err)
+				return
+			}
+			gc, _ := game.NewGameContext([]string{"first", "second"}[i%2], fmt.Sprintf("addr%d", i), lg)
+			gc.Play("rock")
+			if m.StorePlay(gc) == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stored != 2 {
+		t.Errorf("exactly one play per player should be stored, got %d", stored)
+	}
+	final, _ := m.Load(g.ID)
+	if final.PlayCount != 2 {
+		t.Errorf("play count should be 2: %+v", final)
+	}
+}
+
+func TestMemoryConcurrentRounds(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	p1, _ := game.NewGameContext("first", "1addr", g)
+	p2, _ := game.NewGameContext("second", "2addr", g)
+	m.StoreAll(g)
+	p1.Play("rock")
+	m.StorePlay(p1)
+	p2.Play("scissors")
+	m.StorePlay(p2)
+
+	// every invocation loads the game with all the plays in and works out the result,
+	// then they all try to store it at once
+	var loaded, wg sync.WaitGroup
+	var mu sync.Mutex
+	start := make(chan struct{})
+	resolved := 0
+	for i := 0; i < 50; i++ {
+		loaded.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lg, err := m.Load(g.ID)
+			loaded.Done()
+			if err != nil {
+				t.Errorf("unable to load game: %s", err)
+				return
+			}
+			if err := lg.AdvanceGame(); err != nil {
+				t.Errorf("unable to advance: %s", err)
+				return
+			}
+			<-start
+			err = m.StoreRound(lg)
+			if err == nil {
+				mu.Lock()
+				resolved++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrStaleRound) {
+				t.Errorf("expected ErrStaleRound, got %v", err)
+			}
+		}()
+	}
+	loaded.Wait()
+	// things which aren't round state can change while the round resolves
+	m.StoreSpectator(g.ID, "watcher", 1)
+	close(start)
+	wg.Wait()
+
+	if resolved != 1 {
+		t.Errorf("exactly one invocation should resolve the round, got %d", resolved)
+	}
+	if history, _ := m.History(g.ID); len(history) != 1 {
+		t.Errorf("the round should be recorded once: %+v", history)
+	}
+	if st, _ := m.Stats("first"); st.RoundsWon != 1 || st.Moves["rock"] != 1 {
+		t.Errorf("stats should be counted once: %+v", st)
+	}
+	final, _ := m.Load(g.ID)
+	if final.Round != 2 || final.Players["first"].Score != 1 || final.Spectators["watcher"] == nil {
+		t.Errorf("the round should resolve without losing the spectator: %+v", final)
+	}
+}
+
+func TestMemoryConcurrentJoins(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	game.NewGameContext("first", "1addr", g)
+	m.StoreAll(g)
+
+	// everyone loads the game while a seat is free, then they all try to take it at once
+	var loaded, wg sync.WaitGroup
+	var mu sync.Mutex
+	start := make(chan struct{})
+	seated := 0
+	for i := 0; i < 20; i++ {
+		loaded.Add(1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lg, err := m.Load(g.ID)
+			loaded.Done()
+			if err != nil {
+				t.Errorf("unable to load game: %s", err)
+				return
+			}
+			gc, err := game.NewGameContext(fmt.Sprintf("joiner%d", i), fmt.Sprintf("addr%d", i), lg)
+			if err != nil {
+				t.Errorf("a seat should look free: %s", err)
+				return
+			}
+			<-start
+			err = m.ClaimSeat(gc)
+			if err == nil {
+				mu.Lock()
+				seated++
+				mu.Unlock()
+			} else if !errors.Is(err, game.ErrGameFull) {
+				t.Errorf("expected ErrGameFull, got %v", err)
+			}
+		}(i)
+	}
+	loaded.Wait()
+	close(start)
+	wg.Wait()
+
+	if seated != 1 {
+		t.Errorf("exactly one joiner should get the seat, got %d", seated)
+	}
+	if final, _ := m.Load(g.ID); len(final.Players) != 2 {
+		t.Errorf("the game should have two players: %+v", final.Players)
+	}
+}
+
+func TestMemoryJoinTwice(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	game.NewGameContext("first", "1addr", g)
+	m.StoreAll(g)
+
+	// the same player joins from two connections, both having loaded the game before either claimed
+	a, _ := m.Load(g.ID)
+	b, _ := m.Load(g.ID)
+	ga, _ := game.NewGameContext("second", "2addr", a)
+	gb, _ := game.NewGameContext("second", "3addr", b)
+	if err := m.ClaimSeat(ga); err != nil {
+		t.Fatalf("unable to claim seat: %s", err)
+	}
+	if a.Version != g.Version+1 {
+		t.Errorf("claiming a seat should bump the version: %d", a.Version)
+	}
+	if err := m.ClaimSeat(gb); !errors.Is(err, ErrAlreadySeated) {
+		t.Errorf("the second join should find the seat taken, got %v", err)
+	}
+	if final, _ := m.Load(g.ID); final.Players["second"].Address != "2addr" {
+		t.Errorf("the second join should leave the seat alone: %+v", final.Players["second"])
+	}
+}
+
+func TestMemoryRematchAnswers(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	g.MatchOver = true
+	m.StoreAll(g)
+
+	if err := m.StoreRematch(g, "third", true); !errors.Is(err, ErrNotAPlayer) {
+		t.Errorf("only players should answer a rematch, got %v", err)
+	}
+	if err := m.StoreRematch(g, "first", true); err != nil || !g.Players["first"].Rematch {
+		t.Errorf("a player should be able to ask for a rematch: %v", err)
+	}
+	if err := m.LinkRematch(g.ID, "next"); err != nil {
+		t.Fatalf("unable to link rematch: %s", err)
+	}
+	if err := m.StoreRematch(g, "second", true); !errors.Is(err, ErrRematchStarted) {
+		t.Errorf("answers after the rematch started should fail, got %v", err)
+	}
+	if err := m.StoreRematch(g, "third", true); !errors.Is(err, ErrNotAPlayer) {
+		t.Errorf("non-players should still be told they aren't players, got %v", err)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	p1, _ := game.NewGameContext("first", "1addr", g)
+	p2, _ := game.NewGameContext("second", "2addr", g)
+	m.StoreAll(g)
+
+	for _, plays := range [][2]string{{"rock", "scissors"}, {"paper", "scissors"}} {
+		p1.Play(plays[0])
+		p2.Play(plays[1])
+		if err := g.AdvanceGame(); err != nil {
+			t.Fatalf("unable to advance: %s", err)
+		}
+		if err := m.StoreRound(g); err != nil {
+			t.Fatalf("unable to store round: %s", err)
+		}
+	}
+
+	history, err := m.History(g.ID)
+	if err != nil {
+		t.Fatalf("unable to load history: %s", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected two rounds of history: %+v", history)
+	}
+	if history[0].Round != 1 || history[0].Winner != "first" || history[0].Plays["second"] != "scissors" {
+		t.Errorf("unexpected first round: %+v", history[0])
+	}
+	if history[1].Round != 2 || history[1].Winner != "second" || history[1].Summary != "Scissors cuts Paper" {
+		t.Errorf("unexpected second round: %+v", history[1])
+	}
+
+	if empty, _ := m.History("NOPE"); len(empty) != 0 {
+		t.Errorf("unknown games have no history: %+v", empty)
+	}
+}
+
+func TestMemoryCommitReveal(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	g.FairPlay = true
+	p1, _ := game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	m.StoreAll(g)
+
+	p1.Commit(game.Commitment("rock", "n1"))
+	if err := m.StoreCommit(p1); err != nil {
+		t.Fatalf("unable to store commitment: %s", err)
+	}
+	if err := m.StoreCommit(p1); err == nil {
+		t.Errorf("should not be able to commit twice")
+	}
+
+	// reveal can't be stored before everyone commits, even if the game context is wrong about it
+	p1.Reveal("rock", "n1")
+	p1.Game.PlayCount = 2
+	if err := m.StoreReveal(p1); err == nil {
+		t.Errorf("should not be able to reveal before everyone commits")
+	}
+
+	lg, _ := m.Load(g.ID)
+	lp2, _ := game.NewGameContext("second", "2addr", lg)
+	lp2.Commit(game.Commitment("paper", "n2"))
+	if err := m.StoreCommit(lp2); err != nil {
+		t.Fatalf("unable to store second commitment: %s", err)
+	}
+	lp2.Reveal("paper", "n2")
+	if err := m.StoreReveal(lp2); err != nil {
+		t.Fatalf("unable to store reveal: %s", err)
+	}
+	if err := m.StoreReveal(lp2); err == nil {
+		t.Errorf("should not be able to reveal twice")
+	}
+	if lp2.Game.RevealCount != 1 || lp2.Game.Players["second"].Play != "paper" {
+		t.Errorf("reveal should be reflected in the game: %+v %+v", lp2.Game, lp2.Game.Players["second"])
+	}
+}
+
+func TestMemoryExpiredGames(t *testing.T) {
+	m := NewMemory()
+	g := game.NewGame()
+	g.RoundTimeout = 30
+	p1, _ := game.NewGameContext("first", "1addr", g)
+	game.NewGameContext("second", "2addr", g)
+	m.StoreAll(g)
+
+	if ids, _ := m.ExpiredGames(1_000_000); len(ids) != 0 {
+		t.Errorf("games without a running clock never expire: %v", ids)
+	}
+
+	p1.Play("rock")
+	g.StartClock(1000)
+	if err := m.StorePlay(p1); err != nil {
+		t.Fatalf("unable to store play: %s", err)
+	}
+	if ids, _ := m.ExpiredGames(1029); len(ids) != 0 {
+		t.Errorf("game should not expire before the deadline: %v", ids)
+	}
+	if ids, _ := m.ExpiredGames(1030); len(ids) != 1 || ids[0] != g.ID {
+		t.Errorf("game should expire at the deadline: %v", ids)
+	}
+
+	if _, err := g.ExpireRound(1030); err != nil {
+		t.Fatalf("unable to expire round: %s", err)
+	}
+	m.StoreRound(g)
+	if ids, _ := m.ExpiredGames(1030); len(ids) != 0 {
+		t.Errorf("resolving the round should stop the clock: %v", ids)
+	}
+	lg, _ := m.Load(g.ID)
+	if lg.Players["second"].Misses != 1 || lg.RoundTimeout != 30 {
+		t.Errorf("clock settings and misses should be stored: %+v %+v", lg, lg.Players["second"])
+	}
+}
+
+func TestMemoryLeaderboard(t *testing.T) {
+	m := NewMemory()
+	if r, _ := m.Rating("nobody"); r != rating.Default() {
+		t.Errorf("unrated players should get the default rating: %+v", r)
+	}
+	if rank, _ := m.Rank("nobody"); rank != 0 {
+		t.Errorf("unrated players should have no rank: %d", rank)
+	}
+
+	for id, r := range map[string]float64{"a": 1500, "b": 1600, "c": 1400, "d": 1500} {
+		m.StoreRating(id, rating.Rating{Rating: r, Deviation: 200, Volatility: 0.06})
+	}
+	// a moves up, past b
+	m.StoreRating("a", rating.Rating{Rating: 1700, Deviation: 180, Volatility: 0.06})
+
+	board, _ := m.Leaderboard(3)
+	expected := []Ranking{
+		{Rank: 1, UserID: "a", Rating: rating.Rating{Rating: 1700, Deviation: 180, Volatility: 0.06}},
+		{Rank: 2, UserID: "b", Rating: rating.Rating{Rating: 1600, Deviation: 200, Volatility: 0.06}},
+		{Rank: 3, UserID: "d", Rating: rating.Rating{Rating: 1500, Deviation: 200, Volatility: 0.06}},
+	}
+	if len(board) != len(expected) {
+		t.Fatalf("expected %d players on the board, got %+v", len(expected), board)
+	}
+	for i := range expected {
+		if board[i] != expected[i] {
+			t.Errorf("expected %+v at %d, got %+v", expected[i], i, board[i])
+		}
+	}
+
+	m.StoreRating("c", rating.Rating{Rating: 1500, Deviation: 200, Volatility: 0.06})
+	for id, expected := range map[string]int{"a": 1, "b": 2, "c": 3, "d": 3} {
+		if rank, _ := m.Rank(id); rank != expected {
+			t.Errorf("expected %s to be ranked %d, got %d", id, expected, rank)
+		}
+	}
+	if board, _ := m.Leaderboard(10); len(board) != 4 || board[3].Rank != 3 {
+		t.Errorf("players with the same rating should share a rank: %+v", board)
+	}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	m := NewMemory()
+	m.Enqueue(QueueEntry{UserID: "late", ConnectionID: "lateconn", Joined: 1010})
+	m.Enqueue(QueueEntry{UserID: "early", ConnectionID: "earlyconn", Joined: 1000})
+	m.Enqueue(QueueEntry{UserID: "gone", ConnectionID: "goneconn", Joined: 1000 - QUEUE_EXPIRY})
+
+	waiting, _ := m.Waiting(1020)
+	if len(waiting) != 2 || waiting[0].UserID != "early" || waiting[1].UserID != "late" {
+		t.Errorf("expected unexpired players, longest waiting first: %+v", waiting)
+	}
+
+	if err := m.Dequeue("early", "otherconn"); !errors.Is(err, ErrNotQueued) {
+		t.Errorf("another connection shouldn't dequeue the player: %v", err)
+	}
+	if err := m.Dequeue("early", "earlyconn"); err != nil {
+		t.Errorf("unable to dequeue: %s", err)
+	}
+	if err := m.Dequeue("early", ""); !errors.Is(err, ErrNotQueued) {
+		t.Errorf("players can only be dequeued once: %v", err)
+	}
+	if waiting, _ := m.Waiting(1020); len(waiting) != 1 || waiting[0].UserID != "late" {
+		t.Errorf("dequeued players should stop waiting: %+v", waiting)
+	}
+}
+
+func TestMemoryChat(t *testing.T) {
+	m := NewMemory()
+	for i := 0; i < 3; i++ {
+		if err := m.LimitChat("GAME", "p1", 7, 3); err != nil {
+			t.Errorf("message %d should be within the limit: %s", i, err)
+		}
+	}
+	if err := m.LimitChat("GAME", "p1", 7, 3); !errors.Is(err, ErrChatLimited) {
+		t.Errorf("expected ErrChatLimited, got %v", err)
+	}
+	if err := m.LimitChat("GAME", "p2", 7, 3); err != nil {
+		t.Errorf("limits are per player: %s", err)
+	}
+	if err := m.LimitChat("GAME", "p1", 8, 3); err != nil {
+		t.Errorf("a new window should start again: %s", err)
+	}
+
+	for i, text := range []string{"one", "two", "three"} {
+		m.StoreChat(&ChatItem{GameID: "GAME", UserID: "p1", Text: text, Sent: int64(i)})
+	}
+	recent, _ := m.RecentChat("GAME", 2)
+	if len(recent) != 2 || recent[0].Text != "two" || recent[1].Text != "three" {
+		t.Errorf("expected the last two messages, oldest first: %+v", recent)
+	}
+}
+
+func TestMemoryTournament(t *testing.T) {
+	m := NewMemory()
+	if _, err := m.LoadTournament("NOPE"); !errors.Is(err, ErrTournamentNotFound) {
+		t.Errorf("loading a missing tournament should fail with ErrTournamentNotFound: %v", err)
+	}
+
+	tm, _ := tournament.New(tournament.FORMAT_SWISS)
+	if err := m.StoreTournament(tm); err != nil {
+		t.Fatalf("unable to store tournament: %s", err)
+	}
+	first, _ := m.LoadTournament(tm.ID)
+	second, _ := m.LoadTournament(tm.ID)
+
+	first.Register(tournament.Entrant{UserID: "p1"})
+	if err := m.StoreTournament(first); err != nil {
+		t.Fatalf("unable to store registration: %s", err)
+	}
+	second.Register(tournament.Entrant{UserID: "p2"})
+	if err := m.StoreTournament(second); !errors.Is(err, ErrStaleTournament) {
+		t.Errorf("storing over a newer version should fail with ErrStaleTournament: %v", err)
+	}
+
+	stored, _ := m.LoadTournament(tm.ID)
+	if len(stored.Entrants) != 1 || stored.Entrants[0].UserID != "p1" || stored.Version != 2 {
+		t.Errorf("only the first registration should be stored: %+v", stored)
+	}
+}
+
+func TestMemoryRequests(t *testing.T) {
+	m := NewMemory()
+	now := int64(1_000_000)
+
+	if earlier, err := m.BeginRequest("p1", "r1", now); earlier != nil || err != nil {
+		t.Fatalf("a new request should begin: %+v %v", earlier, err)
+	}
+	earlier, err := m.BeginRequest("p1", "r1", now+1)
+	if !errors.Is(err, ErrDuplicateRequest) || earlier == nil || earlier.Done {
+		t.Errorf("a request can only begin once: %+v %v", earlier, err)
+	}
+	if _, err := m.BeginRequest("p2", "r1", now); err != nil {
+		t.Errorf("request IDs are per player: %v", err)
+	}
+
+	m.FinishRequest(&RequestItem{UserID: "p1", RequestID: "r1", Replies: []string{"ok"}}, now+1)
+	earlier, err = m.BeginRequest("p1", "r1", now+REQUEST_TTL)
+	if !errors.Is(err, ErrDuplicateRequest) || !earlier.Done || len(earlier.Replies) != 1 || earlier.Replies[0] != "ok" {
+		t.Errorf("a finished request should keep its replies: %+v %v", earlier, err)
+	}
+	if _, err := m.BeginRequest("p1", "r1", now+REQUEST_TTL+2); err != nil {
+		t.Errorf("an expired request should run again: %v", err)
+	}
+
+	m.BeginRequest("p1", "r2", now)
+	if _, err := m.BeginRequest("p1", "r2", now+REQUEST_TIMEOUT+1); err != nil {
+		t.Errorf("a request which never finished should run again after the timeout: %v", err)
+	}
+	m.ForgetRequest("p1", "r2")
+	if _, err := m.BeginRequest("p1", "r2", now+REQUEST_TIMEOUT+1); err != nil {
+		t.Errorf("a forgotten request should run again: %v", err)
+	}
+
+	// expired requests don't pile up
+	later := now + 2*REQUEST_TTL
+	m.BeginRequest("p3", "r1", later)
+	if len(m.requests) != 1 {
+		t.Errorf("expired requests should be cleared out: %+v", m.requests)
+	}
+}
@@ -0,0 +1,15 @@
+package tournament
+
+import "errors"
+
+// Errors returned by tournaments, wrapped with more detail. Callers can match them with errors.Is.
+var (
+	// ErrRegistrationClosed is returned when registering for a tournament which started, or is full
+	ErrRegistrationClosed = errors.New("registration is closed")
+	// ErrAlreadyStarted is returned when starting a tournament twice
+	ErrAlreadyStarted = errors.New("tournament already started")
+	// ErrNotEnoughPlayers is returned when starting a tournament with fewer than MIN_PLAYERS registered
+	ErrNotEnoughPlayers = errors.New("not enough players")
+	// ErrUnknownMatch is returned when reporting a game which isn't an unfinished match of the current round
+	ErrUnknownMatch = errors.New("not a match in the current round")
+)
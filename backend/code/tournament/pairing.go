@@ -0,0 +1,139 @@
+package tournament
+
+// bracket returns the seeds, counting from 1, in the order they're placed in a single elimination
+// bracket of size players, e.g. 1 8 4 5 2 7 3 6. Each seed meets the weakest one left in round one,
+// and the top two seeds can only meet in the final.
+func bracket(size int) []int {
+	seeds := []int{1}
+	for len(seeds) < size {
+		n := len(seeds) * 2
+		next := make([]int, 0, n)
+		for _, s := range seeds {
+			next = append(next, s, n+1-s)
+		}
+		seeds = next
+	}
+	return seeds
+}
+
+// pairElimination pairs the next round of a single elimination tournament. The first round is
+// paired from the seeding, with byes for the top seeds if the field isn't a power of two, and
+// after that the winners of neighbouring matches meet.
+func (t *Tournament) pairElimination() []Pairing {
+	pairings := []Pairing{}
+	if t.Round == 1 {
+		seeds := bracket(1 << uint(t.Rounds))
+		for i := 0; i < len(seeds); i += 2 {
+			p := Pairing{A: t.Entrants[seeds[i]-1].UserID}
+			if seeds[i+1] <= len(t.Entrants) {
+				p.B = t.Entrants[seeds[i+1]-1].UserID
+			}
+			pairings = append(pairings, p)
+		}
+		return pairings
+	}
+
+	winners := []string{}
+	for _, p := range t.Pairings {
+		if p.Round == t.Round-1 {
+			winners = append(winners, p.Winner)
+		}
+	}
+	for i := 0; i+1 < len(winners); i += 2 {
+		pairings = append(pairings, Pairing{A: winners[i], B: winners[i+1]})
+	}
+	return pairings
+}
+
+// played reports whether two players have already met
+func (t *Tournament) played(a, b string) bool {
+	for _, p := range t.Pairings {
+		if (p.A == a && p.B == b) || (p.A == b && p.B == a) {
+			return true
+		}
+	}
+	return false
+}
+
+// hadBye reports whether a player has already had a bye
+func (t *Tournament) hadBye(userID string) bool {
+	for _, p := range t.Pairings {
+		if p.Bye() && p.A == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// PAIRING_ATTEMPTS is how many opponents pairSwiss tries while avoiding rematches. Searching every
+// way to pair a large field can take exponentially long, so after this rematches are allowed.
+const PAIRING_ATTEMPTS = 10_000
+
+// pairSwiss pairs the next round of a Swiss tournament. Players are taken in order of the
+// standings, and each meets the best placed player they haven't played yet, as long as everyone
+// below can still be paired without a rematch. If that isn't possible, or can't be found within
+// PAIRING_ATTEMPTS, each player in turn meets the best placed player left they haven't played,
+// or the next one if they've played them all.
+// With an odd number of players, the lowest placed player who hasn't had a bye sits out.
+func (t *Tournament) pairSwiss() []Pairing {
+	order := []string{}
+	for _, s := range t.Standings() {
+		order = append(order, s.UserID)
+	}
+
+	pairings := []Pairing{}
+	if len(order)%2 == 1 {
+		bye := len(order) - 1
+		for i := len(order) - 1; i >= 0; i-- {
+			if !t.hadBye(order[i]) {
+				bye = i
+				break
+			}
+		}
+		pairings = append(pairings, Pairing{A: order[bye]})
+		order = append(order[:bye], order[bye+1:]...)
+	}
+
+	attempts := PAIRING_ATTEMPTS
+	if fresh, ok := t.pairFresh(order, &attempts); ok {
+		return append(pairings, fresh...)
+	}
+	for len(order) > 1 {
+		opponent := 1
+		for i := 1; i < len(order); i++ {
+			if !t.played(order[0], order[i]) {
+				opponent = i
+				break
+			}
+		}
+		pairings = append(pairings, Pairing{A: order[0], B: order[opponent]})
+		order = append(order[1:opponent], order[opponent+1:]...)
+	}
+	return pairings
+}
+
+// pairFresh pairs off players so nobody meets someone they've already played, preferring
+// opponents close in the order. It reports false if there is no way to do it, or if it runs out
+// of attempts looking.
+func (t *Tournament) pairFresh(order []string, attempts *int) ([]Pairing, bool) {
+	if len(order) == 0 {
+		return []Pairing{}, true
+	}
+	a := order[0]
+	for i := 1; i < len(order); i++ {
+		if *attempts <= 0 {
+			return nil, false
+		}
+		*attempts--
+		if t.played(a, order[i]) {
+			continue
+		}
+		rest := make([]string, 0, len(order)-2)
+		rest = append(rest, order[1:i]...)
+		rest = append(rest, order[i+1:]...)
+		if pairings, ok := t.pairFresh(rest, attempts); ok {
+			return append([]Pairing{{A: a, B: order[i]}}, pairings...), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,354 @@
+// Package tournament runs single elimination and Swiss tournaments, pairing registered players
+// round by round and advancing them as each match reports its result
+package tournament
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/jbarratt/rpsls/backend/code/game"
+)
+
+// Formats, which decide how players are paired and when the tournament is over
+const (
+	// FORMAT_SINGLE_ELIMINATION knocks out the loser of every match until one player is left
+	FORMAT_SINGLE_ELIMINATION = "single"
+	// FORMAT_SWISS plays a fixed number of rounds, pairing players with similar scores
+	FORMAT_SWISS = "swiss"
+)
+
+// States a tournament moves through
+const (
+	STATE_REGISTERING = "registering"
+	STATE_RUNNING     = "running"
+	STATE_FINISHED    = "finished"
+)
+
+const (
+	// MIN_PLAYERS is how many players must register before a tournament can start
+	MIN_PLAYERS = 2
+	// MAX_PLAYERS is the most players a tournament takes
+	MAX_PLAYERS = 64
+	// MAX_ROUNDS is the most rounds a Swiss tournament can ask for
+	MAX_ROUNDS = 12
+	// TOURNAMENTID_LENGTH is the length of generated tournament IDs
+	TOURNAMENTID_LENGTH = 6
+	// TIE is the Winner of a drawn match
+	TIE = "Tie"
+)
+
+// DEFAULT_MATCH is how long each match runs unless the tournament asks for something else
+var DEFAULT_MATCH = game.MatchFormat{Mode: game.MATCH_BEST_OF, Length: 3}
+
+// Entrant is a registered player
+type Entrant struct {
+	UserID string
+	// ConnectionID is where the player registered from, which is told about standings
+	// and seated in their matches
+	ConnectionID string
+	// Protocol is the message protocol version the player's client speaks
+	Protocol int
+}
+
+// Pairing is a single match in a round
+type Pairing struct {
+	Round int
+	// A and B are the players. B is empty when A has a bye.
+	A string
+	B string
+	// GameID is the game the match is played in, once it has been created
+	GameID string
+	// Winner is the Entrant.UserID which won the match, TIE, or empty until it's reported
+	Winner string
+}
+
+// Bye reports whether the pairing is a bye, which has no match to play
+func (p *Pairing) Bye() bool {
+	return p.B == ""
+}
+
+// Tournament is a set of players and the rounds of matches they play
+type Tournament struct {
+	ID   string
+	Name string
+	// Organizer is the user who created the tournament, and the only one who can start it
+	Organizer string
+	Format    string
+	// Ruleset, Match, RoundTimeout and MaxMisses are the settings of every match
+	Ruleset      string
+	Match        game.MatchFormat
+	RoundTimeout int
+	MaxMisses    int
+	// Rounds is how many rounds are played. Swiss tournaments can pick it, or leave it to be
+	// worked out from the number of players on Start, like single elimination always is.
+	Rounds int
+	// Round is the round being played, 0 before the start
+	Round int
+	State string
+	// Entrants are the registered players, in seed order once started
+	Entrants []Entrant
+	// Pairings holds the matches of every round so far, in order
+	Pairings []Pairing
+	// Winner is the Entrant.UserID which won the tournament, once it's finished
+	Winner string
+	// Version counts how many times the tournament has been stored, so concurrent updates can be spotted
+	Version int
+}
+
+// Standing is how a player is doing in a tournament
+type Standing struct {
+	Rank   int
+	UserID string
+	// Points are 1 for a win or bye, and 0.5 for a tie
+	Points float64
+	Wins   int
+	Losses int
+	Ties   int
+	Byes   int
+	// Eliminated is set once a player is knocked out of a single elimination tournament
+	Eliminated bool
+}
+
+// New returns a tournament open for registration, playing DEFAULT_MATCH matches of the default ruleset
+func New(format string) (*Tournament, error) {
+	if format != FORMAT_SINGLE_ELIMINATION && format != FORMAT_SWISS {
+		return nil, fmt.Errorf("%w: unknown tournament format %s", game.ErrInvalidOptions, format)
+	}
+	id, _ := game.GenerateRandomString(TOURNAMENTID_LENGTH)
+	return &Tournament{
+		ID:       id,
+		Format:   format,
+		Ruleset:  game.DEFAULT_RULESET,
+		Match:    DEFAULT_MATCH,
+		State:    STATE_REGISTERING,
+		Entrants: []Entrant{},
+		Pairings: []Pairing{},
+	}, nil
+}
+
+// Validate checks the tournament's settings make sense. Matches have to finish for the winner
+// to advance, so they can't be endless.
+func (t *Tournament) Validate() error {
+	if _, err := game.LookupRuleset(t.Ruleset); err != nil {
+		return err
+	}
+	if err := t.Match.Validate(); err != nil {
+		return err
+	}
+	if t.Match.Mode == game.MATCH_ENDLESS {
+		return fmt.Errorf("%w: tournament matches need a match format", game.ErrInvalidOptions)
+	}
+	switch {
+	case t.Rounds < 0 || t.Rounds > MAX_ROUNDS:
+		return fmt.Errorf("%w: tournaments have up to %d rounds", game.ErrInvalidOptions, MAX_ROUNDS)
+	case t.Rounds > 0 && t.Format != FORMAT_SWISS:
+		return fmt.Errorf("%w: only swiss tournaments can pick their rounds", game.ErrInvalidOptions)
+	}
+	g := game.Game{RoundTimeout: t.RoundTimeout, MaxMisses: t.MaxMisses}
+	return g.ValidateClock()
+}
+
+// Entrant returns the registered player with the given ID, or nil
+func (t *Tournament) Entrant(userID string) *Entrant {
+	for i := range t.Entrants {
+		if t.Entrants[i].UserID == userID {
+			return &t.Entrants[i]
+		}
+	}
+	return nil
+}
+
+// Register adds a player to the tournament. A player who already registered can register again
+// at any time, which just moves them to the new connection.
+func (t *Tournament) Register(e Entrant) error {
+	if existing := t.Entrant(e.UserID); existing != nil {
+		existing.ConnectionID = e.ConnectionID
+		existing.Protocol = e.Protocol
+		return nil
+	}
+	if t.State != STATE_REGISTERING {
+		return fmt.Errorf("%w: tournament %s is %s", ErrRegistrationClosed, t.ID, t.State)
+	}
+	if len(t.Entrants) >= MAX_PLAYERS {
+		return fmt.Errorf("%w: tournament %s is full", ErrRegistrationClosed, t.ID)
+	}
+	t.Entrants = append(t.Entrants, e)
+	return nil
+}
+
+// Seed orders the players by rating, best first, keeping registration order between equal ratings.
+// The top seeds are kept apart in single elimination brackets, and get byes first.
+func (t *Tournament) Seed(ratings map[string]float64) {
+	sort.SliceStable(t.Entrants, func(i, j int) bool {
+		return ratings[t.Entrants[i].UserID] > ratings[t.Entrants[j].UserID]
+	})
+}
+
+// Start closes registration and pairs the first round
+func (t *Tournament) Start() error {
+	if t.State != STATE_REGISTERING {
+		return fmt.Errorf("%w: tournament %s is %s", ErrAlreadyStarted, t.ID, t.State)
+	}
+	if len(t.Entrants) < MIN_PLAYERS {
+		return fmt.Errorf("%w: %d registered, %d needed", ErrNotEnoughPlayers, len(t.Entrants), MIN_PLAYERS)
+	}
+	if t.Format == FORMAT_SINGLE_ELIMINATION || t.Rounds == 0 {
+		// enough rounds for a single elimination bracket to finish, or for a
+		// Swiss tournament to have at most one unbeaten player
+		t.Rounds = bits.Len(uint(len(t.Entrants) - 1))
+	}
+	t.State = STATE_RUNNING
+	t.nextRound()
+	return nil
+}
+
+// Current returns the pairings of the round being played
+func (t *Tournament) Current() []*Pairing {
+	current := []*Pairing{}
+	for i := range t.Pairings {
+		if t.Pairings[i].Round == t.Round {
+			current = append(current, &t.Pairings[i])
+		}
+	}
+	return current
+}
+
+// Unscheduled returns the matches of the current round which don't have a game yet
+func (t *Tournament) Unscheduled() []*Pairing {
+	unscheduled := []*Pairing{}
+	for _, p := range t.Current() {
+		if !p.Bye() && p.GameID == "" {
+			unscheduled = append(unscheduled, p)
+		}
+	}
+	return unscheduled
+}
+
+// Report records the result of a match in the current round, given the game's match winner.
+// Once every match of the round is in, the next round is paired, or the tournament finishes.
+func (t *Tournament) Report(gameID, winner string) error {
+	var pairing *Pairing
+	for _, p := range t.Current() {
+		if p.GameID == gameID && p.Winner == "" {
+			pairing = p
+		}
+	}
+	if pairing == nil || t.State != STATE_RUNNING {
+		return fmt.Errorf("%w: %s", ErrUnknownMatch, gameID)
+	}
+
+	switch {
+	case winner == pairing.A || winner == pairing.B:
+		pairing.Winner = winner
+	case t.Format == FORMAT_SINGLE_ELIMINATION:
+		// somebody has to go through, so a drawn match goes to the better seed
+		pairing.Winner = pairing.A
+		if t.seed(pairing.B) < t.seed(pairing.A) {
+			pairing.Winner = pairing.B
+		}
+	default:
+		pairing.Winner = TIE
+	}
+
+	for _, p := range t.Current() {
+		if p.Winner == "" {
+			return nil
+		}
+	}
+	if t.Round >= t.Rounds {
+		t.finish()
+		return nil
+	}
+	t.nextRound()
+	return nil
+}
+
+// finish ends the tournament. The winner is whoever tops the standings, which in single
+// elimination is the only player never knocked out.
+func (t *Tournament) finish() {
+	t.State = STATE_FINISHED
+	t.Winner = t.Standings()[0].UserID
+}
+
+// nextRound moves on to the next round and pairs it. Byes are won straight away.
+func (t *Tournament) nextRound() {
+	t.Round++
+	var pairings []Pairing
+	if t.Format == FORMAT_SINGLE_ELIMINATION {
+		pairings = t.pairElimination()
+	} else {
+		pairings = t.pairSwiss()
+	}
+	for _, p := range pairings {
+		p.Round = t.Round
+		if p.Bye() {
+			p.Winner = p.A
+		}
+		t.Pairings = append(t.Pairings, p)
+	}
+}
+
+// seed returns a player's position in the seeding, 0 for the top seed
+func (t *Tournament) seed(userID string) int {
+	for i, e := range t.Entrants {
+		if e.UserID == userID {
+			return i
+		}
+	}
+	return len(t.Entrants)
+}
+
+// Standings returns every player, best first: by points, then by seed. In single
+// elimination players still in the tournament are ahead of everyone knocked out.
+func (t *Tournament) Standings() []Standing {
+	standings := make([]Standing, len(t.Entrants))
+	index := make(map[string]*Standing, len(t.Entrants))
+	for i, e := range t.Entrants {
+		standings[i].UserID = e.UserID
+		index[e.UserID] = &standings[i]
+	}
+
+	for _, p := range t.Pairings {
+		a, b := index[p.A], index[p.B]
+		switch {
+		case p.Winner == "":
+		case p.Bye():
+			a.Byes++
+			a.Points++
+		case p.Winner == TIE:
+			a.Ties++
+			b.Ties++
+			a.Points += 0.5
+			b.Points += 0.5
+		default:
+			winner, loser := a, b
+			if p.Winner == p.B {
+				winner, loser = b, a
+			}
+			winner.Wins++
+			winner.Points++
+			loser.Losses++
+			loser.Eliminated = t.Format == FORMAT_SINGLE_ELIMINATION
+		}
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		if standings[i].Eliminated != standings[j].Eliminated {
+			return !standings[i].Eliminated
+		}
+		return standings[i].Points > standings[j].Points
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+	}
+	return standings
+}
+
+// Clone returns a copy of the tournament which shares nothing with it
+func (t *Tournament) Clone() *Tournament {
+	c := *t
+	c.Entrants = append([]Entrant{}, t.Entrants...)
+	c.Pairings = append([]Pairing{}, t.Pairings...)
+	return &c
+}
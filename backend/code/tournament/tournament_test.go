@@ -0,0 +1,314 @@
+package tournament
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTournament returns a started tournament between players p1, p2, ... seeded in that order
+func newTournament(t *testing.T, format string, players int) *Tournament {
+	t.Helper()
+	tm, err := New(format)
+	if err != nil {
+		t.Fatalf("unable to create tournament: %s", err)
+	}
+	for i := 1; i <= players; i++ {
+		if err := tm.Register(Entrant{UserID: fmt.Sprintf("p%d", i)}); err != nil {
+			t.Fatalf("unable to register: %s", err)
+		}
+	}
+	if err := tm.Start(); err != nil {
+		t.Fatalf("unable to start: %s", err)
+	}
+	return tm
+}
+
+// schedule gives every unscheduled match of the current round a game named after its players
+func schedule(tm *Tournament) {
+	for _, p := range tm.Unscheduled() {
+		p.GameID = p.A + "-" + p.B
+	}
+}
+
+// matches returns the current round's matches as "A-B", with byes as just "A"
+func matches(tm *Tournament) []string {
+	out := []string{}
+	for _, p := range tm.Current() {
+		if p.Bye() {
+			out = append(out, p.A)
+		} else {
+			out = append(out, p.A+"-"+p.B)
+		}
+	}
+	return out
+}
+
+func TestBracket(t *testing.T) {
+	cases := map[int][]int{
+		1: {1},
+		2: {1, 2},
+		4: {1, 4, 2, 3},
+		8: {1, 8, 4, 5, 2, 7, 3, 6},
+	}
+	for size, expected := range cases {
+		if got := bracket(size); !reflect.DeepEqual(got, expected) {
+			t.Errorf("bracket of %d: expected %v, got %v", size, expected, got)
+		}
+	}
+}
+
+func TestSingleElimination(t *testing.T) {
+	tm := newTournament(t, FORMAT_SINGLE_ELIMINATION, 5)
+	if tm.Rounds != 3 {
+		t.Errorf("5 players need 3 rounds, got %d", tm.Rounds)
+	}
+	// the top three seeds get byes
+	expected := []string{"p1", "p4-p5", "p2", "p3"}
+	if got := matches(tm); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected round one %v, got %v", expected, got)
+	}
+	schedule(tm)
+	if err := tm.Report("p4-p5", "p5"); err != nil {
+		t.Fatalf("unable to report: %s", err)
+	}
+	if err := tm.Report("p4-p5", "p4"); !errors.Is(err, ErrUnknownMatch) {
+		t.Errorf("reporting a match twice should fail, got %v", err)
+	}
+
+	expected = []string{"p1-p5", "p2-p3"}
+	if got := matches(tm); tm.Round != 2 || !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected round two %v, got round %d %v", expected, tm.Round, got)
+	}
+	schedule(tm)
+	tm.Report("p1-p5", "p5")
+	// a drawn match goes to the better seed
+	tm.Report("p2-p3", TIE)
+
+	expected = []string{"p5-p2"}
+	if got := matches(tm); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected the final %v, got %v", expected, got)
+	}
+	schedule(tm)
+	tm.Report("p5-p2", "p5")
+	if tm.State != STATE_FINISHED || tm.Winner != "p5" {
+		t.Fatalf("p5 should have won, got %s won by %q", tm.State, tm.Winner)
+	}
+
+	standings := tm.Standings()
+	if standings[0].UserID != "p5" || standings[0].Wins != 3 || standings[0].Eliminated {
+		t.Errorf("the winner should top the standings with 3 wins, got %+v", standings[0])
+	}
+	for _, s := range standings[1:] {
+		if !s.Eliminated {
+			t.Errorf("everyone but the winner should be eliminated, got %+v", s)
+		}
+	}
+}
+
+func TestSwiss(t *testing.T) {
+	tm := newTournament(t, FORMAT_SWISS, 5)
+	if tm.Rounds != 3 {
+		t.Errorf("5 players should get 3 rounds, got %d", tm.Rounds)
+	}
+
+	byes := map[string]bool{}
+	for round := 1; round <= tm.Rounds; round++ {
+		if tm.Round != round {
+			t.Fatalf("expected round %d, got %d", round, tm.Round)
+		}
+		schedule(tm)
+		for _, p := range tm.Current() {
+			if p.Bye() {
+				if byes[p.A] {
+					t.Errorf("%s had a second bye", p.A)
+				}
+				byes[p.A] = true
+				continue
+			}
+			// the first player always wins, except ties in the last round
+			winner := p.A
+			if round == tm.Rounds {
+				winner = TIE
+			}
+			if err := tm.Report(p.GameID, winner); err != nil {
+				t.Fatalf("unable to report %s: %s", p.GameID, err)
+			}
+		}
+	}
+	if tm.State != STATE_FINISHED {
+		t.Fatalf("tournament should be finished, got %s", tm.State)
+	}
+
+	met := map[string]bool{}
+	for _, p := range tm.Pairings {
+		if p.Bye() {
+			continue
+		}
+		key := p.A + p.B
+		if p.B < p.A {
+			key = p.B + p.A
+		}
+		if met[key] {
+			t.Errorf("%s and %s met twice", p.A, p.B)
+		}
+		met[key] = true
+	}
+
+	standings := tm.Standings()
+	if tm.Winner != standings[0].UserID {
+		t.Errorf("winner %s should top the standings, got %+v", tm.Winner, standings)
+	}
+	total := 0.0
+	for i, s := range standings {
+		total += s.Points
+		if i > 0 && s.Points > standings[i-1].Points {
+			t.Errorf("standings out of order: %+v", standings)
+		}
+	}
+	// 2 matches and a bye a round, each worth a point
+	if total != 9 {
+		t.Errorf("expected 9 points handed out, got %v", total)
+	}
+}
+
+// within fails the test if f doesn't return in time. f runs on another goroutine, so it
+// mustn't call t.Fatal.
+func within(t *testing.T, limit time.Duration, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(limit):
+		t.Fatalf("took longer than %s", limit)
+	}
+}
+
+// rematches counts the pairings of a round between players who had already met
+func rematches(tm *Tournament, round int) int {
+	n := 0
+	for i, p := range tm.Pairings {
+		if p.Round != round || p.Bye() {
+			continue
+		}
+		for _, before := range tm.Pairings[:i] {
+			if before.Round < round && ((before.A == p.A && before.B == p.B) || (before.A == p.B && before.B == p.A)) {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+func TestSwissLargeField(t *testing.T) {
+	tm, err := New(FORMAT_SWISS)
+	if err != nil {
+		t.Fatalf("unable to create tournament: %s", err)
+	}
+	tm.Rounds = MAX_ROUNDS
+	for i := 1; i <= MAX_PLAYERS; i++ {
+		if err := tm.Register(Entrant{UserID: fmt.Sprintf("p%d", i)}); err != nil {
+			t.Fatalf("unable to register: %s", err)
+		}
+	}
+
+	within(t, 10*time.Second, func() {
+		if err := tm.Start(); err != nil {
+			t.Errorf("unable to start: %s", err)
+			return
+		}
+		for round := 1; round <= MAX_ROUNDS; round++ {
+			if got := len(tm.Current()); got != MAX_PLAYERS/2 {
+				t.Errorf("round %d: expected %d matches, got %d", round, MAX_PLAYERS/2, got)
+				return
+			}
+			if n := rematches(tm, round); n != 0 {
+				t.Errorf("round %d: %d rematches when fresh pairings exist", round, n)
+			}
+			schedule(tm)
+			for _, p := range tm.Current() {
+				if err := tm.Report(p.GameID, p.A); err != nil {
+					t.Errorf("unable to report %s: %s", p.GameID, err)
+					return
+				}
+			}
+		}
+	})
+	if tm.State != STATE_FINISHED {
+		t.Errorf("tournament should be finished, got %s", tm.State)
+	}
+}
+
+func TestSwissNoFreshPairing(t *testing.T) {
+	tm := &Tournament{Format: FORMAT_SWISS, Rounds: MAX_ROUNDS, Round: 2, State: STATE_RUNNING}
+	for i := 1; i <= MAX_PLAYERS; i++ {
+		tm.Entrants = append(tm.Entrants, Entrant{UserID: fmt.Sprintf("p%d", i)})
+	}
+	// the last player has lost to everyone, so there's no way round a rematch, and they're last
+	// in the standings, so searching for one tries every way to pair everybody else first
+	last := tm.Entrants[MAX_PLAYERS-1].UserID
+	for _, e := range tm.Entrants[:MAX_PLAYERS-1] {
+		tm.Pairings = append(tm.Pairings, Pairing{Round: 1, A: e.UserID, B: last, Winner: e.UserID})
+	}
+
+	var pairings []Pairing
+	within(t, 10*time.Second, func() {
+		pairings = tm.pairSwiss()
+	})
+	for _, p := range pairings {
+		p.Round = tm.Round
+		tm.Pairings = append(tm.Pairings, p)
+	}
+	if len(pairings) != MAX_PLAYERS/2 || rematches(tm, tm.Round) != 1 {
+		t.Errorf("expected everyone paired with the one rematch they can't avoid: %+v", pairings)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	tm, err := New(FORMAT_SWISS)
+	if err != nil {
+		t.Fatalf("unable to create tournament: %s", err)
+	}
+	if _, err := New("roundrobin"); err == nil {
+		t.Errorf("unknown formats should be rejected")
+	}
+
+	tm.Register(Entrant{UserID: "p1", ConnectionID: "c1"})
+	if err := tm.Start(); !errors.Is(err, ErrNotEnoughPlayers) {
+		t.Errorf("starting with one player should fail, got %v", err)
+	}
+	tm.Register(Entrant{UserID: "p2", ConnectionID: "c2"})
+	tm.Seed(map[string]float64{"p1": 1400, "p2": 1600})
+	if err := tm.Start(); err != nil {
+		t.Fatalf("unable to start: %s", err)
+	}
+	if tm.Entrants[0].UserID != "p2" {
+		t.Errorf("the better rated player should be the top seed, got %+v", tm.Entrants)
+	}
+	if err := tm.Start(); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("starting twice should fail, got %v", err)
+	}
+
+	if err := tm.Register(Entrant{UserID: "p3"}); !errors.Is(err, ErrRegistrationClosed) {
+		t.Errorf("registering after the start should fail, got %v", err)
+	}
+	if err := tm.Register(Entrant{UserID: "p1", ConnectionID: "c3"}); err != nil {
+		t.Errorf("registered players should be able to move connection, got %v", err)
+	}
+	if tm.Entrant("p1").ConnectionID != "c3" {
+		t.Errorf("p1 should have moved to c3, got %+v", tm.Entrant("p1"))
+	}
+
+	c := tm.Clone()
+	c.Entrants[0].UserID = "changed"
+	if tm.Entrants[0].UserID == "changed" {
+		t.Errorf("clones should not share entrants")
+	}
+}
@@ -31,6 +31,15 @@ function App() {
     // Handler which runs every time a message comes from the websocket.
     _this.ws.onmessage = e => {
         d = JSON.parse(e.data)
+        // Game states come without a type. Anything else (presence, chat, ...) is
+        // ignored, except errors, which are shown so a rejected play can be retried.
+        if ("type" in d) {
+          if (d.type == "error") {
+            _this.statusElem.innerHTML = `Error: ${d.message}`
+            _this.played = false
+          }
+          return
+        }
         // Only when needed:
         // Add the game ID to the URL so the link can be shared with others
         if (_this.gameId != d.gameId && d.gameId != "") {